@@ -12,8 +12,11 @@ import (
 
 	"github.com/atvirokodosprendimai/knitu/internal/agent/docker"
 	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/atvirokodosprendimai/knitu/internal/wgmesh"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/urfave/cli/v3"
 )
 
@@ -36,11 +39,49 @@ func main() {
 						Value: "/var/lib/knit-agent/node-id",
 						Usage: "Path to persistent node id file",
 					},
+					&cli.StringFlag{
+						Name:  "data-dir",
+						Value: "/var/lib/knit-agent",
+						Usage: "Directory for agent state; rendered templates are kept under <data-dir>/alloc",
+					},
+					&cli.StringFlag{
+						Name:  "allow-host-paths",
+						Usage: "Comma-separated directories that deployments may bind-mount host paths from; none if empty",
+					},
+					&cli.StringFlag{
+						Name:  "secrets-dir",
+						Value: "/dev/shm/knit-secrets",
+						Usage: "Directory on a tmpfs where secret files are materialised for containers; the agent does not start if it is on another filesystem",
+					},
+					&cli.StringFlag{
+						Name:  "mesh-ip",
+						Value: "",
+						Usage: "Address other nodes reach this node's published ports on, exposed to templates as .Node.MeshIP",
+					},
+					&cli.StringFlag{
+						Name:  "wg-mesh-socket",
+						Value: "/var/run/wgmesh.sock",
+						Usage: "Path to the wg-mesh Unix socket, used to route mesh network subnets",
+					},
+					&cli.FloatFlag{
+						Name:  "reserved-cpu",
+						Usage: "CPU cores kept for the system, not allocatable to containers",
+					},
+					&cli.Int64Flag{
+						Name:  "reserved-memory-mb",
+						Value: 256,
+						Usage: "Memory in MB kept for the system, not allocatable to containers",
+					},
 					&cli.StringFlag{
 						Name:  "labels",
 						Value: "",
 						Usage: "Node labels as comma-separated key=value pairs (e.g., region=eu,role=api)",
 					},
+					&cli.StringFlag{
+						Name:  "taints",
+						Value: "",
+						Usage: "Node taints as comma-separated key[=value]:effect entries, effect NoSchedule or NoExecute (e.g., dedicated=gpu:NoSchedule)",
+					},
 				},
 				Action: runAgent,
 			},
@@ -67,6 +108,22 @@ func runAgent(ctx context.Context, cmd *cli.Command) error {
 
 	log.Printf("Agent initialized with Node ID: %s on Host: %s", nodeID, hostname)
 	labels := parseLabels(cmd.String("labels"))
+	meshIP := cmd.String("mesh-ip")
+	taints, err := parseTaints(cmd.String("taints"))
+	if err != nil {
+		return err
+	}
+	reserved := reservation{cpu: cmd.Float("reserved-cpu"), memoryMB: cmd.Int64("reserved-memory-mb")}
+	if reserved.cpu < 0 || reserved.memoryMB < 0 {
+		return fmt.Errorf("reserved resources must not be negative")
+	}
+	hostPaths, err := parseHostPaths(cmd.String("allow-host-paths"))
+	if err != nil {
+		return err
+	}
+	if err := docker.PrepareSecretsDir(cmd.String("secrets-dir")); err != nil {
+		return err
+	}
 
 	// 1. Connect to NATS via the provided URL
 	natsURL := cmd.Value("nats-url").(string)
@@ -78,25 +135,48 @@ func runAgent(ctx context.Context, cmd *cli.Command) error {
 	defer nc.Close()
 
 	// 2. Create Docker Client
-	dockerClient, err := docker.NewClient()
+	dockerClient, err := docker.NewClient(cmd.String("data-dir"), cmd.String("secrets-dir"), hostPaths, docker.NodeInfo{
+		ID:       nodeID,
+		Hostname: hostname,
+		MeshIP:   meshIP,
+		Labels:   labels,
+	})
 	if err != nil {
 		return err
 	}
 
-	// 3. Subscribe to deployment tasks
-	_, err = nc.Subscribe(messaging.SubjectTaskDeployBroadcast, deploymentTaskHandler(ctx, nodeID, dockerClient, nc))
+	// 3. Consume tasks from the durable JetStream task stream. Tasks published
+	// while the agent is offline are delivered once it reconnects.
+	js, err := jetstream.New(nc)
 	if err != nil {
-		return fmt.Errorf("could not subscribe to deployment tasks: %w", err)
+		return fmt.Errorf("could not create JetStream context: %w", err)
 	}
-	_, err = nc.Subscribe(messaging.SubjectTaskDeployNode(nodeID), deploymentTaskHandler(ctx, nodeID, dockerClient, nc))
+	nodeConsumer, err := messaging.NodeTaskConsumer(ctx, js, nodeID)
 	if err != nil {
-		return fmt.Errorf("could not subscribe to node deployment tasks: %w", err)
+		return fmt.Errorf("could not create node task consumer (is the server running?): %w", err)
 	}
-	_, err = nc.Subscribe(messaging.SubjectTaskUndeployBroadcast, undeployTaskHandler(ctx, nodeID, dockerClient, nc))
+	broadcastConsumer, err := messaging.BroadcastDeployConsumer(ctx, js)
 	if err != nil {
-		return fmt.Errorf("could not subscribe to undeploy tasks: %w", err)
+		return fmt.Errorf("could not create broadcast deploy consumer: %w", err)
 	}
-	log.Println("Subscribed to deployment tasks.")
+	nodeCC, err := nodeConsumer.Consume(taskHandler(ctx, nodeID, dockerClient, nc))
+	if err != nil {
+		return fmt.Errorf("could not consume node tasks: %w", err)
+	}
+	defer nodeCC.Stop()
+	broadcastCC, err := broadcastConsumer.Consume(taskHandler(ctx, nodeID, dockerClient, nc))
+	if err != nil {
+		return fmt.Errorf("could not consume broadcast deploy tasks: %w", err)
+	}
+	defer broadcastCC.Stop()
+	log.Println("Consuming deployment tasks.")
+
+	// Mesh network config arrives after every heartbeat.
+	meshSub, err := nc.Subscribe(messaging.SubjectAgentNetwork(nodeID), meshConfigHandler(ctx, dockerClient, wgmesh.NewClient(cmd.String("wg-mesh-socket"))))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to mesh network config: %w", err)
+	}
+	defer meshSub.Unsubscribe()
 
 	// 4. Start heartbeat ticker
 	ticker := time.NewTicker(15 * time.Second)
@@ -105,7 +185,13 @@ func runAgent(ctx context.Context, cmd *cli.Command) error {
 	for {
 		select {
 		case <-ticker.C:
-			publishHeartbeat(nc, nodeID, hostname, labels)
+			publishHeartbeat(ctx, nc, dockerClient, messaging.Heartbeat{
+				NodeID:   nodeID,
+				Hostname: hostname,
+				Labels:   labels,
+				Taints:   taints,
+				MeshIP:   meshIP,
+			}, reserved)
 		case <-ctx.Done():
 			log.Println("Shutting down agent...")
 			return nil
@@ -113,13 +199,29 @@ func runAgent(ctx context.Context, cmd *cli.Command) error {
 	}
 }
 
-func publishHeartbeat(nc *nats.Conn, nodeID, hostname string, labels map[string]string) {
-	hb := messaging.Heartbeat{
-		NodeID:    nodeID,
-		Hostname:  hostname,
-		Labels:    labels,
-		Timestamp: time.Now(),
+// reservation is the CPU and memory the agent keeps for the system.
+type reservation struct {
+	cpu      float64
+	memoryMB int64
+}
+
+// publishHeartbeat completes hb, which carries the node's identity, with
+// its containers and resources and publishes it.
+func publishHeartbeat(ctx context.Context, nc *nats.Conn, dc *docker.Client, hb messaging.Heartbeat, reserved reservation) {
+	// A nil inventory tells the server it is unknown, so it must not treat
+	// our containers as gone when Docker is briefly unreachable.
+	containers, err := dc.ListManagedContainers(ctx)
+	if err != nil {
+		log.Printf("[WARN] Listing containers for heartbeat: %v", err)
+		containers = nil
 	}
+	resources, err := dc.NodeResources(ctx, reserved.cpu, reserved.memoryMB)
+	if err != nil {
+		log.Printf("[WARN] Reading node resources for heartbeat: %v", err)
+	}
+	hb.Timestamp = time.Now()
+	hb.Containers = containers
+	hb.Resources = resources
 	hbBytes, err := json.Marshal(hb)
 	if err != nil {
 		log.Printf("[ERROR] Marshalling heartbeat: %v", err)
@@ -150,6 +252,38 @@ func parseLabels(raw string) map[string]string {
 	return labels
 }
 
+// parseTaints splits the comma-separated taints of the node.
+func parseTaints(raw string) ([]spec.Taint, error) {
+	var taints []spec.Taint
+	for _, s := range strings.Split(raw, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		t, err := spec.ParseTaint(s)
+		if err != nil {
+			return nil, err
+		}
+		taints = append(taints, t)
+	}
+	return taints, nil
+}
+
+// parseHostPaths splits the comma-separated allow-list of host directories.
+func parseHostPaths(raw string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(raw, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("allowed host path '%s' must be absolute", p)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	return paths, nil
+}
+
 func loadOrCreateNodeID(path string) (string, error) {
 	if b, err := os.ReadFile(path); err == nil {
 		id := strings.TrimSpace(string(b))
@@ -168,75 +302,170 @@ func loadOrCreateNodeID(path string) (string, error) {
 	return id, nil
 }
 
-func deploymentTaskHandler(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn) nats.MsgHandler {
+// meshConfigHandler applies the mesh network config the server sends after
+// every heartbeat: routed bridges through Docker and routes to other nodes
+// through wg-mesh. Unchanged configs are skipped.
+func meshConfigHandler(ctx context.Context, dc *docker.Client, wg *wgmesh.Client) nats.MsgHandler {
+	var applied string
 	return func(m *nats.Msg) {
-		var task messaging.DeployTask
-		if err := json.Unmarshal(m.Data, &task); err != nil {
-			log.Printf("[ERROR] Unmarshalling deploy task: %v", err)
+		if string(m.Data) == applied {
 			return
 		}
-
-		log.Printf("[INFO] Received deploy task for '%s' (ID: %d)", task.Name, task.DeploymentID)
-
-		status := messaging.TaskStatus{
-			TaskType:     "deploy",
-			DeploymentID: task.DeploymentID,
-			NodeID:       nodeID,
-			Success:      false,
+		var cfg messaging.MeshConfig
+		if err := json.Unmarshal(m.Data, &cfg); err != nil {
+			log.Printf("[ERROR] Unmarshalling mesh config: %v", err)
+			return
 		}
-
-		containerID, err := dc.DeployContainer(ctx, &task)
-		if err != nil {
-			log.Printf("[ERROR] Failed to deploy container for '%s': %v", task.Name, err)
-			status.Message = err.Error()
-		} else {
-			log.Printf("[INFO] Container for '%s' started successfully: %s", task.Name, containerID)
-			status.Success = true
-			status.ContainerID = containerID
+		// Nodes outside any mesh network never need wg-mesh routes.
+		if applied == "" && len(cfg.Networks) == 0 && len(cfg.Routes) == 0 {
+			return
 		}
 
-		statusBytes, err := json.Marshal(status)
-		if err != nil {
-			log.Printf("[ERROR] Marshalling status response: %v", err)
+		if err := dc.ApplyMeshConfig(ctx, cfg); err != nil {
+			log.Printf("[ERROR] Applying mesh networks: %v", err)
 			return
 		}
-
-		if err := nc.Publish(messaging.SubjectTaskStatus, statusBytes); err != nil {
-			log.Printf("[ERROR] Publishing task status: %v", err)
+		routes := make([]wgmesh.Route, 0, len(cfg.Routes))
+		for _, r := range cfg.Routes {
+			routes = append(routes, wgmesh.Route{Subnet: r.Subnet, Via: r.Via})
+		}
+		if err := wg.SetRoutes(routes); err != nil {
+			log.Printf("[ERROR] Programming mesh routes: %v", err)
+			return
 		}
+		log.Printf("[INFO] Applied mesh config: %d network(s), %d route(s)", len(cfg.Networks), len(cfg.Routes))
+		applied = string(m.Data)
 	}
 }
 
-func undeployTaskHandler(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn) nats.MsgHandler {
-	return func(m *nats.Msg) {
-		var task messaging.UndeployTask
-		if err := json.Unmarshal(m.Data, &task); err != nil {
-			log.Printf("[ERROR] Unmarshalling undeploy task: %v", err)
-			return
+// taskHandler runs deploy, undeploy and render tasks from the task stream. A task is
+// acked once its status is published; if the agent dies first, JetStream
+// redelivers it.
+func taskHandler(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn) jetstream.MessageHandler {
+	return func(m jetstream.Msg) {
+		switch subject := m.Subject(); {
+		case messaging.IsUndeploySubject(subject):
+			handleUndeployTask(ctx, nodeID, dc, nc, m.Data())
+		case messaging.IsRenderSubject(subject):
+			handleRenderTask(ctx, nodeID, dc, nc, m.Data())
+		default:
+			handleDeployTask(ctx, nodeID, dc, nc, m.Data())
 		}
-
-		status := messaging.TaskStatus{
-			TaskType:     "undeploy",
-			DeploymentID: task.DeploymentID,
-			NodeID:       nodeID,
-			Success:      false,
+		if err := m.Ack(); err != nil {
+			log.Printf("[ERROR] Acking task on %s: %v", m.Subject(), err)
 		}
+	}
+}
 
-		if err := dc.UndeployContainer(ctx, task.Name); err != nil {
-			status.Message = err.Error()
-			log.Printf("[ERROR] Failed to undeploy '%s': %v", task.Name, err)
-		} else {
-			status.Success = true
-			log.Printf("[INFO] Undeployed '%s'", task.Name)
-		}
+func handleDeployTask(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn, data []byte) {
+	var task messaging.DeployTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		log.Printf("[ERROR] Unmarshalling deploy task: %v", err)
+		return
+	}
 
-		b, err := json.Marshal(status)
-		if err != nil {
-			log.Printf("[ERROR] Marshalling undeploy status: %v", err)
-			return
+	log.Printf("[INFO] Received deploy task for '%s' instance '%s' (ID: %d)", task.Name, task.InstanceName, task.DeploymentID)
+
+	status := messaging.TaskStatus{
+		TaskID:       task.TaskID,
+		TaskType:     "deploy",
+		DeploymentID: task.DeploymentID,
+		NodeID:       nodeID,
+		Success:      false,
+		InstanceName: task.InstanceName,
+	}
+	publishRunning(nc, status)
+
+	// Secrets are fetched over request/reply: the task stream never holds them.
+	var containerID string
+	err := messaging.FetchSecrets(nc, &task, nodeID)
+	if err == nil {
+		containerID, err = dc.DeployContainer(ctx, &task)
+	}
+	if err != nil {
+		status.Message = task.Redact(err.Error())
+		log.Printf("[ERROR] Failed to deploy container for '%s': %s", task.Name, status.Message)
+	} else {
+		log.Printf("[INFO] Container for '%s' started successfully: %s", task.Name, containerID)
+		status.Success = true
+		status.ContainerID = containerID
+		if status.Ports, err = dc.HostPorts(ctx, containerID, task.Ports); err != nil {
+			log.Printf("[WARN] Reading host ports of '%s': %v", task.Name, err)
 		}
-		if err := nc.Publish(messaging.SubjectTaskStatus, b); err != nil {
-			log.Printf("[ERROR] Publishing undeploy status: %v", err)
+	}
+	publishStatus(nc, status)
+}
+
+func handleUndeployTask(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn, data []byte) {
+	var task messaging.UndeployTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		log.Printf("[ERROR] Unmarshalling undeploy task: %v", err)
+		return
+	}
+
+	status := messaging.TaskStatus{
+		TaskID:       task.TaskID,
+		TaskType:     "undeploy",
+		DeploymentID: task.DeploymentID,
+		NodeID:       nodeID,
+		Success:      false,
+		InstanceName: task.InstanceName,
+	}
+	publishRunning(nc, status)
+
+	if err := dc.UndeployContainer(ctx, task.Name, task.InstanceName); err != nil {
+		status.Message = err.Error()
+		log.Printf("[ERROR] Failed to undeploy '%s': %v", task.Name, err)
+	} else {
+		status.Success = true
+		log.Printf("[INFO] Undeployed '%s'", task.Name)
+	}
+	publishStatus(nc, status)
+}
+
+func handleRenderTask(ctx context.Context, nodeID string, dc *docker.Client, nc *nats.Conn, data []byte) {
+	var task messaging.RenderTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		log.Printf("[ERROR] Unmarshalling render task: %v", err)
+		return
+	}
+
+	status := messaging.TaskStatus{
+		TaskID:       task.TaskID,
+		TaskType:     "render",
+		DeploymentID: task.DeploymentID,
+		NodeID:       nodeID,
+		Success:      false,
+		InstanceName: task.InstanceName,
+	}
+
+	changed, err := dc.RenderTemplates(ctx, &task.DeployTask)
+	if err != nil {
+		status.Message = err.Error()
+		log.Printf("[ERROR] Failed to re-render templates of '%s': %v", task.InstanceName, err)
+	} else {
+		status.Success = true
+		if len(changed) > 0 {
+			status.Message = "changed: " + strings.Join(changed, ", ")
+			log.Printf("[INFO] Re-rendered templates of '%s': %s", task.InstanceName, status.Message)
 		}
 	}
+	publishStatus(nc, status)
+}
+
+// publishRunning reports that the agent started working on a task.
+func publishRunning(nc *nats.Conn, status messaging.TaskStatus) {
+	status.State = "running"
+	publishStatus(nc, status)
+}
+
+func publishStatus(nc *nats.Conn, status messaging.TaskStatus) {
+	b, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("[ERROR] Marshalling task status: %v", err)
+		return
+	}
+	if err := nc.Publish(messaging.SubjectTaskStatus, b); err != nil {
+		log.Printf("[ERROR] Publishing task status: %v", err)
+	}
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/revisions"
+	"github.com/atvirokodosprendimai/knitu/internal/server/services"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// authorHeader names who submitted a spec; it is recorded on the revision.
+const authorHeader = "X-Knit-Author"
+
+// upsertAndPublishDeployment stores the deployment spec and has the
+// reconciler place its replicas and publish one deploy task per instance.
+// Single-instance deployments without a selector are broadcast to all agents.
+// A changed spec is stored as a new revision credited to author. It returns
+// the IDs of the published tasks.
+func upsertAndPublishDeployment(gormDB *gorm.DB, rec *reconciler.Service, ds spec.DeploymentSpec, templatesJSON, author string) (*db.Deployment, []string, error) {
+	if strings.TrimSpace(ds.Name) == "" || strings.TrimSpace(ds.Image) == "" {
+		return nil, nil, fmt.Errorf("name and image are required")
+	}
+	if ds.Replicas < 0 {
+		return nil, nil, fmt.Errorf("replicas must not be negative")
+	}
+
+	// Fail before storing anything if the deployment cannot be placed.
+	if err := rec.CheckPlacement(ds); err != nil {
+		return nil, nil, err
+	}
+
+	specJSON, err := json.Marshal(ds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal spec: %w", err)
+	}
+
+	deployment := db.Deployment{
+		Name:               ds.Name,
+		Image:              ds.Image,
+		NetworkAttachments: ds.NetworkNames(),
+		Templates:          templatesJSON,
+		Spec:               string(specJSON),
+	}
+	if err := gormDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"image", "network_attachments", "templates", "spec", "updated_at"}),
+	}).Create(&deployment).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to store deployment: %w", err)
+	}
+	if err := gormDB.Where("name = ?", ds.Name).First(&deployment).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load deployment: %w", err)
+	}
+
+	// A changed spec becomes a new revision and starts a rollout.
+	rev, created, err := revisions.Record(gormDB, deployment.ID, deployment.Revision, deployment.Spec, author)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store revision: %w", err)
+	}
+	if created {
+		deployment.Revision = rev.Revision
+		deployment.RolloutStatus = reconciler.RolloutProgressing
+		deployment.RolloutStartedAt = time.Now()
+		if err := gormDB.Model(&deployment).Select("revision", "rollout_status", "rollout_started_at").Updates(&deployment).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed to start rollout: %w", err)
+		}
+	}
+
+	taskIDs, err := rec.ReconcileDeployment(&deployment, true)
+	if err != nil {
+		return nil, taskIDs, err
+	}
+	return &deployment, taskIDs, nil
+}
+
+// buildDeployTask turns a stored deployment into the task sent to agents.
+// The task goes through the file-backed task stream, so it only carries
+// references to secrets and no registry credentials: agents fetch those with
+// a SecretsRequest when they run it (see resolveTaskSecrets).
+func buildDeployTask(gormDB *gorm.DB, v *vault.Vault, deployment *db.Deployment, ds spec.DeploymentSpec) (*messaging.DeployTask, error) {
+	if err := validateSecretRefs(gormDB, v, ds); err != nil {
+		return nil, err
+	}
+	networks, err := resolveNetworks(gormDB, ds)
+	if err != nil {
+		return nil, err
+	}
+	ds.Registry = spec.RegistryAuth{}
+	task := &messaging.DeployTask{
+		DeploymentID:   deployment.ID,
+		DeploymentSpec: ds,
+		SecretEnv:      secretEnvKeys(ds.Env),
+		NetworkDefs:    networks,
+	}
+	if len(ds.Templates) > 0 {
+		if task.Services, err = services.Endpoints(gormDB); err != nil {
+			return nil, fmt.Errorf("failed to load service endpoints: %w", err)
+		}
+	}
+	return task, nil
+}
+
+// resolveSecrets loads the secret env values, secret files and registry
+// credentials of a spec.
+func resolveSecrets(gormDB *gorm.DB, v *vault.Vault, ds spec.DeploymentSpec) (messaging.Secrets, error) {
+	var out messaging.Secrets
+	env, secretKeys, err := resolveEnv(gormDB, v, ds.Env)
+	if err != nil {
+		return out, err
+	}
+	out.Env = make(map[string]string, len(secretKeys))
+	for _, k := range secretKeys {
+		out.Env[k] = env[k]
+	}
+	if out.Files, err = resolveSecretMounts(gormDB, v, ds.Secrets); err != nil {
+		return out, err
+	}
+	// Specs stored before registries were managed may still carry inline credentials.
+	out.Registry = ds.Registry
+	if out.Registry.Username == "" && out.Registry.Password == "" {
+		if out.Registry, err = registryAuth(gormDB, v, ds.Image); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// secretEnvKeys returns the sorted env keys whose values reference secrets.
+func secretEnvKeys(env map[string]string) []string {
+	var keys []string
+	for k, value := range env {
+		if _, ok := spec.SecretRef(value); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resolveEnv returns a copy of env with every "secret://name" value replaced
+// by the stored secret, and the keys that were replaced.
+func resolveEnv(gormDB *gorm.DB, v *vault.Vault, env map[string]string) (map[string]string, []string, error) {
+	if len(env) == 0 {
+		return env, nil, nil
+	}
+	resolved := make(map[string]string, len(env))
+	var secretKeys []string
+	for k, value := range env {
+		ref, ok := spec.SecretRef(value)
+		if !ok {
+			resolved[k] = value
+			continue
+		}
+		secret, err := loadSecret(gormDB, v, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("env %s: %w", k, err)
+		}
+		resolved[k] = secret
+		secretKeys = append(secretKeys, k)
+	}
+	sort.Strings(secretKeys)
+	return resolved, secretKeys, nil
+}
+
+// resolveSecretMounts loads the value of every secret mounted as a file.
+func resolveSecretMounts(gormDB *gorm.DB, v *vault.Vault, mounts []spec.SecretMount) ([]messaging.SecretFile, error) {
+	files := make([]messaging.SecretFile, 0, len(mounts))
+	for _, m := range mounts {
+		value, err := loadSecret(gormDB, v, m.Name)
+		if err != nil {
+			return nil, fmt.Errorf("secret mount %s: %w", m.Path(), err)
+		}
+		mode, err := m.FileMode()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, messaging.SecretFile{Path: m.Path(), Value: value, Mode: mode})
+	}
+	return files, nil
+}
+
+// validateSecretRefs checks that every secret referenced from env or mounted
+// as a file exists.
+func validateSecretRefs(gormDB *gorm.DB, v *vault.Vault, ds spec.DeploymentSpec) error {
+	if _, _, err := resolveEnv(gormDB, v, ds.Env); err != nil {
+		return err
+	}
+	_, err := resolveSecretMounts(gormDB, v, ds.Secrets)
+	return err
+}
+
+// undeployDeployment removes the deployment and its instance records and
+// broadcasts an undeploy task so every agent drops its containers. Unknown
+// names are still broadcast, which keeps undeploy idempotent. Agents that are
+// offline are cleaned up by the reconciler once they report their inventory.
+func undeployDeployment(gormDB *gorm.DB, dispatcher *taskDispatcher, name string) (*db.Deployment, error) {
+	deployment := db.Deployment{Name: name}
+	if err := gormDB.Where("name = ?", name).First(&deployment).Error; err == nil {
+		if err := gormDB.Where("deployment_id = ?", deployment.ID).Delete(&db.ContainerInstance{}).Error; err != nil {
+			return nil, fmt.Errorf("failed to delete container instances: %w", err)
+		}
+		if err := gormDB.Unscoped().Where("deployment_id = ?", deployment.ID).Delete(&db.DeploymentRevision{}).Error; err != nil {
+			return nil, fmt.Errorf("failed to delete revisions: %w", err)
+		}
+		if err := gormDB.Unscoped().Delete(&deployment).Error; err != nil {
+			return nil, fmt.Errorf("failed to delete deployment: %w", err)
+		}
+	}
+
+	if _, err := dispatcher.Undeploy("", messaging.UndeployTask{DeploymentID: deployment.ID, Name: name}); err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+func undeployHandler(gormDB *gorm.DB, dispatcher *taskDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(chi.URLParam(r, "name"))
+		if name == "" {
+			http.Error(w, "deployment name is required", http.StatusBadRequest)
+			return
+		}
+
+		deployment, err := undeployDeployment(gormDB, dispatcher, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[INFO] Published undeploy task for '%s'", name)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(deployment)
+	}
+}
+
+// revisionSummary is what the API returns for a deployment revision.
+type revisionSummary struct {
+	Revision  int             `json:"revision"`
+	CreatedAt time.Time       `json:"created_at"`
+	Author    string          `json:"author"`
+	Diff      string          `json:"diff"`
+	Current   bool            `json:"current"`
+	Spec      json.RawMessage `json:"spec"`
+}
+
+func revisionListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deployment db.Deployment
+		if err := gormDB.Where("name = ?", chi.URLParam(r, "name")).First(&deployment).Error; err != nil {
+			http.Error(w, "deployment not found", http.StatusNotFound)
+			return
+		}
+		revs, err := revisions.List(gormDB, deployment.ID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list revisions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := make([]revisionSummary, 0, len(revs))
+		for _, rev := range revs {
+			out = append(out, revisionSummary{
+				Revision:  rev.Revision,
+				CreatedAt: rev.CreatedAt,
+				Author:    rev.Author,
+				Diff:      rev.Diff,
+				Current:   rev.Revision == deployment.Revision,
+				Spec:      json.RawMessage(rev.Spec),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+type rollbackRequest struct {
+	Revision int `json:"revision"`
+}
+
+// rollbackHandler republishes an earlier revision of a deployment, by default
+// the one before the current revision.
+func rollbackHandler(gormDB *gorm.DB, rec *reconciler.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req rollbackRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var deployment db.Deployment
+		if err := gormDB.Where("name = ?", chi.URLParam(r, "name")).First(&deployment).Error; err != nil {
+			http.Error(w, "deployment not found", http.StatusNotFound)
+			return
+		}
+		var rev *db.DeploymentRevision
+		if req.Revision == 0 {
+			rev, err = revisions.Previous(gormDB, deployment.ID, deployment.Revision)
+		} else {
+			rev = &db.DeploymentRevision{}
+			err = gormDB.Where("deployment_id = ? AND revision = ?", deployment.ID, req.Revision).First(rev).Error
+		}
+		if err != nil {
+			http.Error(w, "revision not found", http.StatusNotFound)
+			return
+		}
+
+		taskIDs, err := rec.Rollback(&deployment, rev)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "no healthy node matches selector") {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		log.Printf("[INFO] Rolling back '%s' to revision %d", deployment.Name, rev.Revision)
+		writeDeploymentResponse(w, r, gormDB, &deployment, taskIDs, wait)
+	}
+}
+
+// nodeVerdict tells whether a dry run accepted a node and why not.
+type nodeVerdict struct {
+	Node     string   `json:"node"`
+	Status   string   `json:"status"`
+	Accepted bool     `json:"accepted"`
+	Score    int      `json:"score"`
+	Reasons  []string `json:"reasons,omitempty"`
+	Replicas []int    `json:"replicas,omitempty"`
+}
+
+// dryRunResponse is the outcome of placing a spec without deploying it.
+type dryRunResponse struct {
+	Scheduled bool          `json:"scheduled"`
+	Placeable bool          `json:"placeable"`
+	Error     string        `json:"error,omitempty"`
+	Nodes     []nodeVerdict `json:"nodes"`
+}
+
+// dryRunHandler explains where a spec would be placed and why each node was
+// accepted or rejected, without storing or deploying anything.
+func dryRunHandler(rec *reconciler.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ds spec.DeploymentSpec
+		if err := json.NewDecoder(r.Body).Decode(&ds); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(ds.Name) == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if err := ds.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		scheduled, err := rec.Scheduled(ds)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load nodes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		explanation, err := rec.ExplainPlacement(ds)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to explain placement: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := dryRunResponse{Scheduled: scheduled, Placeable: explanation.Err == nil, Nodes: []nodeVerdict{}}
+		if explanation.Err != nil {
+			out.Error = explanation.Err.Error()
+		}
+		for _, v := range explanation.Nodes {
+			verdict := nodeVerdict{Node: v.NodeKey, Status: v.Status, Accepted: v.Accepted, Score: v.Score, Reasons: v.Reasons}
+			// Broadcast deployments go to whichever agent claims them first.
+			if out.Scheduled {
+				verdict.Replicas = v.Replicas
+			}
+			out.Nodes = append(out.Nodes, verdict)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/tasks"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"gorm.io/gorm"
+)
+
+// publishTimeout bounds how long a publish waits for the JetStream ack.
+const publishTimeout = 5 * time.Second
+
+// taskDispatcher publishes deploy and undeploy tasks to the durable task stream.
+type taskDispatcher struct {
+	db    *gorm.DB
+	js    jetstream.JetStream
+	vault *vault.Vault
+	// dns is set on deploy tasks so containers resolve deployments.
+	dns []string
+	// portRange is where agents pick host ports of broadcast instances.
+	portRange scheduler.PortRange
+}
+
+// Deploy publishes a deploy task for one instance, to its node or as a
+// broadcast, and returns its task ID.
+func (d *taskDispatcher) Deploy(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string) (string, error) {
+	task, err := buildDeployTask(d.db, d.vault, deployment, ds)
+	if err != nil {
+		return "", err
+	}
+	task.TaskID = uuid.New().String()
+	task.InstanceIndex = instance.InstanceIndex
+	task.InstanceName = instance.Name
+	task.DNS = d.dns
+	if ports := scheduler.InstancePorts(instance); ports != nil {
+		task.Ports = ports
+	} else {
+		task.HostPortRange = d.portRange.String()
+	}
+
+	subject := messaging.SubjectTaskDeployBroadcast
+	if nodeKey != "" {
+		subject = messaging.SubjectTaskDeployNode(nodeKey)
+	}
+	record := db.Task{TaskID: task.TaskID, Type: "deploy", DeploymentID: deployment.ID, InstanceName: instance.Name, NodeID: nodeKey, SpecHash: reconciler.SpecHash(deployment.Spec)}
+	return task.TaskID, d.publish(&record, subject, task)
+}
+
+// Render publishes a render task for a running instance to its node and
+// returns its task ID. Secrets are left out: templates never see them.
+func (d *taskDispatcher) Render(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string, endpoints map[string][]messaging.ServiceEndpoint) (string, error) {
+	env := make(map[string]string, len(ds.Env))
+	for k, v := range ds.Env {
+		if _, ok := spec.SecretRef(v); !ok {
+			env[k] = v
+		}
+	}
+	ds.Env = env
+	ds.Registry = spec.RegistryAuth{}
+	ds.Secrets = nil
+
+	task := messaging.RenderTask{DeployTask: messaging.DeployTask{
+		TaskID:         uuid.New().String(),
+		DeploymentID:   deployment.ID,
+		InstanceIndex:  instance.InstanceIndex,
+		InstanceName:   instance.Name,
+		DeploymentSpec: ds,
+		Services:       endpoints,
+	}}
+	record := db.Task{TaskID: task.TaskID, Type: "render", DeploymentID: deployment.ID, InstanceName: instance.Name, NodeID: nodeKey}
+	return task.TaskID, d.publish(&record, messaging.SubjectTaskRenderNode(nodeKey), task)
+}
+
+// Undeploy publishes an undeploy task to a node, or to all agents, and
+// returns its task ID.
+func (d *taskDispatcher) Undeploy(nodeKey string, task messaging.UndeployTask) (string, error) {
+	task.TaskID = uuid.New().String()
+	subject := messaging.SubjectTaskUndeployBroadcast
+	if nodeKey != "" {
+		subject = messaging.SubjectTaskUndeployNode(nodeKey)
+	}
+	record := db.Task{TaskID: task.TaskID, Type: "undeploy", DeploymentID: task.DeploymentID, InstanceName: task.InstanceName, NodeID: nodeKey}
+	return task.TaskID, d.publish(&record, subject, task)
+}
+
+// publish stores the task record, publishes the task and tracks the outcome
+// of the publish on the record.
+func (d *taskDispatcher) publish(record *db.Task, subject string, task interface{}) error {
+	record.State = tasks.StatePending
+	if err := d.db.Create(record).Error; err != nil {
+		return fmt.Errorf("failed to store task: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := messaging.PublishTask(ctx, d.js, subject, record.TaskID, task); err != nil {
+		now := time.Now()
+		d.db.Model(record).Updates(db.Task{State: tasks.StateFailed, Message: err.Error(), CompletedAt: &now})
+		return err
+	}
+	return d.db.Model(record).Where("state = ?", tasks.StatePending).Update("state", tasks.StateDispatched).Error
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestDeployTaskKeepsSecretsOutOfStream(t *testing.T) {
+	ctx := context.Background()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatalf("NATS server did not become ready")
+	}
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Failed to create JetStream context: %v", err)
+	}
+	if err := messaging.EnsureTaskStream(ctx, js); err != nil {
+		t.Fatalf("EnsureTaskStream failed: %v", err)
+	}
+
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	v, err := vault.New(bytes.Repeat([]byte{7}, vault.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create vault: %v", err)
+	}
+	const envSecret, fileSecret, password = "env-secret-value", "file-secret-value", "registry-password"
+	for name, value := range map[string]string{"db-password": envSecret, "tls-key": fileSecret} {
+		if _, err := storeSecretVersion(gormDB, v, name, value); err != nil {
+			t.Fatalf("Failed to store secret: %v", err)
+		}
+	}
+	if _, err := storeRegistryCredentials(gormDB, v, "ghcr.io", "deploy", password); err != nil {
+		t.Fatalf("Failed to store registry credentials: %v", err)
+	}
+
+	ds := spec.DeploymentSpec{
+		Name:    "api",
+		Image:   "ghcr.io/org/api:1.0",
+		Env:     map[string]string{"DB_PASSWORD": "secret://db-password", "MODE": "prod"},
+		Secrets: []spec.SecretMount{{Name: "tls-key"}},
+	}
+	specJSON, _ := json.Marshal(ds)
+	deployment := db.Deployment{Name: ds.Name, Image: ds.Image, Spec: string(specJSON)}
+	gormDB.Create(&deployment)
+	instance := db.ContainerInstance{DeploymentID: deployment.ID, Name: "api-0"}
+	gormDB.Create(&instance)
+
+	dispatcher := &taskDispatcher{db: gormDB, js: js, vault: v}
+	taskID, err := dispatcher.Deploy(&deployment, ds, &instance, "node-a")
+	if err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+
+	stream, err := js.Stream(ctx, messaging.StreamTasks)
+	if err != nil {
+		t.Fatalf("Failed to load task stream: %v", err)
+	}
+	raw, err := stream.GetLastMsgForSubject(ctx, messaging.SubjectTaskDeployNode("node-a"))
+	if err != nil {
+		t.Fatalf("Failed to read task from stream: %v", err)
+	}
+	for _, secret := range []string{envSecret, fileSecret, password} {
+		if bytes.Contains(raw.Data, []byte(secret)) {
+			t.Errorf("Expected the stored task to leave out %q, but got %s", secret, raw.Data)
+		}
+	}
+
+	// The node the task was sent to gets the secrets; another node does not.
+	secrets, err := resolveTaskSecrets(gormDB, v, messaging.SecretsRequest{TaskID: taskID, NodeID: "node-a"})
+	if err != nil {
+		t.Fatalf("resolveTaskSecrets failed: %v", err)
+	}
+	if secrets.Env["DB_PASSWORD"] != envSecret || len(secrets.Files) != 1 || secrets.Files[0].Value != fileSecret || secrets.Registry.Password != password {
+		t.Errorf("Expected the task's secrets, but got %+v", secrets)
+	}
+	if _, err := resolveTaskSecrets(gormDB, v, messaging.SecretsRequest{TaskID: taskID, NodeID: "node-b"}); err == nil {
+		t.Errorf("Expected secrets to be refused to another node")
+	}
+}
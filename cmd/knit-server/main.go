@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -15,12 +16,20 @@ import (
 	"github.com/atvirokodosprendimai/knitu/internal/db"
 	"github.com/atvirokodosprendimai/knitu/internal/messaging"
 	"github.com/atvirokodosprendimai/knitu/internal/server/discovery"
+	"github.com/atvirokodosprendimai/knitu/internal/server/dns"
+	"github.com/atvirokodosprendimai/knitu/internal/server/liveness"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/services"
+	"github.com/atvirokodosprendimai/knitu/internal/server/tasks"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
 	"github.com/atvirokodosprendimai/knitu/internal/spec"
 	"github.com/atvirokodosprendimai/knitu/internal/wgmesh"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/urfave/cli/v3"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -38,8 +47,20 @@ func main() {
 					&cli.StringFlag{Name: "http-addr", Value: "0.0.0.0:8080", Usage: "HTTP server bind address"},
 					&cli.StringFlag{Name: "db-path", Value: "knit.db", Usage: "Path to the SQLite database file"},
 					&cli.StringFlag{Name: "nats-addr", Value: "0.0.0.0:4222", Usage: "NATS server bind address (host:port)"},
+					&cli.StringFlag{Name: "nats-store-dir", Value: "knit-jetstream", Usage: "Directory for JetStream task storage"},
+					&cli.StringFlag{Name: "master-key-file", Value: "knit-master.key", Usage: "File holding the master key that encrypts stored credentials, created if missing"},
 					&cli.StringFlag{Name: "wg-mesh-socket", Value: "/var/run/wgmesh.sock", Usage: "Path to the wg-mesh Unix socket"},
 					&cli.DurationFlag{Name: "discovery-interval", Value: 30 * time.Second, Usage: "Interval for syncing nodes from wg-mesh"},
+					&cli.DurationFlag{Name: "reconcile-interval", Value: 30 * time.Second, Usage: "Interval for converging containers to deployments"},
+					&cli.DurationFlag{Name: "node-suspect-after", Value: 45 * time.Second, Usage: "Heartbeat silence after which a node is suspect and gets no new workloads"},
+					&cli.DurationFlag{Name: "node-down-after", Value: 2 * time.Minute, Usage: "Heartbeat silence after which a node is down and its workloads are rescheduled"},
+					&cli.DurationFlag{Name: "liveness-interval", Value: 10 * time.Second, Usage: "Interval for checking node heartbeats"},
+					&cli.DurationFlag{Name: "template-watch-interval", Value: 10 * time.Second, Usage: "Interval for re-rendering templates when service endpoints change"},
+					&cli.StringFlag{Name: "host-port-range", Value: scheduler.DefaultPortRange.String(), Usage: "Range host ports are allocated from for ports with host_port 0"},
+					&cli.StringFlag{Name: "dns-addr", Usage: "Service discovery DNS bind address (ip:53), usually the server WireGuard IP; disabled if empty"},
+					&cli.StringFlag{Name: "dns-upstream", Usage: "Resolver (host:port) for names outside the knit zone, defaults to the first nameserver in /etc/resolv.conf"},
+					&cli.DurationFlag{Name: "dns-refresh-interval", Value: 5 * time.Second, Usage: "Interval for reloading DNS records, also their TTL"},
+					&cli.DurationFlag{Name: "task-timeout", Value: 15 * time.Minute, Usage: "Time after which a task without a result is marked timed out"},
 				},
 				Action: runServer,
 			},
@@ -61,6 +82,18 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 
+	key, err := vault.LoadOrCreateKey(cmd.Value("master-key-file").(string))
+	if err != nil {
+		return err
+	}
+	v, err := vault.New(key)
+	if err != nil {
+		return fmt.Errorf("invalid master key: %w", err)
+	}
+	if err := encryptLegacySecrets(gormDB, v); err != nil {
+		return err
+	}
+
 	// 2. Start wg-mesh Discovery Service
 	wgSocket := cmd.Value("wg-mesh-socket").(string)
 	wgClient := wgmesh.NewClient(wgSocket)
@@ -76,7 +109,12 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("invalid nats-addr format: %w", err)
 	}
 	natsPortInt, _ := strconv.Atoi(natsPort)
-	ns, err := server.NewServer(&server.Options{Host: natsHost, Port: natsPortInt})
+	ns, err := server.NewServer(&server.Options{
+		Host:      natsHost,
+		Port:      natsPortInt,
+		JetStream: true,
+		StoreDir:  cmd.Value("nats-store-dir").(string),
+	})
 	if err != nil {
 		return fmt.Errorf("could not start embedded NATS server: %w", err)
 	}
@@ -93,9 +131,76 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("failed to connect to NATS: %w", err)
 	}
 	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	if err := messaging.EnsureTaskStream(ctx, js); err != nil {
+		return err
+	}
+
+	portRange, err := scheduler.ParsePortRange(cmd.Value("host-port-range").(string))
+	if err != nil {
+		return fmt.Errorf("invalid host-port-range: %w", err)
+	}
+	dispatcher := &taskDispatcher{db: gormDB, js: js, vault: v, portRange: portRange}
+
+	// Start service discovery DNS for "<deployment>.knit"
+	if dnsAddr := cmd.Value("dns-addr").(string); dnsAddr != "" {
+		dnsHost, dnsPort, err := net.SplitHostPort(dnsAddr)
+		if err != nil {
+			return fmt.Errorf("invalid dns-addr format: %w", err)
+		}
+		if ip := net.ParseIP(dnsHost); ip == nil || ip.IsUnspecified() {
+			return fmt.Errorf("dns-addr must be an IP containers can reach, got '%s'", dnsHost)
+		}
+		if dnsPort != "53" {
+			log.Printf("[WARN] DNS server is not on port 53; containers will not be pointed at it")
+		} else {
+			dispatcher.dns = []string{dnsHost}
+		}
+		upstream := cmd.Value("dns-upstream").(string)
+		if upstream == "" {
+			upstream = dns.UpstreamFromResolvConf("/etc/resolv.conf")
+		}
+		dnsSvc := dns.NewServer(gormDB, dnsAddr, upstream, cmd.Value("dns-refresh-interval").(time.Duration))
+		if err := dnsSvc.Start(); err != nil {
+			return err
+		}
+		defer dnsSvc.Stop()
+	}
+
+	// 5. Start Reconciler
+	reconcileInterval := cmd.Value("reconcile-interval").(time.Duration)
+	reconcilerSvc := reconciler.NewService(gormDB, dispatcher, portRange, reconcileInterval)
+	reconcilerSvc.Start()
+	defer reconcilerSvc.Stop()
+
+	// 6. Start Node Liveness Monitor
+	livenessSvc := liveness.NewService(gormDB,
+		cmd.Value("node-suspect-after").(time.Duration),
+		cmd.Value("node-down-after").(time.Duration),
+		cmd.Value("liveness-interval").(time.Duration),
+		func(nodeIDs []string) {
+			log.Printf("[WARN] Rescheduling workloads of down nodes: %v", nodeIDs)
+			reconcilerSvc.Reconcile()
+		},
+	)
+	livenessSvc.Start()
+	defer livenessSvc.Stop()
+
+	// Time out tasks that agents never answered
+	taskSvc := tasks.NewService(gormDB, cmd.Value("task-timeout").(time.Duration), 10*time.Second)
+	taskSvc.Start()
+	defer taskSvc.Stop()
+
+	// Re-render templates of running containers when endpoints change
+	templateWatcher := services.NewWatcher(gormDB, dispatcher, cmd.Value("template-watch-interval").(time.Duration))
+	templateWatcher.Start()
+	defer templateWatcher.Stop()
 
-	// 5. Subscribe to Subjects
-	_, err = nc.Subscribe(messaging.SubjectAgentHeartbeat, heartbeatHandler(gormDB))
+	// 7. Subscribe to Subjects
+	_, err = nc.Subscribe(messaging.SubjectAgentHeartbeat, heartbeatHandler(gormDB, reconcilerSvc, nc))
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to heartbeats: %w", err)
 	}
@@ -103,9 +208,13 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to task status: %w", err)
 	}
-	log.Println("Subscribed to agent heartbeats and task statuses.")
+	_, err = nc.Subscribe(messaging.SubjectSecretsResolve, secretsRequestHandler(gormDB, v))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to secrets requests: %w", err)
+	}
+	log.Println("Subscribed to agent heartbeats, task statuses and secrets requests.")
 
-	// 6. Start Chi HTTP Server
+	// 8. Start Chi HTTP Server
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
@@ -117,8 +226,26 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 	r.Post("/dashboard/deploy", dashboardDeployHandler(gormDB, nc))
 	r.Post("/dashboard/undeploy", dashboardUndeployHandler(gormDB, nc))
 	r.Post("/dashboard/prune-nodes", dashboardPruneNodesHandler(gormDB))
-	r.Post("/deployments", deploymentCreateHandler(gormDB, nc))
-	r.Delete("/deployments/{name}", undeployHandler(gormDB, nc))
+	r.Post("/deployments", deploymentCreateHandler(gormDB, reconcilerSvc, v))
+	r.Post("/deployments/dry-run", dryRunHandler(reconcilerSvc))
+	r.Delete("/deployments/{name}", undeployHandler(gormDB, dispatcher))
+	r.Get("/deployments/{name}/revisions", revisionListHandler(gormDB))
+	r.Post("/deployments/{name}/rollback", rollbackHandler(gormDB, reconcilerSvc))
+	r.Get("/tasks/{id}", taskGetHandler(gormDB))
+	r.Post("/secrets", secretCreateHandler(gormDB, v))
+	r.Get("/secrets", secretListHandler(gormDB))
+	r.Delete("/secrets/{name}", secretDeleteHandler(gormDB))
+	r.Post("/registries", registryCreateHandler(gormDB, v))
+	r.Get("/registries", registryListHandler(gormDB))
+	r.Delete("/registries/{host}", registryDeleteHandler(gormDB))
+	r.Post("/networks", networkCreateHandler(gormDB))
+	r.Get("/networks", networkListHandler(gormDB))
+	r.Delete("/networks/{name}", networkDeleteHandler(gormDB))
+	r.Get("/volumes", volumeListHandler(gormDB))
+	r.Get("/nodes", nodeListHandler(gormDB))
+	r.Post("/nodes/{id}/cordon", nodeCordonHandler(gormDB, true))
+	r.Post("/nodes/{id}/uncordon", nodeCordonHandler(gormDB, false))
+	r.Post("/nodes/{id}/drain", nodeDrainHandler(gormDB, reconcilerSvc))
 
 	httpAddr := cmd.Value("http-addr").(string)
 	log.Printf("HTTP server listening on %s", httpAddr)
@@ -126,18 +253,41 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 }
 
 // ... handlers remain the same
-func deploymentCreateHandler(gormDB *gorm.DB, nc *nats.Conn) http.HandlerFunc {
+func deploymentCreateHandler(gormDB *gorm.DB, rec *reconciler.Service, v *vault.Vault) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var spec spec.DeploymentSpec
-		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		var ds spec.DeploymentSpec
+		if err := json.NewDecoder(r.Body).Decode(&ds); err != nil {
 			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 			return
 		}
 
+		if err := ds.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateSecretRefs(gormDB, v, ds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := resolveNetworks(gormDB, ds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Inline registry credentials are stored like POST /registries and
+		// never kept in the spec.
+		if ds.Registry.Username != "" || ds.Registry.Password != "" {
+			if _, err := storeRegistryCredentials(gormDB, v, spec.ImageRegistry(ds.Image), ds.Registry.Username, ds.Registry.Password); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ds.Registry = spec.RegistryAuth{}
+		}
+
 		// Marshal templates into JSON blob for storage
 		var templatesJSON string
-		if len(spec.Templates) > 0 {
-			templatesBytes, err := json.Marshal(spec.Templates)
+		if len(ds.Templates) > 0 {
+			templatesBytes, err := json.Marshal(ds.Templates)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Failed to marshal templates: %v", err), http.StatusInternalServerError)
 				return
@@ -145,7 +295,13 @@ func deploymentCreateHandler(gormDB *gorm.DB, nc *nats.Conn) http.HandlerFunc {
 			templatesJSON = string(templatesBytes)
 		}
 
-		deployment, derr := upsertAndPublishDeployment(gormDB, nc, spec, templatesJSON)
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		deployment, taskIDs, derr := upsertAndPublishDeployment(gormDB, rec, ds, templatesJSON, r.Header.Get(authorHeader))
 		if derr != nil {
 			status := http.StatusInternalServerError
 			if strings.Contains(derr.Error(), "no healthy node matches selector") {
@@ -156,8 +312,7 @@ func deploymentCreateHandler(gormDB *gorm.DB, nc *nats.Conn) http.HandlerFunc {
 		}
 
 		log.Printf("[INFO] Published deployment task for '%s' (ID: %d)", deployment.Name, deployment.ID)
-		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(deployment)
+		writeDeploymentResponse(w, r, gormDB, deployment, taskIDs, wait)
 	}
 }
 
@@ -169,13 +324,37 @@ func taskStatusHandler(gormDB *gorm.DB) nats.MsgHandler {
 			return
 		}
 
+		if err := tasks.RecordStatus(gormDB, status); err != nil {
+			log.Printf("[ERROR] Recording status of task %s: %v", status.TaskID, err)
+		}
+		if status.State == tasks.StateRunning {
+			return
+		}
+
 		log.Printf("[INFO] Received task status: DeploymentID=%d, Success=%v from NodeID=%s", status.DeploymentID, status.Success, status.NodeID)
+		if status.TaskType == "render" {
+			if !status.Success {
+				log.Printf("[WARN] Re-rendering templates of '%s' failed: %s", status.InstanceName, status.Message)
+			}
+			return
+		}
 		if status.TaskType == "undeploy" {
 			log.Printf("[INFO] Undeploy status deployment=%d node=%s success=%v", status.DeploymentID, status.NodeID, status.Success)
-			if status.Success {
-				if err := gormDB.Where("deployment_id = ?", status.DeploymentID).Delete(&db.ContainerInstance{}).Error; err != nil {
-					log.Printf("[WARN] Failed to clear container instances for undeploy: %v", err)
-				}
+			if !status.Success {
+				return
+			}
+			// Only clear instances on the reporting node: an instance that was
+			// moved elsewhere shares its name with the container just removed.
+			var node db.Node
+			if err := gormDB.First(&node, "node_id = ?", status.NodeID).Error; err != nil {
+				return
+			}
+			q := gormDB.Where("deployment_id = ? AND node_id = ?", status.DeploymentID, node.ID)
+			if status.InstanceName != "" {
+				q = q.Where("name = ?", status.InstanceName)
+			}
+			if err := q.Delete(&db.ContainerInstance{}).Error; err != nil {
+				log.Printf("[WARN] Failed to clear container instances for undeploy: %v", err)
 			}
 			return
 		}
@@ -188,21 +367,70 @@ func taskStatusHandler(gormDB *gorm.DB) nats.MsgHandler {
 
 		instance := db.ContainerInstance{
 			DeploymentID: status.DeploymentID,
-			NodeID:       node.ID,
-			ContainerID:  status.ContainerID,
-			Status:       "failed",
+			Name:         status.InstanceName,
 		}
+		if err := gormDB.Where("deployment_id = ? AND name = ?", status.DeploymentID, status.InstanceName).First(&instance).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[ERROR] Loading container instance record: %v", err)
+			return
+		}
+		if instance.NodeID != 0 && instance.NodeID != node.ID {
+			log.Printf("[WARN] Ignoring status for '%s' from node %s, instance was moved", status.InstanceName, status.NodeID)
+			return
+		}
+		// A late or redelivered result of a task built from an older spec
+		// must not overwrite the instance deployed from the current one.
+		if instance.ID != 0 && status.TaskID != "" {
+			var task db.Task
+			if err := gormDB.Where("task_id = ?", status.TaskID).Limit(1).Find(&task).Error; err != nil {
+				log.Printf("[ERROR] Loading task %s: %v", status.TaskID, err)
+				return
+			}
+			if task.SpecHash != "" && task.SpecHash != instance.SpecHash {
+				log.Printf("[WARN] Ignoring result of superseded task %s for '%s'", status.TaskID, status.InstanceName)
+				return
+			}
+		}
+		instance.NodeID = node.ID
+		instance.Status = "failed"
 		if status.Success {
 			instance.Status = "running"
+			instance.ContainerID = status.ContainerID
+		}
+		if len(status.Ports) > 0 {
+			if b, err := json.Marshal(status.Ports); err == nil {
+				instance.Ports = string(b)
+			}
 		}
 
-		if err := gormDB.Create(&instance).Error; err != nil {
-			log.Printf("[ERROR] Creating container instance record: %v", err)
+		if err := gormDB.Save(&instance).Error; err != nil {
+			log.Printf("[ERROR] Saving container instance record: %v", err)
+		}
+
+		if !status.Success {
+			return
+		}
+		var deployment db.Deployment
+		if err := gormDB.First(&deployment, status.DeploymentID).Error; err != nil {
+			return
+		}
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(deployment.Spec), &ds); err != nil {
+			return
+		}
+		// Record which agent of the queue group claimed a broadcast deployment.
+		if !ds.Scheduled() && deployment.NodeID != node.ID {
+			if err := gormDB.Model(&deployment).Update("node_id", node.ID).Error; err != nil {
+				log.Printf("[WARN] Recording node for deployment '%s': %v", deployment.Name, err)
+			}
+		}
+		// Named volumes now hold data on this node; later placements stay here.
+		if err := scheduler.RecordVolumes(gormDB, deployment.ID, ds, instance.InstanceIndex, node.ID); err != nil {
+			log.Printf("[WARN] %v", err)
 		}
 	}
 }
 
-func heartbeatHandler(gormDB *gorm.DB) nats.MsgHandler {
+func heartbeatHandler(gormDB *gorm.DB, rec *reconciler.Service, nc *nats.Conn) nats.MsgHandler {
 	return func(m *nats.Msg) {
 		var hb messaging.Heartbeat
 		if err := json.Unmarshal(m.Data, &hb); err != nil {
@@ -215,54 +443,49 @@ func heartbeatHandler(gormDB *gorm.DB) nats.MsgHandler {
 			log.Printf("[WARN] Could not marshal heartbeat labels: %v", err)
 		}
 
+		taintsJSON := ""
+		if len(hb.Taints) > 0 {
+			b, err := json.Marshal(hb.Taints)
+			if err != nil {
+				log.Printf("[WARN] Could not marshal heartbeat taints: %v", err)
+			}
+			taintsJSON = string(b)
+		}
+
 		log.Printf("[INFO] Heartbeat received: NodeID=%s, Hostname=%s, Labels=%v", hb.NodeID, hb.Hostname, hb.Labels)
 
+		// Liveness is judged against the server clock, so agent clock skew
+		// cannot make a node look dead.
 		node := db.Node{
 			NodeID:        hb.NodeID,
 			Hostname:      hb.Hostname,
 			Labels:        string(labelsJSON),
-			LastHeartbeat: hb.Timestamp,
+			MeshIP:        hb.MeshIP,
+			Taints:        taintsJSON,
+			LastHeartbeat: time.Now(),
 			Status:        "healthy",
 		}
 
+		columns := []string{"hostname", "labels", "mesh_ip", "taints", "last_heartbeat", "status"}
+		if r := hb.Resources; r != nil {
+			node.CPU, node.MemoryMB = r.CPU, r.MemoryMB
+			node.AllocatableCPU, node.AllocatableMemoryMB = r.AllocatableCPU, r.AllocatableMemoryMB
+			columns = append(columns, "cpu", "memory_mb", "allocatable_cpu", "allocatable_memory_mb")
+		}
+
 		result := gormDB.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "node_id"}},
-			DoUpdates: clause.AssignmentColumns([]string{"hostname", "labels", "last_heartbeat", "status"}),
+			DoUpdates: clause.AssignmentColumns(columns),
 		}).Create(&node)
 
 		if result.Error != nil {
 			log.Printf("[ERROR] Upserting node: %v", result.Error)
+		} else {
+			publishMeshConfig(gormDB, nc, hb.NodeID)
 		}
-	}
-}
 
-func selectNodeForDeployment(gormDB *gorm.DB, selector map[string]string) (string, error) {
-	var nodes []db.Node
-	if err := gormDB.Where("status = ?", "healthy").Order("last_heartbeat desc").Find(&nodes).Error; err != nil {
-		return "", err
-	}
-	for _, n := range nodes {
-		if matchesSelector(n.Labels, selector) {
-			return n.NodeID, nil
-		}
-	}
-	return "", fmt.Errorf("no healthy node matches selector")
-}
-
-func matchesSelector(labelsJSON string, selector map[string]string) bool {
-	if len(selector) == 0 {
-		return true
-	}
-	labels := map[string]string{}
-	if strings.TrimSpace(labelsJSON) != "" {
-		if err := json.Unmarshal([]byte(labelsJSON), &labels); err != nil {
-			return false
-		}
-	}
-	for k, v := range selector {
-		if labels[k] != v {
-			return false
+		if hb.Containers != nil {
+			rec.ObserveInventory(hb.NodeID, hb.Containers, time.Now())
 		}
 	}
-	return true
 }
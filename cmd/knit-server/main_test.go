@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/nats-io/nats.go"
+)
+
+func TestTaskStatusIgnoresSupersededResult(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	node := db.Node{NodeID: "node-a", Status: "healthy"}
+	gormDB.Create(&node)
+	deployment := db.Deployment{Name: "web", Image: "nginx", Spec: `{"name":"web","image":"nginx"}`}
+	gormDB.Create(&deployment)
+	instance := db.ContainerInstance{DeploymentID: deployment.ID, Name: "web-0", NodeID: node.ID, SpecHash: "new", Status: "pending", ContainerID: "c1"}
+	gormDB.Create(&instance)
+	gormDB.Create(&db.Task{TaskID: "old", Type: "deploy", DeploymentID: deployment.ID, InstanceName: "web-0", SpecHash: "old", State: "dispatched"})
+	gormDB.Create(&db.Task{TaskID: "new", Type: "deploy", DeploymentID: deployment.ID, InstanceName: "web-0", SpecHash: "new", State: "dispatched"})
+
+	handle := taskStatusHandler(gormDB)
+	report := func(status messaging.TaskStatus) db.ContainerInstance {
+		status.TaskType, status.DeploymentID, status.NodeID, status.InstanceName = "deploy", deployment.ID, "node-a", "web-0"
+		b, _ := json.Marshal(status)
+		handle(&nats.Msg{Data: b})
+		var got db.ContainerInstance
+		gormDB.First(&got, instance.ID)
+		return got
+	}
+
+	if got := report(messaging.TaskStatus{TaskID: "old", Message: "pull failed"}); got.Status != "pending" {
+		t.Errorf("Expected a superseded failure to be ignored, but got status %s", got.Status)
+	}
+	if got := report(messaging.TaskStatus{TaskID: "new", Message: "pull failed"}); got.Status != "failed" || got.ContainerID != "c1" {
+		t.Errorf("Expected the failure to keep container c1, but got status %s and container %q", got.Status, got.ContainerID)
+	}
+	if got := report(messaging.TaskStatus{TaskID: "new", Success: true, ContainerID: "c2"}); got.Status != "running" || got.ContainerID != "c2" {
+		t.Errorf("Expected running container c2, but got status %s and container %q", got.Status, got.ContainerID)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/meshnet"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+// networkSummary is what the API returns for a network.
+type networkSummary struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Driver    string    `json:"driver"`
+	Subnet    string    `json:"subnet,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newNetworkSummary(n *db.Network) networkSummary {
+	return networkSummary{ID: n.NetworkID, Name: n.Name, Driver: n.Driver, Subnet: n.Subnet, CreatedAt: n.CreatedAt}
+}
+
+// resolveNetworks returns the definitions of the networks a spec attaches to.
+func resolveNetworks(gormDB *gorm.DB, ds spec.DeploymentSpec) ([]spec.NetworkSpec, error) {
+	attached := ds.AttachedNetworks()
+	if len(attached) == 0 {
+		return nil, nil
+	}
+	defs := make([]spec.NetworkSpec, 0, len(attached))
+	for _, a := range attached {
+		var n db.Network
+		if err := gormDB.Where("name = ?", a.Name).First(&n).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, fmt.Errorf("network %q not found", a.Name)
+			}
+			return nil, fmt.Errorf("failed to load network %q: %w", a.Name, err)
+		}
+		defs = append(defs, spec.NetworkSpec{Name: n.Name, Driver: n.Driver, Subnet: n.Subnet})
+	}
+	return defs, nil
+}
+
+// networkUsers returns the names of deployments attached to a network.
+func networkUsers(gormDB *gorm.DB, name string) ([]string, error) {
+	var deployments []db.Deployment
+	if err := gormDB.Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, d := range deployments {
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(d.Spec), &ds); err != nil {
+			continue
+		}
+		for _, a := range ds.AttachedNetworks() {
+			if a.Name == name {
+				users = append(users, d.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// publishMeshConfig sends a node its mesh network config, allocating its
+// subnets on first contact. Agents apply it only when it changed.
+func publishMeshConfig(gormDB *gorm.DB, nc *nats.Conn, nodeKey string) {
+	var node db.Node
+	if err := gormDB.Where("node_id = ?", nodeKey).First(&node).Error; err != nil {
+		log.Printf("[ERROR] Loading node %s for mesh config: %v", nodeKey, err)
+		return
+	}
+	cfg, err := meshnet.NodeConfig(gormDB, &node)
+	if err != nil {
+		log.Printf("[WARN] Mesh config of node %s: %v", nodeKey, err)
+		return
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("[ERROR] Marshalling mesh config: %v", err)
+		return
+	}
+	if err := nc.Publish(messaging.SubjectAgentNetwork(nodeKey), b); err != nil {
+		log.Printf("[ERROR] Publishing mesh config to %s: %v", nodeKey, err)
+	}
+}
+
+func networkCreateHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req spec.NetworkSpec
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		n := db.Network{NetworkID: uuid.New().String(), Name: req.Name, Driver: req.DriverName(), Subnet: req.Subnet}
+		var existing db.Network
+		err := gormDB.Where("name = ?", req.Name).First(&existing).Error
+		switch {
+		case err == nil:
+			http.Error(w, fmt.Sprintf("network %q already exists", req.Name), http.StatusConflict)
+			return
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, fmt.Sprintf("Failed to load network: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := gormDB.Create(&n).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to store network: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[INFO] Defined network '%s' (%s %s)", n.Name, n.Driver, n.Subnet)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newNetworkSummary(&n))
+	}
+}
+
+func networkListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var networks []db.Network
+		if err := gormDB.Order("name").Find(&networks).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list networks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := make([]networkSummary, 0, len(networks))
+		for i := range networks {
+			out = append(out, newNetworkSummary(&networks[i]))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func networkDeleteHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		users, err := networkUsers(gormDB, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to check network users: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(users) > 0 {
+			http.Error(w, fmt.Sprintf("network %q is used by deployments: %s", name, strings.Join(users, ", ")), http.StatusConflict)
+			return
+		}
+		var n db.Network
+		if err := gormDB.Where("name = ?", name).First(&n).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "network not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to load network: %v", err), http.StatusInternalServerError)
+			return
+		}
+		err = gormDB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Unscoped().Where("network_id = ?", n.ID).Delete(&db.NetworkAllocation{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&n).Error
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete network: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] Deleted network '%s'", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// nodeSummary is what the API returns for a node.
+type nodeSummary struct {
+	Node          string            `json:"node"`
+	Hostname      string            `json:"hostname"`
+	Status        string            `json:"status"`
+	MeshIP        string            `json:"mesh_ip,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Taints        []spec.Taint      `json:"taints,omitempty"`
+	Cordoned      bool              `json:"cordoned"`
+	Draining      bool              `json:"draining"`
+	Instances     []string          `json:"instances"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+}
+
+// drainResponse is a draining node and whether all its instances have moved.
+type drainResponse struct {
+	nodeSummary
+	Drained bool `json:"drained"`
+}
+
+func newNodeSummary(gormDB *gorm.DB, n *db.Node) (nodeSummary, error) {
+	var instances []db.ContainerInstance
+	if err := gormDB.Where("node_id = ?", n.ID).Order("name").Find(&instances).Error; err != nil {
+		return nodeSummary{}, err
+	}
+	names := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		names = append(names, inst.Name)
+	}
+	return nodeSummary{
+		Node:          n.NodeID,
+		Hostname:      n.Hostname,
+		Status:        n.Status,
+		MeshIP:        n.MeshIP,
+		Labels:        scheduler.ParseLabels(n.Labels),
+		Taints:        scheduler.ParseTaints(n.Taints),
+		Cordoned:      n.Cordoned,
+		Draining:      n.Draining,
+		Instances:     names,
+		LastHeartbeat: n.LastHeartbeat,
+	}, nil
+}
+
+// loadNode loads the node named in the URL, writing 404 if there is none.
+func loadNode(w http.ResponseWriter, r *http.Request, gormDB *gorm.DB) (*db.Node, bool) {
+	var n db.Node
+	if err := gormDB.Where("node_id = ?", chi.URLParam(r, "id")).First(&n).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Failed to load node: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &n, true
+}
+
+func nodeListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var nodes []db.Node
+		if err := gormDB.Order("node_id").Find(&nodes).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list nodes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := make([]nodeSummary, 0, len(nodes))
+		for i := range nodes {
+			summary, err := newNodeSummary(gormDB, &nodes[i])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to list instances: %v", err), http.StatusInternalServerError)
+				return
+			}
+			out = append(out, summary)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// nodeCordonHandler cordons a node, or uncordons it, which also stops a
+// drain. Replicas already on a cordoned node keep running there.
+func nodeCordonHandler(gormDB *gorm.DB, cordon bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, ok := loadNode(w, r, gormDB)
+		if !ok {
+			return
+		}
+		updates := map[string]interface{}{"cordoned": cordon}
+		if !cordon {
+			updates["draining"] = false
+		}
+		if err := gormDB.Model(n).Updates(updates).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update node: %v", err), http.StatusInternalServerError)
+			return
+		}
+		n.Cordoned = cordon
+		n.Draining = n.Draining && cordon
+		log.Printf("[INFO] Node %s cordoned=%v", n.NodeID, cordon)
+		summary, err := newNodeSummary(gormDB, n)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list instances: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+// nodeDrainHandler cordons a node and has the reconciler move its instances
+// elsewhere. With ?wait= it blocks until the node is drained and answers 200,
+// or 202 if the wait elapsed first.
+func nodeDrainHandler(gormDB *gorm.DB, rec *reconciler.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, ok := loadNode(w, r, gormDB)
+		if !ok {
+			return
+		}
+		if err := gormDB.Model(n).Updates(map[string]interface{}{"cordoned": true, "draining": true}).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update node: %v", err), http.StatusInternalServerError)
+			return
+		}
+		n.Cordoned, n.Draining = true, true
+		log.Printf("[INFO] Draining node %s", n.NodeID)
+		rec.Reconcile()
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		drained, err := waitDrained(ctx, rec, n.NodeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to check drain: %v", err), http.StatusInternalServerError)
+			return
+		}
+		summary, err := newNodeSummary(gormDB, n)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list instances: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusAccepted
+		if drained {
+			status = http.StatusOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(drainResponse{nodeSummary: summary, Drained: drained})
+	}
+}
+
+// waitDrained polls until the node is drained or ctx is done. Replacements
+// become ready and old containers disappear as heartbeats report them, so
+// this takes at least a heartbeat interval per instance.
+func waitDrained(ctx context.Context, rec *reconciler.Service, nodeKey string) (bool, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		drained, err := rec.Drained(nodeKey)
+		if err != nil || drained {
+			return drained, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+}
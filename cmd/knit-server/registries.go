@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type registryRequest struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// registrySummary is what the API returns for registry credentials.
+// Passwords are never echoed.
+type registrySummary struct {
+	URL       string    `json:"url"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newRegistrySummary(c *db.RegistryCredentials) registrySummary {
+	return registrySummary{URL: c.URL, Username: c.Username, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt}
+}
+
+// storeRegistryCredentials creates or replaces the credentials of a
+// registry, encrypting the password with the master key.
+func storeRegistryCredentials(gormDB *gorm.DB, v *vault.Vault, url, username, password string) (*db.RegistryCredentials, error) {
+	host := spec.NormalizeRegistry(url)
+	if host == "" {
+		return nil, fmt.Errorf("registry url is required")
+	}
+	sealed, err := v.Encrypt(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt password: %w", err)
+	}
+	creds := db.RegistryCredentials{URL: host, Username: username, Password: sealed}
+	if err := gormDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "url"}},
+		DoUpdates: clause.AssignmentColumns([]string{"username", "password", "updated_at"}),
+	}).Create(&creds).Error; err != nil {
+		return nil, fmt.Errorf("failed to store registry credentials: %w", err)
+	}
+	if err := gormDB.Where("url = ?", host).First(&creds).Error; err != nil {
+		return nil, fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// registryAuth returns the decrypted credentials for the registry an image is
+// pulled from, or empty credentials if none are stored.
+func registryAuth(gormDB *gorm.DB, v *vault.Vault, image string) (spec.RegistryAuth, error) {
+	var creds db.RegistryCredentials
+	err := gormDB.Where("url = ?", spec.ImageRegistry(image)).First(&creds).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.RegistryAuth{}, nil
+	}
+	if err != nil {
+		return spec.RegistryAuth{}, fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+	password, err := v.Decrypt(creds.Password)
+	if err != nil {
+		return spec.RegistryAuth{}, fmt.Errorf("registry %s: %w", creds.URL, err)
+	}
+	return spec.RegistryAuth{Username: creds.Username, Password: password}, nil
+}
+
+func registryCreateHandler(gormDB *gorm.DB, v *vault.Vault) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req registryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.URL) == "" || req.Username == "" {
+			http.Error(w, "url and username are required", http.StatusBadRequest)
+			return
+		}
+
+		creds, err := storeRegistryCredentials(gormDB, v, req.URL, req.Username, req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[INFO] Stored credentials for registry '%s'", creds.URL)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newRegistrySummary(creds))
+	}
+}
+
+func registryListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var all []db.RegistryCredentials
+		if err := gormDB.Order("url").Find(&all).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list registries: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := make([]registrySummary, 0, len(all))
+		for i := range all {
+			out = append(out, newRegistrySummary(&all[i]))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func registryDeleteHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := spec.NormalizeRegistry(chi.URLParam(r, "host"))
+		res := gormDB.Unscoped().Where("url = ?", host).Delete(&db.RegistryCredentials{})
+		if res.Error != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete registry credentials: %v", res.Error), http.StatusInternalServerError)
+			return
+		}
+		if res.RowsAffected == 0 {
+			http.Error(w, "registry not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("[INFO] Deleted credentials for registry '%s'", host)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
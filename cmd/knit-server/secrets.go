@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/tasks"
+	"github.com/atvirokodosprendimai/knitu/internal/server/vault"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+type secretRequest struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// secretSummary is what the API returns for a secret. Values are never echoed.
+type secretSummary struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newSecretSummary(s *db.Secret) secretSummary {
+	return secretSummary{Name: s.Name, Version: s.Version, CreatedAt: s.CreatedAt, UpdatedAt: s.UpdatedAt}
+}
+
+// storeSecretVersion encrypts value and stores it as the next version of the
+// named secret, creating the secret if needed.
+func storeSecretVersion(gormDB *gorm.DB, v *vault.Vault, name, value string) (*db.Secret, error) {
+	sealed, err := v.Encrypt(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	var secret db.Secret
+	err = gormDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(db.Secret{Name: name}).FirstOrCreate(&secret).Error; err != nil {
+			return err
+		}
+		secret.Version++
+		if err := tx.Create(&db.SecretVersion{SecretID: secret.ID, Version: secret.Version, Value: sealed}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&secret).Update("version", secret.Version).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store secret: %w", err)
+	}
+	return &secret, nil
+}
+
+// loadSecret returns the decrypted value of a secret reference, "name" for
+// the latest version or "name@version" for a pinned one.
+func loadSecret(gormDB *gorm.DB, v *vault.Vault, ref string) (string, error) {
+	name, version, err := spec.ParseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	var secret db.Secret
+	if err := gormDB.Where("name = ?", name).First(&secret).Error; err != nil {
+		return "", fmt.Errorf("secret %q not found", name)
+	}
+	if version == 0 {
+		version = secret.Version
+	}
+	var sv db.SecretVersion
+	if err := gormDB.Where("secret_id = ? AND version = ?", secret.ID, version).First(&sv).Error; err != nil {
+		return "", fmt.Errorf("secret %q has no version %d", name, version)
+	}
+	value, err := v.Decrypt(sv.Value)
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", name, err)
+	}
+	return value, nil
+}
+
+// encryptLegacySecrets moves plaintext values stored before secrets were
+// encrypted and versioned into encrypted first versions, then drops the
+// plaintext column.
+func encryptLegacySecrets(gormDB *gorm.DB, v *vault.Vault) error {
+	if !gormDB.Migrator().HasColumn(&db.Secret{}, "value") {
+		return nil
+	}
+	var legacy []struct {
+		ID    uint
+		Value string
+	}
+	if err := gormDB.Table("secrets").Select("id, value").Where("version = 0 OR version IS NULL").Scan(&legacy).Error; err != nil {
+		return fmt.Errorf("failed to read legacy secrets: %w", err)
+	}
+	for _, l := range legacy {
+		sealed, err := v.Encrypt(l.Value)
+		if err != nil {
+			return err
+		}
+		if err := gormDB.Create(&db.SecretVersion{SecretID: l.ID, Version: 1, Value: sealed}).Error; err != nil {
+			return fmt.Errorf("failed to encrypt legacy secret: %w", err)
+		}
+		if err := gormDB.Table("secrets").Where("id = ?", l.ID).Update("version", 1).Error; err != nil {
+			return fmt.Errorf("failed to encrypt legacy secret: %w", err)
+		}
+	}
+	if len(legacy) > 0 {
+		log.Printf("[INFO] Encrypted %d plaintext secret(s)", len(legacy))
+	}
+	return gormDB.Migrator().DropColumn(&db.Secret{}, "value")
+}
+
+func secretCreateHandler(gormDB *gorm.DB, v *vault.Vault) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req secretRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || strings.Contains(req.Name, "@") {
+			http.Error(w, "secret name is required and must not contain '@'", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := storeSecretVersion(gormDB, v, req.Name, req.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[INFO] Stored secret '%s' version %d", secret.Name, secret.Version)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newSecretSummary(secret))
+	}
+}
+
+func secretListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var secrets []db.Secret
+		if err := gormDB.Order("name").Find(&secrets).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list secrets: %v", err), http.StatusInternalServerError)
+			return
+		}
+		out := make([]secretSummary, 0, len(secrets))
+		for i := range secrets {
+			out = append(out, newSecretSummary(&secrets[i]))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func secretDeleteHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		var secret db.Secret
+		if err := gormDB.Where("name = ?", name).First(&secret).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "secret not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to load secret: %v", err), http.StatusInternalServerError)
+			return
+		}
+		err := gormDB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Unscoped().Where("secret_id = ?", secret.ID).Delete(&db.SecretVersion{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&secret).Error
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete secret: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] Deleted secret '%s'", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// resolveTaskSecrets returns the secrets of a deploy task still in flight.
+// Only the node the task was sent to, or any node for a broadcast, gets them,
+// and only while the deployment still has the spec the task was built from.
+func resolveTaskSecrets(gormDB *gorm.DB, v *vault.Vault, req messaging.SecretsRequest) (messaging.Secrets, error) {
+	var task db.Task
+	if err := gormDB.Where("task_id = ? AND type = ?", req.TaskID, "deploy").First(&task).Error; err != nil {
+		return messaging.Secrets{}, fmt.Errorf("unknown deploy task %q", req.TaskID)
+	}
+	if tasks.Terminal(task.State) {
+		return messaging.Secrets{}, fmt.Errorf("task %s is %s", task.TaskID, task.State)
+	}
+	if task.NodeID != "" && task.NodeID != req.NodeID {
+		return messaging.Secrets{}, fmt.Errorf("task %s was not sent to node %s", task.TaskID, req.NodeID)
+	}
+	var deployment db.Deployment
+	if err := gormDB.First(&deployment, task.DeploymentID).Error; err != nil {
+		return messaging.Secrets{}, fmt.Errorf("deployment of task %s not found", task.TaskID)
+	}
+	if reconciler.SpecHash(deployment.Spec) != task.SpecHash {
+		return messaging.Secrets{}, fmt.Errorf("deployment '%s' changed since task %s was published", deployment.Name, task.TaskID)
+	}
+	var ds spec.DeploymentSpec
+	if err := json.Unmarshal([]byte(deployment.Spec), &ds); err != nil {
+		return messaging.Secrets{}, fmt.Errorf("invalid spec of deployment '%s': %w", deployment.Name, err)
+	}
+	return resolveSecrets(gormDB, v, ds)
+}
+
+// secretsRequestHandler answers agents' requests for the secrets of the
+// deploy tasks they run.
+func secretsRequestHandler(gormDB *gorm.DB, v *vault.Vault) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		var req messaging.SecretsRequest
+		if err := json.Unmarshal(m.Data, &req); err != nil {
+			log.Printf("[ERROR] Unmarshalling secrets request: %v", err)
+			return
+		}
+		secrets, err := resolveTaskSecrets(gormDB, v, req)
+		if err != nil {
+			log.Printf("[WARN] Refusing secrets of task %s to node %s: %v", req.TaskID, req.NodeID, err)
+			secrets = messaging.Secrets{Error: err.Error()}
+		}
+		b, err := json.Marshal(secrets)
+		if err != nil {
+			log.Printf("[ERROR] Marshalling secrets of task %s: %v", req.TaskID, err)
+			return
+		}
+		if err := m.Respond(b); err != nil {
+			log.Printf("[ERROR] Replying with secrets of task %s: %v", req.TaskID, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/tasks"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// maxWait caps the ?wait= duration a client may block a request for.
+const maxWait = 5 * time.Minute
+
+// deploymentResponse is a deployment together with the tasks a request
+// published and whether all its replicas are ready.
+type deploymentResponse struct {
+	*db.Deployment
+	Tasks []db.Task `json:"tasks"`
+	Ready bool      `json:"ready"`
+}
+
+// parseWait reads the optional ?wait= duration.
+func parseWait(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get("wait")
+	if raw == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid wait duration %q", raw)
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, nil
+}
+
+// writeDeploymentResponse writes the deployment and its tasks. Without wait it
+// answers 202 right away. With wait it blocks until all tasks finished and
+// the deployment is ready, and answers 200 if so, 500 if any task failed or
+// timed out, and 202 if the wait elapsed first.
+func writeDeploymentResponse(w http.ResponseWriter, r *http.Request, gormDB *gorm.DB, deployment *db.Deployment, taskIDs []string, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	found, err := tasks.Wait(ctx, gormDB, taskIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load tasks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusAccepted
+	if wait > 0 && len(found) == len(taskIDs) {
+		status = http.StatusOK
+		for _, t := range found {
+			if !tasks.Terminal(t.State) {
+				status = http.StatusAccepted
+				break
+			}
+			if t.State != tasks.StateSucceeded {
+				status = http.StatusInternalServerError
+			}
+		}
+	}
+
+	ready := false
+	if status == http.StatusOK {
+		if ready, err = waitReady(ctx, gormDB, deployment); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to check readiness: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !ready {
+			status = http.StatusAccepted
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(deploymentResponse{Deployment: deployment, Tasks: found, Ready: ready})
+}
+
+// waitReady polls until the deployment is ready or ctx is done. Health is
+// learned from agent heartbeats, so this can take a heartbeat interval.
+func waitReady(ctx context.Context, gormDB *gorm.DB, deployment *db.Deployment) (bool, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		ready, err := reconciler.Ready(gormDB, deployment)
+		if err != nil || ready {
+			return ready, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func taskGetHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var task db.Task
+		if err := gormDB.Where("task_id = ?", chi.URLParam(r, "id")).First(&task).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "task not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to load task: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(task)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"gorm.io/gorm"
+)
+
+// volumeSummary is what the API returns for a named volume.
+type volumeSummary struct {
+	Name       string    `json:"name"`
+	Node       string    `json:"node"`
+	Deployment string    `json:"deployment,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func volumeListHandler(gormDB *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var volumes []db.Volume
+		if err := gormDB.Order("name").Find(&volumes).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list volumes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		var nodes []db.Node
+		if err := gormDB.Find(&nodes).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list nodes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		nodeKeys := make(map[uint]string, len(nodes))
+		for _, n := range nodes {
+			nodeKeys[n.ID] = n.NodeID
+		}
+		var deployments []db.Deployment
+		if err := gormDB.Find(&deployments).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list deployments: %v", err), http.StatusInternalServerError)
+			return
+		}
+		names := make(map[uint]string, len(deployments))
+		for _, d := range deployments {
+			names[d.ID] = d.Name
+		}
+
+		out := make([]volumeSummary, 0, len(volumes))
+		for _, v := range volumes {
+			out = append(out, volumeSummary{Name: v.Name, Node: nodeKeys[v.NodeID], Deployment: names[v.DeploymentID], CreatedAt: v.CreatedAt})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -9,11 +10,17 @@ import (
 	"log"
 	"net/netip"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
-	"text/template"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
 	cerrdefs "github.com/containerd/errdefs"
 	"github.com/moby/moby/api/types/container"
 	"github.com/moby/moby/api/types/mount"
@@ -22,18 +29,40 @@ import (
 	"github.com/moby/moby/client"
 )
 
+const (
+	// LabelDeployment marks a container with the name of the deployment it belongs to.
+	LabelDeployment = "knit.deployment"
+	// LabelInstance marks a container with its instance (container) name.
+	LabelInstance = "knit.instance"
+)
+
 // Client is a wrapper around the official Docker client.
 type Client struct {
 	cli *client.Client
+	// allocDir holds one directory of rendered templates per container.
+	allocDir string
+	// secretsDir holds one directory of secret files per container. It must
+	// be on a tmpfs so secrets never touch the disk.
+	secretsDir string
+	// node is exposed to templates as .Node.
+	node NodeInfo
+	// hostPaths are the directories bind volumes may mount from.
+	hostPaths []string
+
+	mu sync.Mutex
+	// meshSubnets maps mesh network names to this node's subnet in them.
+	meshSubnets map[string]string
 }
 
-// NewClient creates a new Docker client.
-func NewClient() (*Client, error) {
+// NewClient creates a new Docker client for the given node that renders
+// templates under dataDir/alloc, materialises secrets under secretsDir and
+// bind-mounts host paths only from under hostPaths.
+func NewClient(dataDir, secretsDir string, hostPaths []string, node NodeInfo) (*Client, error) {
 	cli, err := client.New(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf("could not create docker client: %w", err)
 	}
-	return &Client{cli: cli}, nil
+	return &Client{cli: cli, allocDir: filepath.Join(dataDir, "alloc"), secretsDir: secretsDir, hostPaths: hostPaths, node: node}, nil
 }
 
 // DeployContainer pulls an image, creates a container, and starts it.
@@ -52,60 +81,96 @@ func (c *Client) DeployContainer(ctx context.Context, task *messaging.DeployTask
 	defer reader.Close()
 
 	// 2. Prepare Host and Container Configuration
-	hostConfig := &container.HostConfig{}
+	policy, maxRetries, err := spec.ParseRestartPolicy(task.RestartPolicy)
+	if err != nil {
+		return "", err
+	}
+	hostConfig := &container.HostConfig{
+		RestartPolicy: container.RestartPolicy{
+			Name:              container.RestartPolicyMode(policy),
+			MaximumRetryCount: maxRetries,
+		},
+		Resources: containerResources(task.Resources),
+	}
 	containerConfig := &container.Config{
 		Image: task.Image,
+		Env:   envList(task.Env),
+		Labels: map[string]string{
+			LabelDeployment: task.Name,
+			LabelInstance:   containerName(task),
+		},
+	}
+	if task.Healthcheck != nil {
+		containerConfig.Healthcheck, err = healthConfig(task.Healthcheck)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	// Handle Templates
 	if len(task.Templates) > 0 {
-		mounts, err := c.prepareTemplates(task, nil)
+		mounts, err := c.prepareTemplates(task, newTemplateData(c.node, task))
 		if err != nil {
 			return "", fmt.Errorf("could not prepare templates: %w", err)
 		}
 		hostConfig.Mounts = mounts
+	} else if err := c.removeAlloc(containerName(task)); err != nil {
+		return "", err
 	}
 
 	// Handle Port Mappings
 	if len(task.Ports) > 0 {
-		exposedPorts := make(network.PortSet)
-		portBindings := make(network.PortMap)
-
-		for _, p := range task.Ports {
-			containerPort, err := network.ParsePort(fmt.Sprintf("%d/tcp", p.ContainerPort))
-			if err != nil {
-				return "", fmt.Errorf("invalid container port %d: %w", p.ContainerPort, err)
-			}
-			exposedPorts[containerPort] = struct{}{}
-
-			hostIP := netip.Addr{}
-			if p.HostIP != "" {
-				hostIP, err = netip.ParseAddr(p.HostIP)
-				if err != nil {
-					return "", fmt.Errorf("invalid host IP '%s': %w", p.HostIP, err)
-				}
-			}
+		containerConfig.ExposedPorts, hostConfig.PortBindings, err = portMappings(task.Ports, task.HostPortRange)
+		if err != nil {
+			return "", err
+		}
+	}
 
-			portBindings[containerPort] = []network.PortBinding{
-				{
-					HostIP:   hostIP,
-					HostPort: strconv.Itoa(p.HostPort),
-				},
-			}
+	// Resolve deployments through the server's service discovery DNS.
+	for _, ns := range task.DNS {
+		addr, err := netip.ParseAddr(ns)
+		if err != nil {
+			return "", fmt.Errorf("invalid DNS server '%s': %w", ns, err)
 		}
-		containerConfig.ExposedPorts = exposedPorts
-		hostConfig.PortBindings = portBindings
+		hostConfig.DNS = append(hostConfig.DNS, addr)
+	}
+	if len(hostConfig.DNS) > 0 {
+		hostConfig.DNSSearch = []string{dnsSearchDomain}
 	}
 
 	// 3. Create Container
-	if err := c.removeContainerIfExists(ctx, task.Name); err != nil {
-		return "", fmt.Errorf("could not prepare container name '%s': %w", task.Name, err)
+	name := containerName(task)
+	if err := c.removeContainerIfExists(ctx, name); err != nil {
+		return "", fmt.Errorf("could not prepare container name '%s': %w", name, err)
+	}
+	volumes, err := c.volumeMounts(task)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Mounts = append(hostConfig.Mounts, volumes...)
+	if len(task.SecretFiles) > 0 {
+		dir, err := c.writeSecrets(name, task.SecretFiles)
+		if err != nil {
+			return "", fmt.Errorf("could not prepare secrets: %w", err)
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   dir,
+			Target:   spec.SecretsDir,
+			ReadOnly: true,
+		})
+	} else if err := c.removeSecrets(name); err != nil {
+		return "", err
 	}
 
+	if err := c.ensureNetworks(ctx, task.NetworkDefs); err != nil {
+		return "", err
+	}
 	createOptions := client.ContainerCreateOptions{
-		Config:     containerConfig,
-		HostConfig: hostConfig,
-		Name:       task.Name,
+		Config:           containerConfig,
+		HostConfig:       hostConfig,
+		NetworkingConfig: networkingConfig(task.AttachedNetworks()),
+		Name:             name,
 	}
 	resp, err := c.cli.ContainerCreate(ctx, createOptions)
 	if err != nil {
@@ -121,40 +186,210 @@ func (c *Client) DeployContainer(ctx context.Context, task *messaging.DeployTask
 	return resp.ID, nil
 }
 
+// prepareTemplates renders the templates of a task into a fresh alloc
+// directory of its container, mirroring their destinations, e.g.
+// <allocDir>/web-0/etc/nginx/nginx.conf, and returns bind mounts of their
+// directories, so re-rendered files can be renamed into place. Files of a
+// container being replaced stay mounted in it until it is removed.
 func (c *Client) prepareTemplates(task *messaging.DeployTask, data interface{}) ([]mount.Mount, error) {
-	mounts := []mount.Mount{}
-	tempDir, err := os.MkdirTemp("", "knit-templates-*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp dir for templates: %w", err)
+	dir := filepath.Join(c.allocDir, containerName(task))
+	if err := c.removeAlloc(containerName(task)); err != nil {
+		return nil, err
 	}
-	log.Printf("[INFO] Created temp dir for templates: %s. Note: This directory is not automatically cleaned up.", tempDir)
 
+	var dirs []string
 	for i, t := range task.Templates {
-		tempFilePath := filepath.Join(tempDir, fmt.Sprintf("template-%d", i))
-		tempFile, err := os.Create(tempFilePath)
+		mode, err := t.FileMode()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create temp file for template %d: %w", i, err)
+			return nil, fmt.Errorf("template %s: %w", t.Destination, err)
 		}
-		defer tempFile.Close()
-
-		tmpl, err := template.New(fmt.Sprintf("template-%d", i)).Parse(t.Content)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse template %d: %w", i, err)
+		var buf bytes.Buffer
+		if err := renderTemplate(&buf, task, i, data); err != nil {
+			return nil, err
 		}
-		if err := tmpl.Execute(tempFile, data); err != nil {
-			return nil, fmt.Errorf("failed to execute template %d: %w", i, err)
+		source := filepath.Join(dir, filepath.FromSlash(path.Clean(t.Destination)))
+		if err := writeFileAtomic(source, buf.Bytes(), os.FileMode(mode), t.UID, t.GID); err != nil {
+			return nil, fmt.Errorf("failed to write template %s: %w", t.Destination, err)
 		}
+		dirs = append(dirs, path.Dir(path.Clean(t.Destination)))
+	}
 
+	// A directory inside another mounted one is already visible through it.
+	slices.Sort(dirs)
+	mounts := []mount.Mount{}
+	for _, d := range slices.Compact(dirs) {
+		if n := len(mounts); n > 0 && strings.HasPrefix(d, mounts[n-1].Target+"/") {
+			continue
+		}
+		source := filepath.Join(dir, filepath.FromSlash(d))
 		mounts = append(mounts, mount.Mount{
 			Type:   mount.TypeBind,
-			Source: tempFilePath,
-			Target: t.Destination,
+			Source: source,
+			Target: d,
 		})
-		log.Printf("[INFO] Prepared template to be mounted from %s to %s", tempFilePath, t.Destination)
+		log.Printf("[INFO] Prepared templates to be mounted from %s to %s", source, d)
 	}
 	return mounts, nil
 }
 
+// removeAlloc deletes the rendered templates of a container, if any.
+func (c *Client) removeAlloc(containerName string) error {
+	if containerName == "" || c.allocDir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(c.allocDir, containerName)); err != nil {
+		return fmt.Errorf("could not remove templates of '%s': %w", containerName, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to file and renames it
+// into place, so readers never see a partial file. uid and gid are applied
+// when non-zero.
+func writeFileAtomic(file string, data []byte, mode os.FileMode, uid, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if uid != 0 || gid != 0 {
+		if err := f.Chown(ownerID(uid), ownerID(gid)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// ownerID maps an unset (zero) uid or gid to -1, which Chown leaves unchanged.
+func ownerID(id int) int {
+	if id == 0 {
+		return -1
+	}
+	return id
+}
+
+// writeSecrets replaces the secret files of a container. Their directory is
+// bind-mounted into the container, so the values only live in the memory
+// backing secretsDir.
+func (c *Client) writeSecrets(containerName string, files []messaging.SecretFile) (string, error) {
+	if err := c.removeSecrets(containerName); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(c.secretsDir, 0o700); err != nil {
+		return "", fmt.Errorf("could not create secrets dir: %w", err)
+	}
+	dir := filepath.Join(c.secretsDir, containerName)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", fmt.Errorf("could not create secrets dir for '%s': %w", containerName, err)
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return "", fmt.Errorf("could not create dir for secret %s: %w", f.Path, err)
+		}
+		if err := os.WriteFile(p, []byte(f.Value), os.FileMode(f.Mode)); err != nil {
+			return "", fmt.Errorf("could not write secret %s: %w", f.Path, err)
+		}
+		// WriteFile applies the umask; secrets get exactly the requested mode.
+		if err := os.Chmod(p, os.FileMode(f.Mode)); err != nil {
+			return "", fmt.Errorf("could not set mode of secret %s: %w", f.Path, err)
+		}
+	}
+	return dir, nil
+}
+
+// PrepareSecretsDir creates the directory secrets are materialised under and
+// fails unless it is on a tmpfs, so secret values never reach the disk.
+func PrepareSecretsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("could not create secrets dir: %w", err)
+	}
+	if err := requireTmpfs(dir); err != nil {
+		return fmt.Errorf("refusing to store secrets: %w", err)
+	}
+	return nil
+}
+
+// removeSecrets deletes the secret files of a container, if any.
+func (c *Client) removeSecrets(containerName string) error {
+	if containerName == "" || c.secretsDir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(c.secretsDir, containerName)); err != nil {
+		return fmt.Errorf("could not remove secrets of '%s': %w", containerName, err)
+	}
+	return nil
+}
+
+// healthConfig maps a spec healthcheck to Docker's. HTTP and TCP probes are
+// shell commands run inside the container.
+func healthConfig(h *spec.Healthcheck) (*container.HealthConfig, error) {
+	interval, timeout, startPeriod, err := h.Durations()
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthcheck: %w", err)
+	}
+	hc := &container.HealthConfig{
+		Interval:    interval,
+		Timeout:     timeout,
+		StartPeriod: startPeriod,
+		Retries:     h.Retries,
+	}
+	switch {
+	case len(h.Cmd) > 0:
+		hc.Test = append([]string{"CMD"}, h.Cmd...)
+	case h.HTTP != "":
+		url := shellQuote(h.HTTP)
+		hc.Test = []string{"CMD-SHELL", fmt.Sprintf("curl -fsS -o /dev/null %s || wget -q -O /dev/null %s || exit 1", url, url)}
+	case h.TCP != 0:
+		hc.Test = []string{"CMD-SHELL", fmt.Sprintf("nc -z 127.0.0.1 %d || exit 1", h.TCP)}
+	default:
+		return nil, fmt.Errorf("invalid healthcheck: no probe set")
+	}
+	return hc, nil
+}
+
+// shellQuote quotes s for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// envList converts an env map into Docker's KEY=value form, sorted by key so
+// repeated deploys produce an identical container config.
+func envList(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, k+"="+env[k])
+	}
+	return out
+}
+
 func getAuthString(username, password string) (string, error) {
 	if username == "" && password == "" {
 		return "", nil
@@ -170,9 +405,187 @@ func getAuthString(username, password string) (string, error) {
 	return base64.URLEncoding.EncodeToString(encodedJSON), nil
 }
 
-// UndeployContainer removes container by name if it exists.
-func (c *Client) UndeployContainer(ctx context.Context, name string) error {
-	return c.removeContainerIfExists(ctx, name)
+// dnsSearchDomain lets containers resolve deployments by their bare name.
+const dnsSearchDomain = "knit"
+
+// containerName returns the Docker container name for a task. Tasks from
+// servers predating replicas carry no instance name and use the deployment name.
+func containerName(task *messaging.DeployTask) string {
+	if task.InstanceName != "" {
+		return task.InstanceName
+	}
+	return task.Name
+}
+
+// UndeployContainer removes a single instance when instanceName is set,
+// otherwise every container labelled with the deployment name. A container
+// named exactly after the deployment (pre-replica naming) is removed as well.
+// Knit-created networks left without containers are removed afterwards.
+func (c *Client) UndeployContainer(ctx context.Context, name, instanceName string) error {
+	if err := c.removeContainers(ctx, name, instanceName); err != nil {
+		return err
+	}
+	if err := c.pruneNetworks(ctx); err != nil {
+		log.Printf("[WARN] Pruning networks after undeploying '%s': %v", name, err)
+	}
+	return nil
+}
+
+func (c *Client) removeContainers(ctx context.Context, name, instanceName string) error {
+	if instanceName != "" {
+		if err := c.removeContainerIfExists(ctx, instanceName); err != nil {
+			return err
+		}
+		return c.removeFiles(instanceName)
+	}
+
+	res, err := c.cli.ContainerList(ctx, client.ContainerListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", LabelDeployment+"="+name),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list containers for '%s': %w", name, err)
+	}
+	for _, ctr := range res.Items {
+		if _, err := c.cli.ContainerRemove(ctx, ctr.ID, client.ContainerRemoveOptions{Force: true}); err != nil && !cerrdefs.IsNotFound(err) {
+			return fmt.Errorf("could not remove container %s: %w", ctr.ID, err)
+		}
+		if err := c.removeFiles(ctr.Labels[LabelInstance]); err != nil {
+			return err
+		}
+	}
+	if err := c.removeContainerIfExists(ctx, name); err != nil {
+		return err
+	}
+	return c.removeFiles(name)
+}
+
+// removeFiles deletes the rendered templates and secrets of a removed container.
+func (c *Client) removeFiles(containerName string) error {
+	if err := c.removeAlloc(containerName); err != nil {
+		return err
+	}
+	return c.removeSecrets(containerName)
+}
+
+// ListManagedContainers returns every container carrying Knit's deployment
+// label, running or not.
+func (c *Client) ListManagedContainers(ctx context.Context) ([]messaging.ContainerReport, error) {
+	res, err := c.cli.ContainerList(ctx, client.ContainerListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", LabelDeployment),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list managed containers: %w", err)
+	}
+	reports := make([]messaging.ContainerReport, 0, len(res.Items))
+	for _, ctr := range res.Items {
+		name := ctr.Labels[LabelInstance]
+		if name == "" && len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		report := messaging.ContainerReport{
+			Name:        name,
+			ContainerID: ctr.ID,
+			Deployment:  ctr.Labels[LabelDeployment],
+			ImageDigest: ctr.ImageID,
+			State:       string(ctr.State),
+		}
+		if ctr.ImageManifestDescriptor != nil {
+			report.ImageDigest = ctr.ImageManifestDescriptor.Digest.String()
+		}
+
+		// Exit code and start time are only available from inspect.
+		inspect, err := c.cli.ContainerInspect(ctx, ctr.ID, client.ContainerInspectOptions{})
+		if err != nil {
+			if cerrdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not inspect container %s: %w", ctr.ID, err)
+		}
+		if st := inspect.Container.State; st != nil {
+			report.ExitCode = st.ExitCode
+			if st.Health != nil {
+				report.Health = string(st.Health.Status)
+			}
+			if t, err := time.Parse(time.RFC3339Nano, st.StartedAt); err == nil && !t.IsZero() {
+				report.StartedAt = t
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// portMappings turns port bindings into Docker's exposed ports and port
+// map, one entry per port of a range. Unallocated host ports are left to
+// Docker, which picks a free one of hostPortRange. Ranges need their host
+// ports allocated, since Docker would not pick consecutive ones.
+func portMappings(ports []spec.PortBinding, hostPortRange string) (network.PortSet, network.PortMap, error) {
+	exposed := make(network.PortSet)
+	bindings := make(network.PortMap)
+	for _, p := range ports {
+		hostIP := netip.Addr{}
+		if p.HostIP != "" {
+			var err error
+			hostIP, err = netip.ParseAddr(p.HostIP)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid host IP '%s': %w", p.HostIP, err)
+			}
+		}
+		if p.HostPort == 0 && p.Size() > 1 {
+			return nil, nil, fmt.Errorf("container ports %d-%d/%s have no allocated host ports", p.ContainerPort, p.ContainerPortEnd, p.Proto())
+		}
+		for i := 0; i < p.Size(); i++ {
+			containerPort, err := network.ParsePort(fmt.Sprintf("%d/%s", p.ContainerPort+i, p.Proto()))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid container port %d/%s: %w", p.ContainerPort+i, p.Proto(), err)
+			}
+			exposed[containerPort] = struct{}{}
+
+			hostPort := hostPortRange
+			if p.HostPort != 0 {
+				hostPort = strconv.Itoa(p.HostPort + i)
+			}
+			bindings[containerPort] = append(bindings[containerPort], network.PortBinding{HostIP: hostIP, HostPort: hostPort})
+		}
+	}
+	return exposed, bindings, nil
+}
+
+// HostPorts returns the bindings of a container's ports as Docker made them,
+// in the order of the requested ones, with allocated host ports filled in.
+// A range reports the host port of its first container port.
+func (c *Client) HostPorts(ctx context.Context, containerID string, requested []spec.PortBinding) ([]spec.PortBinding, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	inspect, err := c.cli.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect container %s: %w", containerID, err)
+	}
+	var bound network.PortMap
+	if inspect.Container.NetworkSettings != nil {
+		bound = inspect.Container.NetworkSettings.Ports
+	}
+	out := make([]spec.PortBinding, len(requested))
+	for i, p := range requested {
+		out[i] = p
+		containerPort, err := network.ParsePort(fmt.Sprintf("%d/%s", p.ContainerPort, p.Proto()))
+		if err != nil {
+			continue
+		}
+		for _, b := range bound[containerPort] {
+			if p.HostIP != "" && b.HostIP.String() != p.HostIP {
+				continue
+			}
+			if port, err := strconv.Atoi(b.HostPort); err == nil {
+				out[i].HostPort = port
+				break
+			}
+		}
+	}
+	return out, nil
 }
 
 func (c *Client) removeContainerIfExists(ctx context.Context, containerName string) error {
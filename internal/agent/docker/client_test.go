@@ -3,26 +3,30 @@ package docker
 import (
 	"os"
 	"path/filepath"
-	"strings"
 	"testing"
 
 	"github.com/atvirokodosprendimai/knitu/internal/messaging"
 	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/moby/moby/api/types/network"
 )
 
 func TestPrepareTemplates(t *testing.T) {
 	// 1. Setup
-	c, err := NewClient()
+	dataDir := t.TempDir()
+	c, err := NewClient(dataDir, t.TempDir(), nil, NodeInfo{})
 	if err != nil {
 		t.Fatalf("Failed to create new Docker client: %v", err)
 	}
 
 	task := &messaging.DeployTask{
+		InstanceName: "hello-0",
 		DeploymentSpec: spec.DeploymentSpec{
+			Name: "hello",
 			Templates: []spec.Template{
 				{
 					Content:     "Hello, {{ .Name }}!",
 					Destination: "/test/hello.txt",
+					Mode:        "0600",
 				},
 			},
 		},
@@ -45,20 +49,24 @@ func TestPrepareTemplates(t *testing.T) {
 		t.Fatalf("Expected 1 mount, but got %d", len(mounts))
 	}
 
+	// The template's directory is mounted, so re-rendered files can be
+	// renamed into place.
 	mount := mounts[0]
-	// Clean up the temp file and its parent dir after the test
-	defer os.RemoveAll(filepath.Dir(mount.Source))
-
-	if mount.Target != "/test/hello.txt" {
-		t.Errorf("Expected mount target to be '/test/hello.txt', but got '%s'", mount.Target)
+	if mount.Target != "/test" {
+		t.Errorf("Expected mount target to be '/test', but got '%s'", mount.Target)
 	}
 
-	if !strings.HasPrefix(filepath.Base(mount.Source), "template-") {
-		t.Errorf("Expected mount source to be a temp file, but got '%s'", mount.Source)
+	expectedSource := filepath.Join(dataDir, "alloc", "hello-0", "test")
+	if mount.Source != expectedSource {
+		t.Errorf("Expected mount source to be '%s', but got '%s'", expectedSource, mount.Source)
+	}
+	file := filepath.Join(mount.Source, "hello.txt")
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected rendered file with mode 0600, but got %v (%v)", info, err)
 	}
 
 	// Verify the content of the rendered file
-	content, err := os.ReadFile(mount.Source)
+	content, err := os.ReadFile(file)
 	if err != nil {
 		t.Fatalf("Failed to read rendered template file: %v", err)
 	}
@@ -67,4 +75,133 @@ func TestPrepareTemplates(t *testing.T) {
 	if string(content) != expectedContent {
 		t.Errorf("Expected file content to be '%s', but got '%s'", expectedContent, string(content))
 	}
+
+	// Undeploying garbage-collects the rendered files.
+	if err := c.removeFiles("hello-0"); err != nil {
+		t.Fatalf("removeFiles failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "alloc", "hello-0")); !os.IsNotExist(err) {
+		t.Errorf("Expected alloc dir to be removed, but got %v", err)
+	}
+}
+
+func TestEnvList(t *testing.T) {
+	env := map[string]string{"B": "2", "A": "1", "EMPTY": ""}
+
+	got := envList(env)
+	want := []string{"A=1", "B=2", "EMPTY="}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d env entries, but got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected env[%d] to be '%s', but got '%s'", i, want[i], got[i])
+		}
+	}
+
+	if envList(nil) != nil {
+		t.Errorf("Expected nil env list for empty map")
+	}
+}
+
+func TestPortMappings(t *testing.T) {
+	ports := []spec.PortBinding{
+		{HostPort: 53, ContainerPort: 53, Protocol: "udp"},
+		{HostPort: 53, ContainerPort: 53},
+		{HostIP: "10.54.0.15", HostPort: 27015, ContainerPort: 27015, ContainerPortEnd: 27017, Protocol: "udp"},
+		{ContainerPort: 8080},
+	}
+	exposed, bindings, err := portMappings(ports, "20000-32000")
+	if err != nil {
+		t.Fatalf("portMappings failed: %v", err)
+	}
+	if len(exposed) != 6 {
+		t.Errorf("Expected 6 exposed ports, but got %d", len(exposed))
+	}
+	want := map[string]string{
+		"53/udp":    "53",
+		"53/tcp":    "53",
+		"27015/udp": "27015",
+		"27017/udp": "27017",
+		"8080/tcp":  "20000-32000",
+	}
+	for port, hostPort := range want {
+		b := bindings[network.MustParsePort(port)]
+		if len(b) != 1 || b[0].HostPort != hostPort {
+			t.Errorf("Expected %s to be bound to host port %s, but got %v", port, hostPort, b)
+		}
+	}
+	if b := bindings[network.MustParsePort("27016/udp")]; len(b) != 1 || b[0].HostIP.String() != "10.54.0.15" {
+		t.Errorf("Expected 27016/udp to be bound on 10.54.0.15, but got %v", b)
+	}
+
+	if _, _, err := portMappings([]spec.PortBinding{{ContainerPort: 7000, ContainerPortEnd: 7002}}, "20000-32000"); err == nil {
+		t.Errorf("Expected an error for a port range without allocated host ports")
+	}
+}
+
+func TestVolumeMounts(t *testing.T) {
+	allowed := t.TempDir()
+	c := &Client{hostPaths: []string{allowed}}
+	task := &messaging.DeployTask{InstanceIndex: 2, DeploymentSpec: spec.DeploymentSpec{Name: "db", Volumes: []spec.VolumeMount{
+		{Source: "pgdata", Target: "/data"},
+		{Type: "bind", Source: filepath.Join(allowed, "conf"), Target: "/etc/db", ReadOnly: true},
+		{Type: "tmpfs", Target: "/tmp", SizeMB: 16},
+	}}}
+
+	mounts, err := c.volumeMounts(task)
+	if err != nil {
+		t.Fatalf("volumeMounts failed: %v", err)
+	}
+	if len(mounts) != 3 || mounts[0].Source != "pgdata-2" || !mounts[1].ReadOnly || mounts[2].TmpfsOptions.SizeBytes != 16<<20 {
+		t.Errorf("Unexpected mounts: %+v", mounts)
+	}
+
+	for _, p := range []string{"/etc", allowed + "-other", filepath.Join(allowed, "..")} {
+		task.Volumes = []spec.VolumeMount{{Type: "bind", Source: p, Target: "/host"}}
+		if _, err := c.volumeMounts(task); err == nil {
+			t.Errorf("Expected host path '%s' to be rejected", p)
+		}
+	}
+}
+
+func TestContainerResources(t *testing.T) {
+	res := containerResources(&spec.Resources{CPU: 1.5, MemoryMB: 512, MemoryReservationMB: 256, Pids: 100})
+	if res.NanoCPUs != 1_500_000_000 || res.Memory != 512<<20 || res.MemoryReservation != 256<<20 || res.PidsLimit == nil || *res.PidsLimit != 100 {
+		t.Errorf("Unexpected resources: %+v", res)
+	}
+	if res := containerResources(nil); res.NanoCPUs != 0 || res.Memory != 0 || res.PidsLimit != nil {
+		t.Errorf("Expected no limits without resources, but got %+v", res)
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	c := &Client{secretsDir: filepath.Join(t.TempDir(), "secrets")}
+
+	dir, err := c.writeSecrets("api-0", []messaging.SecretFile{
+		{Path: "db_password", Value: "hunter2", Mode: 0o400},
+		{Path: "tls/key.pem", Value: "KEY", Mode: 0o444},
+	})
+	if err != nil {
+		t.Fatalf("writeSecrets failed: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "db_password"))
+	if err != nil {
+		t.Fatalf("Failed to stat secret file: %v", err)
+	}
+	if info.Mode().Perm() != 0o400 {
+		t.Errorf("Expected mode 0400, but got %o", info.Mode().Perm())
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "tls", "key.pem"))
+	if err != nil || string(content) != "KEY" {
+		t.Errorf("Expected nested secret 'KEY', but got %q (%v)", content, err)
+	}
+
+	if err := c.removeSecrets("api-0"); err != nil {
+		t.Fatalf("removeSecrets failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected secrets dir to be removed, but got %v", err)
+	}
 }
@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+)
+
+const (
+	// LabelNetwork marks a Docker network created by Knit with its network name.
+	LabelNetwork = "knit.network"
+	// LabelMeshNetwork marks the routed bridge of a mesh network. Mesh
+	// networks live as long as the node is part of them and are never pruned.
+	LabelMeshNetwork = "knit.network.mesh"
+)
+
+// bridgeRoutedOption makes Docker route instead of masquerade a bridge's
+// traffic, so containers keep their own address across nodes.
+const bridgeRoutedOption = "com.docker.network.bridge.gateway_mode_ipv4"
+
+// ensureNetworks creates the networks of a task that do not exist on this
+// node yet. Networks of the same name created outside Knit are used as they
+// are. Mesh networks use this node's subnet from the last mesh config.
+func (c *Client) ensureNetworks(ctx context.Context, defs []spec.NetworkSpec) error {
+	for _, def := range defs {
+		if def.DriverName() == spec.MeshDriver {
+			c.mu.Lock()
+			subnet, ok := c.meshSubnets[def.Name]
+			c.mu.Unlock()
+			if !ok {
+				return fmt.Errorf("mesh network '%s' is not configured on this node yet", def.Name)
+			}
+			def = meshBridge(def.Name, subnet)
+		}
+		if err := c.ensureNetwork(ctx, def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// meshBridge is the local network spec of a mesh network on this node.
+func meshBridge(name, subnet string) spec.NetworkSpec {
+	return spec.NetworkSpec{Name: name, Driver: spec.MeshDriver, Subnet: subnet}
+}
+
+func (c *Client) ensureNetwork(ctx context.Context, def spec.NetworkSpec) error {
+	_, err := c.cli.NetworkInspect(ctx, def.Name, client.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("could not inspect network '%s': %w", def.Name, err)
+	}
+
+	opts := client.NetworkCreateOptions{
+		Driver: def.DriverName(),
+		Labels: map[string]string{LabelNetwork: def.Name},
+	}
+	if def.Driver == spec.MeshDriver {
+		opts.Driver = "bridge"
+		opts.Labels[LabelMeshNetwork] = "true"
+		opts.Options = map[string]string{bridgeRoutedOption: "routed"}
+	}
+	if def.Subnet != "" {
+		subnet, err := netip.ParsePrefix(def.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet of network '%s': %w", def.Name, err)
+		}
+		opts.IPAM = &network.IPAM{Config: []network.IPAMConfig{{Subnet: subnet}}}
+	}
+	if _, err := c.cli.NetworkCreate(ctx, def.Name, opts); err != nil && !cerrdefs.IsConflict(err) {
+		return fmt.Errorf("could not create network '%s': %w", def.Name, err)
+	}
+	log.Printf("[INFO] Created network '%s' (%s %s)", def.Name, opts.Driver, def.Subnet)
+	return nil
+}
+
+// ApplyMeshConfig creates the routed bridges of this node's mesh networks and
+// remembers their subnets for later deploys. Routes to other nodes are
+// programmed through wg-mesh by the caller.
+func (c *Client) ApplyMeshConfig(ctx context.Context, cfg messaging.MeshConfig) error {
+	subnets := make(map[string]string, len(cfg.Networks))
+	for _, n := range cfg.Networks {
+		if err := c.ensureNetwork(ctx, meshBridge(n.Name, n.Subnet)); err != nil {
+			return err
+		}
+		subnets[n.Name] = n.Subnet
+	}
+	c.mu.Lock()
+	c.meshSubnets = subnets
+	c.mu.Unlock()
+	return nil
+}
+
+// networkingConfig attaches a container to its networks under their aliases.
+func networkingConfig(attached []spec.NetworkAttachment) *network.NetworkingConfig {
+	if len(attached) == 0 {
+		return nil
+	}
+	cfg := &network.NetworkingConfig{EndpointsConfig: make(map[string]*network.EndpointSettings, len(attached))}
+	for _, a := range attached {
+		cfg.EndpointsConfig[a.Name] = &network.EndpointSettings{Aliases: a.Aliases}
+	}
+	return cfg
+}
+
+// pruneNetworks removes Knit-created networks that no container uses any more.
+func (c *Client) pruneNetworks(ctx context.Context) error {
+	res, err := c.cli.NetworkList(ctx, client.NetworkListOptions{
+		Filters: make(client.Filters).Add("label", LabelNetwork),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list networks: %w", err)
+	}
+	for _, n := range res.Items {
+		if n.Labels[LabelMeshNetwork] != "" {
+			continue
+		}
+		_, err := c.cli.NetworkRemove(ctx, n.ID, client.NetworkRemoveOptions{})
+		switch {
+		case err == nil:
+			log.Printf("[INFO] Removed unused network '%s'", n.Name)
+		case cerrdefs.IsConflict(err) || cerrdefs.IsNotFound(err):
+			// Still in use, or removed concurrently.
+		default:
+			return fmt.Errorf("could not remove network '%s': %w", n.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// containerResources returns the Docker limits of a spec's resources. The
+// memory reservation becomes Docker's soft limit.
+func containerResources(r *spec.Resources) container.Resources {
+	var res container.Resources
+	if r == nil {
+		return res
+	}
+	res.NanoCPUs = int64(math.Round(r.CPU * 1e9))
+	res.Memory = r.MemoryMB << 20
+	res.MemoryReservation = r.MemoryReservationMB << 20
+	if r.Pids > 0 {
+		pids := r.Pids
+		res.PidsLimit = &pids
+	}
+	return res
+}
+
+// NodeResources returns the CPU and memory of the Docker host, and what is
+// allocatable to containers once reservedCPU cores and reservedMemoryMB are
+// set aside for the system.
+func (c *Client) NodeResources(ctx context.Context, reservedCPU float64, reservedMemoryMB int64) (*messaging.NodeResources, error) {
+	info, err := c.cli.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get docker info: %w", err)
+	}
+	r := &messaging.NodeResources{
+		CPU:      float64(info.Info.NCPU),
+		MemoryMB: info.Info.MemTotal >> 20,
+	}
+	r.AllocatableCPU = math.Max(r.CPU-reservedCPU, 0)
+	r.AllocatableMemoryMB = max(r.MemoryMB-reservedMemoryMB, 0)
+	return r, nil
+}
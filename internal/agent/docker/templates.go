@@ -0,0 +1,174 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/client"
+)
+
+// NodeInfo describes the node an agent runs on, as seen by templates.
+type NodeInfo struct {
+	ID       string
+	Hostname string
+	MeshIP   string
+	Labels   map[string]string
+}
+
+// TemplateData is the context templates are rendered with.
+type TemplateData struct {
+	Node       NodeInfo
+	Deployment DeploymentInfo
+	Instance   InstanceInfo
+	// Env is the container environment without values resolved from
+	// secrets, which must never be rendered into files.
+	Env map[string]string
+}
+
+// DeploymentInfo describes the deployment a container belongs to.
+type DeploymentInfo struct {
+	ID    uint
+	Name  string
+	Image string
+}
+
+// InstanceInfo describes the replica a container runs.
+type InstanceInfo struct {
+	Index int
+	Name  string
+}
+
+// newTemplateData builds the template context of a deploy task.
+func newTemplateData(node NodeInfo, task *messaging.DeployTask) TemplateData {
+	env := make(map[string]string, len(task.Env))
+	for k, v := range task.Env {
+		if !slices.Contains(task.SecretEnv, k) {
+			env[k] = v
+		}
+	}
+	return TemplateData{
+		Node:       node,
+		Deployment: DeploymentInfo{ID: task.DeploymentID, Name: task.Name, Image: task.Image},
+		Instance:   InstanceInfo{Index: task.InstanceIndex, Name: containerName(task)},
+		Env:        env,
+	}
+}
+
+// templateFuncs returns the helper functions available to templates:
+//
+//	service "name"  the ready endpoints of a deployment, each printing as "ip:port"
+func templateFuncs(task *messaging.DeployTask) template.FuncMap {
+	return template.FuncMap{
+		"service": func(name string) []messaging.ServiceEndpoint {
+			return task.Services[name]
+		},
+	}
+}
+
+// renderTemplate executes template i of a task into w.
+func renderTemplate(w io.Writer, task *messaging.DeployTask, i int, data interface{}) error {
+	tmpl, err := template.New(fmt.Sprintf("template-%d", i)).Funcs(templateFuncs(task)).Option("missingkey=zero").Parse(task.Templates[i].Content)
+	if err != nil {
+		return fmt.Errorf("failed to parse template %d: %w", i, err)
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		return fmt.Errorf("failed to execute template %d: %w", i, err)
+	}
+	return nil
+}
+
+// RenderTemplates re-renders the templates of a running container into the
+// directories bind-mounted into it and applies the change mode of every
+// template whose output changed: one restart if any of them asks for it,
+// otherwise their signals. It returns the destinations that changed.
+func (c *Client) RenderTemplates(ctx context.Context, task *messaging.DeployTask) ([]string, error) {
+	name := containerName(task)
+	inspect, err := c.cli.ContainerInspect(ctx, name, client.ContainerInspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect container '%s': %w", name, err)
+	}
+
+	data := newTemplateData(c.node, task)
+	var changed, signals []string
+	restart := false
+	for i, t := range task.Templates {
+		source, ok := templateSource(inspect.Container.Mounts, t.Destination)
+		if !ok {
+			return changed, fmt.Errorf("container '%s' has no directory mount for template %s", name, t.Destination)
+		}
+		mode, err := t.FileMode()
+		if err != nil {
+			return changed, fmt.Errorf("template %s: %w", t.Destination, err)
+		}
+		var buf bytes.Buffer
+		if err := renderTemplate(&buf, task, i, data); err != nil {
+			return changed, err
+		}
+		current, err := os.ReadFile(source)
+		if err == nil && bytes.Equal(current, buf.Bytes()) {
+			continue
+		}
+		// The container sees the renamed file through its directory mount,
+		// and never a partially written one.
+		if err := writeFileAtomic(source, buf.Bytes(), os.FileMode(mode), t.UID, t.GID); err != nil {
+			return changed, fmt.Errorf("failed to write template %s: %w", t.Destination, err)
+		}
+		changed = append(changed, t.Destination)
+		switch t.OnChange() {
+		case spec.ChangeRestart:
+			restart = true
+		case spec.ChangeSignal:
+			if !slices.Contains(signals, t.Signal()) {
+				signals = append(signals, t.Signal())
+			}
+		}
+	}
+
+	if restart {
+		log.Printf("[INFO] Templates of '%s' changed, restarting", name)
+		if _, err := c.cli.ContainerRestart(ctx, name, client.ContainerRestartOptions{}); err != nil {
+			return changed, fmt.Errorf("could not restart container '%s': %w", name, err)
+		}
+		return changed, nil
+	}
+	for _, sig := range signals {
+		log.Printf("[INFO] Templates of '%s' changed, sending %s", name, sig)
+		if _, err := c.cli.ContainerKill(ctx, name, client.ContainerKillOptions{Signal: sig}); err != nil {
+			return changed, fmt.Errorf("could not signal container '%s': %w", name, err)
+		}
+	}
+	return changed, nil
+}
+
+// templateSource returns the host path of a template destination inside the
+// closest directory bind-mounted into a container.
+func templateSource(mounts []container.MountPoint, destination string) (string, bool) {
+	destination = path.Clean(destination)
+	best := -1
+	for i, m := range mounts {
+		if m.Type != mount.TypeBind || !strings.HasPrefix(destination, m.Destination+"/") {
+			continue
+		}
+		if best < 0 || len(m.Destination) > len(mounts[best].Destination) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	rel := strings.TrimPrefix(destination, mounts[best].Destination+"/")
+	return filepath.Join(mounts[best].Source, filepath.FromSlash(rel)), true
+}
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
+)
+
+func TestTemplateContext(t *testing.T) {
+	c := &Client{allocDir: t.TempDir(), node: NodeInfo{ID: "node-a", MeshIP: "10.99.0.1", Labels: map[string]string{"zone": "eu-1"}}}
+	task := &messaging.DeployTask{
+		InstanceIndex: 1,
+		DeploymentSpec: spec.DeploymentSpec{
+			Name: "lb",
+			Env:  map[string]string{"MODE": "prod", "TOKEN": "hunter2"},
+			Templates: []spec.Template{{
+				Destination: "/etc/nginx/conf.d/upstream.conf",
+				Content: `# {{ .Deployment.Name }}/{{ .Instance.Index }} on {{ .Node.ID }} ({{ .Node.Labels.zone }}, {{ .Node.MeshIP }}) {{ .Env.MODE }}{{ .Env.TOKEN }}
+upstream api {
+{{- range service "api" }}
+  server {{ . }};
+{{- end }}
+}`,
+			}},
+		},
+		SecretEnv: []string{"TOKEN"},
+		Services: map[string][]messaging.ServiceEndpoint{
+			"api": {{Address: "10.99.0.1", Port: 8080}, {Address: "10.99.0.2", Port: 8080}},
+		},
+	}
+
+	mounts, err := c.prepareTemplates(task, newTemplateData(c.node, task))
+	if err != nil {
+		t.Fatalf("c.prepareTemplates failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(mounts[0].Source, "upstream.conf"))
+	if err != nil {
+		t.Fatalf("Failed to read rendered template file: %v", err)
+	}
+	expected := `# lb/1 on node-a (eu-1, 10.99.0.1) prod
+upstream api {
+  server 10.99.0.1:8080;
+  server 10.99.0.2:8080;
+}`
+	if string(content) != expected {
+		t.Errorf("Expected file content to be %q, but got %q", expected, string(content))
+	}
+}
+
+func TestTemplateMountsAndSources(t *testing.T) {
+	c := &Client{allocDir: t.TempDir()}
+	task := &messaging.DeployTask{DeploymentSpec: spec.DeploymentSpec{
+		Name: "app",
+		Templates: []spec.Template{
+			{Destination: "/etc/app/app.conf", Content: "a"},
+			{Destination: "/etc/app/conf.d/extra.conf", Content: "b"},
+			{Destination: "/srv/www/index.html", Content: "c"},
+		},
+	}}
+	mounts, err := c.prepareTemplates(task, newTemplateData(c.node, task))
+	if err != nil {
+		t.Fatalf("c.prepareTemplates failed: %v", err)
+	}
+	var targets []string
+	var points []container.MountPoint
+	for _, m := range mounts {
+		targets = append(targets, m.Target)
+		points = append(points, container.MountPoint{Type: m.Type, Source: m.Source, Destination: m.Target})
+	}
+	if !slices.Equal(targets, []string{"/etc/app", "/srv/www"}) {
+		t.Errorf("Expected mounts of /etc/app and /srv/www, but got %v", targets)
+	}
+
+	// Re-rendering writes through the directory the file is visible in.
+	source, ok := templateSource(points, "/etc/app/conf.d/extra.conf")
+	if want := filepath.Join(c.allocDir, "app", "etc", "app", "conf.d", "extra.conf"); !ok || source != want {
+		t.Errorf("Expected source %s, but got %q (%v)", want, source, ok)
+	}
+	if _, ok := templateSource([]container.MountPoint{{Type: mount.TypeBind, Source: "/x", Destination: "/etc/app/app.conf"}}, "/etc/app/app.conf"); ok {
+		t.Errorf("Expected a file mount not to be written through")
+	}
+}
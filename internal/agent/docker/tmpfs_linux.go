@@ -0,0 +1,21 @@
+package docker
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// tmpfsMagic is the filesystem type statfs reports for a tmpfs.
+const tmpfsMagic = 0x01021994
+
+// requireTmpfs fails unless dir is on a tmpfs.
+func requireTmpfs(dir string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("could not stat filesystem of %s: %w", dir, err)
+	}
+	if st.Type != tmpfsMagic {
+		return fmt.Errorf("%s is not on a tmpfs (filesystem type %#x)", dir, st.Type)
+	}
+	return nil
+}
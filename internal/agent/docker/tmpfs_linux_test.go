@@ -0,0 +1,18 @@
+package docker
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRequireTmpfs(t *testing.T) {
+	if err := requireTmpfs("/proc"); err == nil {
+		t.Errorf("Expected /proc to be refused as a secrets dir")
+	}
+	if _, err := os.Stat("/dev/shm"); err != nil {
+		t.Skip("no /dev/shm on this host")
+	}
+	if err := requireTmpfs("/dev/shm"); err != nil {
+		t.Errorf("Expected /dev/shm to be accepted, but got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package docker
+
+import "fmt"
+
+// requireTmpfs fails, since only Linux can tell whether dir is on a tmpfs.
+func requireTmpfs(dir string) error {
+	return fmt.Errorf("cannot verify that %s is on a tmpfs on this platform", dir)
+}
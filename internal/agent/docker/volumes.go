@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"github.com/moby/moby/api/types/mount"
+)
+
+// volumeMounts returns the Docker mounts of an instance's volumes. Named
+// volumes are created by Docker on first use and survive redeploys; host
+// paths must lie under one of the agent's allowed directories.
+func (c *Client) volumeMounts(task *messaging.DeployTask) ([]mount.Mount, error) {
+	var mounts []mount.Mount
+	for _, v := range task.Volumes {
+		m := mount.Mount{Target: v.Target, ReadOnly: v.ReadOnly}
+		switch v.Kind() {
+		case spec.VolumeNamed:
+			m.Type = mount.TypeVolume
+			m.Source = spec.VolumeName(v.Source, task.InstanceIndex)
+			m.VolumeOptions = &mount.VolumeOptions{Labels: map[string]string{LabelDeployment: task.Name}}
+		case spec.VolumeBind:
+			if !c.hostPathAllowed(v.Source) {
+				return nil, fmt.Errorf("host path '%s' is not in the agent's allowed host paths", v.Source)
+			}
+			m.Type = mount.TypeBind
+			m.Source = v.Source
+		case spec.VolumeTmpfs:
+			m.Type = mount.TypeTmpfs
+			m.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: int64(v.SizeMB) << 20}
+		default:
+			return nil, fmt.Errorf("unsupported volume type '%s'", v.Type)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// hostPathAllowed reports whether a host path, with symlinks resolved, lies
+// under one of the allowed directories.
+func (c *Client) hostPathAllowed(p string) bool {
+	p = filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	for _, dir := range c.hostPaths {
+		dir = filepath.Clean(dir)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/glebarez/sqlite"
@@ -15,13 +16,22 @@ func NewDatabase(dsn string) (*gorm.DB, error) {
 	}
 
 	log.Println("Running database migrations...")
+	if err := dropUniqueContainerIDIndex(db); err != nil {
+		return nil, err
+	}
 	// Auto-migrate the schema
 	err = db.AutoMigrate(
 		&Node{},
 		&Deployment{},
+		&DeploymentRevision{},
 		&ContainerInstance{},
 		&RegistryCredentials{},
 		&Network{},
+		&NetworkAllocation{},
+		&Volume{},
+		&Secret{},
+		&SecretVersion{},
+		&Task{},
 	)
 	if err != nil {
 		return nil, err
@@ -30,3 +40,24 @@ func NewDatabase(dsn string) (*gorm.DB, error) {
 	log.Println("Database connection established and migrations completed.")
 	return db, nil
 }
+
+// dropUniqueContainerIDIndex drops the unique index databases created before
+// replicas kept ContainerID empty until deployed. AutoMigrate would keep it,
+// since the plain index that replaces it has the same name.
+func dropUniqueContainerIDIndex(db *gorm.DB) error {
+	const name = "idx_container_instances_container_id"
+	if !db.Migrator().HasTable(&ContainerInstance{}) {
+		return nil
+	}
+	indexes, err := db.Migrator().GetIndexes(&ContainerInstance{})
+	if err != nil {
+		return fmt.Errorf("listing container instance indexes: %w", err)
+	}
+	for _, idx := range indexes {
+		if unique, ok := idx.Unique(); idx.Name() == name && ok && unique {
+			log.Printf("Dropping unique index %s", name)
+			return db.Migrator().DropIndex(&ContainerInstance{}, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// baselineContainerInstance is ContainerInstance as first released, with a
+// unique ContainerID.
+type baselineContainerInstance struct {
+	gorm.Model
+	ContainerID  string `gorm:"uniqueIndex"`
+	NodeID       uint
+	DeploymentID uint
+}
+
+func (baselineContainerInstance) TableName() string { return "container_instances" }
+
+func TestNewDatabaseUpgradesContainerIDIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knit.db")
+	old, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := old.AutoMigrate(&baselineContainerInstance{}); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	sqlDB, _ := old.DB()
+	sqlDB.Close()
+
+	gormDB, err := NewDatabase(path)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %v", err)
+	}
+	// Pending replicas have no container yet.
+	for _, name := range []string{"web-0", "web-1"} {
+		if err := gormDB.Create(&ContainerInstance{Name: name}).Error; err != nil {
+			t.Fatalf("Expected pending replicas to share an empty container ID, but got %v", err)
+		}
+	}
+	if !gormDB.Migrator().HasIndex(&ContainerInstance{}, "idx_container_instances_container_id") {
+		t.Errorf("Expected the container ID index to be recreated as a plain index")
+	}
+}
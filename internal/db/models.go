@@ -12,8 +12,20 @@ type Node struct {
 	NodeID        string `gorm:"uniqueIndex"`
 	Hostname      string
 	Labels        string
+	MeshIP        string // Address other nodes reach this node's published ports on
+	Taints        string // JSON array of spec.Taint reported by the agent, "" if none
 	Status        string
 	LastHeartbeat time.Time
+	// Cordoned nodes get no new replicas; draining ones also have theirs
+	// moved elsewhere. Both are cleared by uncordoning.
+	Cordoned bool
+	Draining bool
+	// Capacity reported by the agent, zero until it reports any. The
+	// scheduler places reserving replicas within the allocatable part.
+	CPU                 float64
+	MemoryMB            int64
+	AllocatableCPU      float64
+	AllocatableMemoryMB int64
 }
 
 // Deployment is the specification for a set of containers.
@@ -24,30 +36,102 @@ type Deployment struct {
 	RegistryCredentialsID uint
 	NetworkAttachments    string // Simplification for now, could be a separate table
 	Templates             string // Simplification for now, JSON blob
+	Spec                  string // Full DeploymentSpec as JSON, secret references unresolved
+	NodeID                uint   // Node that claimed a broadcast deployment, 0 if scheduled
+	Revision              int    // Revision the stored spec belongs to
+	RolloutStatus         string // progressing, complete, paused, rolling_back, rolled_back
+	RolloutStartedAt      time.Time
+}
+
+// DeploymentRevision is an immutable snapshot of an accepted deployment spec.
+type DeploymentRevision struct {
+	gorm.Model
+	DeploymentID uint   `gorm:"uniqueIndex:idx_deployment_revision"`
+	Revision     int    `gorm:"uniqueIndex:idx_deployment_revision"`
+	Spec         string // Full DeploymentSpec as JSON, secret references unresolved
+	Author       string
+	Diff         string // Changed top-level spec fields, relative to the revision it replaced
 }
 
 // ContainerInstance represents a running container managed by Knit.
 type ContainerInstance struct {
 	gorm.Model
-	ContainerID  string `gorm:"uniqueIndex"`
-	NodeID       uint
-	DeploymentID uint
-	Status       string
+	ContainerID   string `gorm:"index"`
+	NodeID        uint
+	DeploymentID  uint   `gorm:"index"`
+	Name          string // Container name on the node, unique per deployment replica
+	InstanceIndex int
+	SpecHash      string // Hash of the deployment spec the instance was last deployed with
+	Ports         string // Host port bindings as JSON, with allocated host ports filled in
+	Status        string // pending, failed, missing, or the Docker state reported by the agent
+	ImageDigest   string
+	ExitCode      int
+	StartedAt     time.Time
 }
 
 // RegistryCredentials stores credentials for private Docker registries.
 type RegistryCredentials struct {
 	gorm.Model
-	URL      string `gorm:"uniqueIndex"`
+	URL      string `gorm:"uniqueIndex"` // Registry host as matched against image names, e.g. "ghcr.io"
 	Username string
-	Password string // Should be encrypted
+	Password string // Encrypted with the server master key
 }
 
-// Network represents a Docker network managed by Knit.
+// Network represents a Docker network managed by Knit. Agents create it on
+// demand, so each node has its own Docker network of that name.
 type Network struct {
 	gorm.Model
-	NetworkID string `gorm:"uniqueIndex"`
+	NetworkID string `gorm:"uniqueIndex"` // Cluster-wide ID, set as a label on the Docker networks
 	Name      string `gorm:"uniqueIndex"`
 	Driver    string
 	Subnet    string
 }
+
+// NetworkAllocation is the subnet a node runs the containers of a mesh
+// network in.
+type NetworkAllocation struct {
+	gorm.Model
+	NetworkID uint   `gorm:"uniqueIndex:idx_network_node;uniqueIndex:idx_network_subnet"` // db.Network primary key
+	NodeID    uint   `gorm:"uniqueIndex:idx_network_node"`
+	Subnet    string `gorm:"uniqueIndex:idx_network_subnet"`
+}
+
+// Volume is a named Docker volume and the node holding its data. Instances
+// mounting it are only ever placed on that node.
+type Volume struct {
+	gorm.Model
+	Name         string `gorm:"uniqueIndex"` // Docker volume name on the node
+	NodeID       uint
+	DeploymentID uint // Deployment that first mounted it
+}
+
+// Secret is a named value that deployments can reference from env as
+// "secret://<name>" or mount as a file. Its values are kept as versions.
+type Secret struct {
+	gorm.Model
+	Name    string `gorm:"uniqueIndex"`
+	Version int    // Latest version
+}
+
+// SecretVersion is one immutable value of a secret.
+type SecretVersion struct {
+	gorm.Model
+	SecretID uint   `gorm:"uniqueIndex:idx_secret_version"`
+	Version  int    `gorm:"uniqueIndex:idx_secret_version"`
+	Value    string // Encrypted with the server master key
+}
+
+// Task records a deploy or undeploy task sent to agents and its outcome.
+type Task struct {
+	gorm.Model
+	TaskID       string `gorm:"uniqueIndex"`
+	Type         string // deploy or undeploy
+	DeploymentID uint   `gorm:"index"`
+	InstanceName string
+	NodeID       string // Agent node id the task was sent to or, for broadcasts, that reported it
+	SpecHash     string // Hash of the deployment spec a deploy task was built from
+	State        string // pending, dispatched, running, succeeded, failed, timed_out
+	Message      string
+	ContainerID  string
+	CompletedAt  *time.Time
+}
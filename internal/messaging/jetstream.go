@@ -0,0 +1,96 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// StreamTasks is the JetStream stream holding every deploy, undeploy and render task.
+	StreamTasks = "KNIT_TASKS"
+	// ConsumerBroadcastDeploy is the durable consumer shared by all agents for
+	// broadcast deploys, so that exactly one agent runs each task.
+	ConsumerBroadcastDeploy = "knit-agents"
+
+	// taskAckWait bounds how long an agent may work on a task (including the
+	// image pull) before it is redelivered.
+	taskAckWait = 10 * time.Minute
+	// taskMaxDeliver bounds redeliveries of a task an agent keeps failing to ack.
+	taskMaxDeliver = 5
+	// taskDedupWindow is how long the server remembers task IDs for deduplication.
+	taskDedupWindow = 10 * time.Minute
+	// taskMaxAge is how long tasks are kept for agents that are offline.
+	taskMaxAge = 24 * time.Hour
+)
+
+// EnsureTaskStream creates or updates the stream that stores agent tasks.
+func EnsureTaskStream(ctx context.Context, js jetstream.JetStream) error {
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       StreamTasks,
+		Subjects:   []string{"knit.tasks.>"},
+		Storage:    jetstream.FileStorage,
+		Retention:  jetstream.LimitsPolicy,
+		MaxAge:     taskMaxAge,
+		Duplicates: taskDedupWindow,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create task stream: %w", err)
+	}
+	return nil
+}
+
+// PublishTask publishes a task to the task stream. The task ID is used as the
+// message ID, so republishing the same task within the dedup window is a no-op.
+func PublishTask(ctx context.Context, js jetstream.JetStream, subject, taskID string, task interface{}) error {
+	b, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+	if _, err := js.Publish(ctx, subject, b, jetstream.WithMsgID(taskID)); err != nil {
+		return fmt.Errorf("failed to publish task to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// NodeTaskConsumer returns the durable consumer for tasks addressed to a node,
+// including broadcast undeploys, which every node must process.
+func NodeTaskConsumer(ctx context.Context, js jetstream.JetStream, nodeID string) (jetstream.Consumer, error) {
+	return js.CreateOrUpdateConsumer(ctx, StreamTasks, jetstream.ConsumerConfig{
+		Durable: "agent-" + durableName(nodeID),
+		FilterSubjects: []string{
+			SubjectTaskDeployNode(nodeID),
+			SubjectTaskUndeployNode(nodeID),
+			SubjectTaskUndeployBroadcast,
+			SubjectTaskRenderNode(nodeID),
+		},
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       taskAckWait,
+		MaxDeliver:    taskMaxDeliver,
+	})
+}
+
+// BroadcastDeployConsumer returns the durable consumer shared by all agents
+// for broadcast deploys.
+func BroadcastDeployConsumer(ctx context.Context, js jetstream.JetStream) (jetstream.Consumer, error) {
+	return js.CreateOrUpdateConsumer(ctx, StreamTasks, jetstream.ConsumerConfig{
+		Durable:       ConsumerBroadcastDeploy,
+		FilterSubject: SubjectTaskDeployBroadcast,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       taskAckWait,
+		MaxDeliver:    taskMaxDeliver,
+	})
+}
+
+var invalidDurableChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// durableName makes a node id safe for use in a consumer name.
+func durableName(nodeID string) string {
+	return invalidDurableChars.ReplaceAllString(nodeID, "_")
+}
@@ -0,0 +1,78 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func startJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatalf("NATS server did not become ready")
+	}
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Failed to create JetStream context: %v", err)
+	}
+	return js
+}
+
+func TestNodeTaskConsumerDeliversOnceAfterDedup(t *testing.T) {
+	ctx := context.Background()
+	js := startJetStream(t)
+	if err := EnsureTaskStream(ctx, js); err != nil {
+		t.Fatalf("EnsureTaskStream failed: %v", err)
+	}
+
+	// The consumer must exist before tasks are published: it only delivers new ones.
+	cons, err := NodeTaskConsumer(ctx, js, "node-a")
+	if err != nil {
+		t.Fatalf("NodeTaskConsumer failed: %v", err)
+	}
+
+	deploy := DeployTask{TaskID: "t1", DeploymentID: 1}
+	for i := 0; i < 2; i++ {
+		if err := PublishTask(ctx, js, SubjectTaskDeployNode("node-a"), deploy.TaskID, deploy); err != nil {
+			t.Fatalf("PublishTask failed: %v", err)
+		}
+	}
+	undeploy := UndeployTask{TaskID: "t2", Name: "web"}
+	if err := PublishTask(ctx, js, SubjectTaskUndeployBroadcast, undeploy.TaskID, undeploy); err != nil {
+		t.Fatalf("PublishTask failed: %v", err)
+	}
+	if err := PublishTask(ctx, js, SubjectTaskDeployNode("node-b"), "t3", DeployTask{TaskID: "t3"}); err != nil {
+		t.Fatalf("PublishTask failed: %v", err)
+	}
+
+	batch, err := cons.Fetch(10, jetstream.FetchMaxWait(time.Second))
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	var subjects []string
+	for m := range batch.Messages() {
+		subjects = append(subjects, m.Subject())
+		m.Ack()
+	}
+	if len(subjects) != 2 {
+		t.Fatalf("Expected 2 tasks (deduplicated deploy and broadcast undeploy), but got %v", subjects)
+	}
+	if IsUndeploySubject(subjects[0]) || !IsUndeploySubject(subjects[1]) {
+		t.Errorf("Expected deploy then undeploy, but got %v", subjects)
+	}
+}
@@ -1,8 +1,12 @@
 package messaging
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/atvirokodosprendimai/knitu/internal/spec"
 	"log"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +22,10 @@ const (
 	SubjectTaskStatus = "knit.task.status"
 	// SubjectTaskUndeployBroadcast is the subject for undeploy tasks.
 	SubjectTaskUndeployBroadcast = "knit.tasks.undeploy.broadcast"
+	// SubjectSecretsResolve is the subject agents request the secrets of a
+	// deploy task on. Secrets only travel over request/reply, never through
+	// the persistent task stream.
+	SubjectSecretsResolve = "knit.secrets.resolve"
 )
 
 // Heartbeat is the message sent by an agent.
@@ -25,7 +33,61 @@ type Heartbeat struct {
 	NodeID    string            `json:"node_id"`
 	Hostname  string            `json:"hostname"`
 	Labels    map[string]string `json:"labels,omitempty"`
+	Taints    []spec.Taint      `json:"taints,omitempty"`
+	MeshIP    string            `json:"mesh_ip,omitempty"`
 	Timestamp time.Time         `json:"timestamp"`
+	// Containers is the agent's Knit-managed container inventory. It is null
+	// when the agent could not list containers, and an empty list when none run.
+	Containers []ContainerReport `json:"containers"`
+	// Resources is the node's capacity, nil when Docker could not report it.
+	Resources *NodeResources `json:"resources,omitempty"`
+}
+
+// NodeResources is the CPU (in cores) and memory (in MB) of a node, in total
+// and what is left for containers after the agent's system reservation.
+type NodeResources struct {
+	CPU                 float64 `json:"cpu"`
+	MemoryMB            int64   `json:"memory_mb"`
+	AllocatableCPU      float64 `json:"allocatable_cpu"`
+	AllocatableMemoryMB int64   `json:"allocatable_memory_mb"`
+}
+
+// ContainerReport describes a Knit-managed container found on an agent.
+type ContainerReport struct {
+	Name        string    `json:"name"`
+	ContainerID string    `json:"container_id"`
+	Deployment  string    `json:"deployment"`
+	ImageDigest string    `json:"image_digest,omitempty"`
+	State       string    `json:"state"`            // Docker state: created, running, exited, ...
+	Health      string    `json:"health,omitempty"` // starting, healthy or unhealthy; empty without a healthcheck
+	ExitCode    int       `json:"exit_code"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+}
+
+// SubjectAgentNetwork returns the subject the server sends a node its mesh
+// network config on.
+func SubjectAgentNetwork(nodeID string) string {
+	return "knit.agent.network." + strings.ReplaceAll(nodeID, " ", "")
+}
+
+// MeshConfig is a node's view of the mesh networks: the subnets its
+// containers use and the routes to every other node's subnets. The server
+// sends it after every heartbeat.
+type MeshConfig struct {
+	Networks []MeshNetwork `json:"networks"`
+	Routes   []MeshRoute   `json:"routes"`
+}
+
+// MeshNetwork is a mesh network as run on one node.
+type MeshNetwork struct {
+	Name   string `json:"name"`
+	Subnet string `json:"subnet"` // this node's subnet
+}
+
+// MeshRoute routes another node's container subnet via its mesh IP.
+type MeshRoute struct {
+	Subnet string `json:"subnet"`
+	Via    string `json:"via"`
 }
 
 // SubjectTaskDeployNode returns the node-specific subject for deployments.
@@ -33,26 +95,177 @@ func SubjectTaskDeployNode(nodeID string) string {
 	return "knit.tasks.deploy.node." + strings.ReplaceAll(nodeID, " ", "")
 }
 
+// SubjectTaskUndeployNode returns the node-specific subject for undeploy tasks.
+func SubjectTaskUndeployNode(nodeID string) string {
+	return "knit.tasks.undeploy.node." + strings.ReplaceAll(nodeID, " ", "")
+}
+
+// SubjectTaskRenderNode returns the node-specific subject for render tasks.
+func SubjectTaskRenderNode(nodeID string) string {
+	return "knit.tasks.render.node." + strings.ReplaceAll(nodeID, " ", "")
+}
+
+// IsRenderSubject reports whether a task subject carries a RenderTask.
+func IsRenderSubject(subject string) bool {
+	return strings.HasPrefix(subject, "knit.tasks.render.")
+}
+
+// IsUndeploySubject reports whether a task subject carries an UndeployTask.
+func IsUndeploySubject(subject string) bool {
+	return strings.HasPrefix(subject, "knit.tasks.undeploy.")
+}
+
 // DeployTask is the message sent from the server to an agent to start a deployment.
 type DeployTask struct {
-	DeploymentID uint `json:"deployment_id"`
+	TaskID        string `json:"task_id"`
+	DeploymentID  uint   `json:"deployment_id"`
+	InstanceIndex int    `json:"instance_index"`
+	InstanceName  string `json:"instance_name,omitempty"`
 	spec.DeploymentSpec
+	// SecretFiles are the resolved secret mounts of the spec, filled in by
+	// the agent from the server's reply to a SecretsRequest.
+	SecretFiles []SecretFile `json:"-"`
+	// SecretEnv lists the env keys that reference secrets. The task carries
+	// their references; the agent swaps in the values before deploying.
+	SecretEnv []string `json:"secret_env,omitempty"`
+	// NetworkDefs define the networks the spec attaches to, so agents can
+	// create missing ones.
+	NetworkDefs []spec.NetworkSpec `json:"network_defs,omitempty"`
+	// Services maps deployment names to the endpoints of their ready
+	// instances, for the "service" template function.
+	Services map[string][]ServiceEndpoint `json:"services,omitempty"`
+	// DNS lists the nameservers containers resolve with, the server's
+	// service discovery DNS if it runs one.
+	DNS []string `json:"dns,omitempty"`
+	// HostPortRange is where the agent picks host ports left at zero, for
+	// instances the scheduler did not place, e.g. "20000-32000".
+	HostPortRange string `json:"host_port_range,omitempty"`
+}
+
+// ServiceEndpoint is the mesh address of one instance of a deployment.
+type ServiceEndpoint struct {
+	Address string `json:"address"` // mesh IP of the instance's node
+	Port    int    `json:"port"`    // first published host port
+	Node    string `json:"node"`    // agent node id
+}
+
+// String returns the endpoint as "address:port".
+func (e ServiceEndpoint) String() string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(e.Port))
+}
+
+// SecretFile is a secret value to be written under spec.SecretsDir.
+type SecretFile struct {
+	Path  string `json:"path"` // relative to spec.SecretsDir
+	Value string `json:"value"`
+	Mode  uint32 `json:"mode"`
+}
+
+// SecretsRequest asks the server for the secrets of a deploy task an agent
+// is about to run.
+type SecretsRequest struct {
+	TaskID string `json:"task_id"`
+	NodeID string `json:"node_id"`
+}
+
+// Secrets is the server's reply to a SecretsRequest.
+type Secrets struct {
+	// Env maps the task's SecretEnv keys to their values.
+	Env      map[string]string `json:"env,omitempty"`
+	Files    []SecretFile      `json:"files,omitempty"`
+	Registry spec.RegistryAuth `json:"registry"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// secretsTimeout bounds how long an agent waits for the secrets of a task.
+const secretsTimeout = 10 * time.Second
+
+// FetchSecrets requests the secrets of a deploy task from the server and
+// fills them into the task.
+func FetchSecrets(nc *nats.Conn, task *DeployTask, nodeID string) error {
+	b, err := json.Marshal(SecretsRequest{TaskID: task.TaskID, NodeID: nodeID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets request: %w", err)
+	}
+	msg, err := nc.Request(SubjectSecretsResolve, b, secretsTimeout)
+	if err != nil {
+		return fmt.Errorf("could not fetch secrets: %w", err)
+	}
+	var secrets Secrets
+	if err := json.Unmarshal(msg.Data, &secrets); err != nil {
+		return fmt.Errorf("could not read secrets: %w", err)
+	}
+	if secrets.Error != "" {
+		return fmt.Errorf("could not fetch secrets: %s", secrets.Error)
+	}
+	env := make(map[string]string, len(task.Env))
+	for k, v := range task.Env {
+		env[k] = v
+	}
+	for _, k := range task.SecretEnv {
+		value, ok := secrets.Env[k]
+		if !ok {
+			return fmt.Errorf("could not fetch secrets: no value for env %s", k)
+		}
+		env[k] = value
+	}
+	task.Env = env
+	task.SecretFiles = secrets.Files
+	task.Registry = secrets.Registry
+	return nil
+}
+
+// minRedactLen keeps very short secret values from mangling messages.
+const minRedactLen = 4
+
+// Redact replaces every secret value of the task found in msg, so that
+// errors can be logged and reported without leaking secrets.
+func (t *DeployTask) Redact(msg string) string {
+	values := make([]string, 0, len(t.SecretFiles)+len(t.SecretEnv))
+	for _, f := range t.SecretFiles {
+		values = append(values, f.Value)
+	}
+	for _, k := range t.SecretEnv {
+		values = append(values, t.Env[k])
+	}
+	for _, v := range values {
+		if len(v) >= minRedactLen {
+			msg = strings.ReplaceAll(msg, v, "[redacted]")
+		}
+	}
+	return msg
+}
+
+// RenderTask asks an agent to re-render the templates of a running
+// container against fresh cluster state. It carries the instance's deploy
+// task without secrets.
+type RenderTask struct {
+	DeployTask
 }
 
-// UndeployTask asks agents to remove a deployed container.
+// UndeployTask asks agents to remove a deployed container. If InstanceName is
+// empty every container of the deployment is removed.
 type UndeployTask struct {
+	TaskID       string `json:"task_id"`
 	DeploymentID uint   `json:"deployment_id"`
 	Name         string `json:"name"`
+	InstanceName string `json:"instance_name,omitempty"`
 }
 
 // TaskStatus is the message sent from an agent to the server to report task status.
 type TaskStatus struct {
-	TaskType     string `json:"task_type"` // e.g., "deploy"
+	TaskID       string `json:"task_id,omitempty"`
+	TaskType     string `json:"task_type"`       // e.g., "deploy"
+	State        string `json:"state,omitempty"` // "running" for progress reports, empty for results
 	DeploymentID uint   `json:"deployment_id"`
 	NodeID       string `json:"node_id"`
 	Success      bool   `json:"success"`
 	Message      string `json:"message"` // Error message on failure
 	ContainerID  string `json:"container_id,omitempty"`
+	InstanceName string `json:"instance_name,omitempty"`
+	// Ports are the host port bindings of a deployed container, with
+	// allocated host ports filled in.
+	Ports []spec.PortBinding `json:"ports,omitempty"`
 }
 
 // Connect establishes a connection to a NATS server.
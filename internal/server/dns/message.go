@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// Record types and classes the responder knows about.
+const (
+	typeA   uint16 = 1
+	typeSRV uint16 = 33
+	typeANY uint16 = 255
+
+	classIN uint16 = 1
+)
+
+// Response codes.
+const (
+	rcodeSuccess  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+const (
+	headerLen = 12
+	// maxUDPLen is the largest response sent without EDNS. Longer answers are
+	// cut and flagged as truncated.
+	maxUDPLen = 512
+
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+var errMalformed = errors.New("malformed dns message")
+
+// question is the single question of a query. Name is lower-cased and has no
+// trailing dot.
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// record is a resource record of a response.
+type record struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// query is the part of a request the responder needs to answer it.
+type query struct {
+	ID       uint16
+	Flags    uint16
+	Question question
+}
+
+// Opcode returns the opcode of the query.
+func (q query) Opcode() uint16 {
+	return (q.Flags >> 11) & 0xF
+}
+
+// parseQuery reads the header and the first question of a request.
+func parseQuery(b []byte) (query, error) {
+	if len(b) < headerLen {
+		return query{}, errMalformed
+	}
+	q := query{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	if q.Flags&flagQR != 0 || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return q, errMalformed
+	}
+	name, off, err := readName(b, headerLen)
+	if err != nil || off+4 > len(b) {
+		return q, errMalformed
+	}
+	q.Question = question{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(b[off:]),
+		Class: binary.BigEndian.Uint16(b[off+2:]),
+	}
+	return q, nil
+}
+
+// readName reads an uncompressed name at off and returns it with the offset
+// following it. Questions are never compressed.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		n := int(b[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(b) {
+			return "", 0, errMalformed
+		}
+		labels = append(labels, strings.ToLower(string(b[off:off+n])))
+		off += n
+	}
+	return strings.Join(labels, "."), off, nil
+}
+
+// appendName appends name in wire format.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// aRecord returns an A record for addr.
+func aRecord(name string, ttl uint32, addr netip.Addr) record {
+	ip := addr.As4()
+	return record{Name: name, Type: typeA, TTL: ttl, Data: ip[:]}
+}
+
+// srvRecord returns an SRV record pointing at target:port.
+func srvRecord(name string, ttl uint32, port int, target string) record {
+	data := binary.BigEndian.AppendUint16(nil, 0) // priority
+	data = binary.BigEndian.AppendUint16(data, 1) // weight
+	data = binary.BigEndian.AppendUint16(data, uint16(port))
+	return record{Name: name, Type: typeSRV, TTL: ttl, Data: appendName(data, target)}
+}
+
+// buildResponse encodes the response to q. Records that would make it longer
+// than maxUDPLen are dropped: extra records first, then answers, in which case
+// the response is flagged as truncated.
+func buildResponse(q query, rcode int, authoritative bool, answers, extra []record) []byte {
+	flags := uint16(flagQR|flagRA) | q.Flags&(0xF<<11|flagRD) | uint16(rcode)
+	if authoritative {
+		flags |= flagAA
+	}
+
+	b := make([]byte, headerLen, maxUDPLen)
+	binary.BigEndian.PutUint16(b[0:], q.ID)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendName(b, q.Question.Name)
+	b = binary.BigEndian.AppendUint16(b, q.Question.Type)
+	b = binary.BigEndian.AppendUint16(b, q.Question.Class)
+
+	var ancount, arcount uint16
+	for _, r := range answers {
+		rr := appendRecord(nil, r)
+		if len(b)+len(rr) > maxUDPLen {
+			flags |= flagTC
+			break
+		}
+		b = append(b, rr...)
+		ancount++
+	}
+	if flags&flagTC == 0 {
+		for _, r := range extra {
+			rr := appendRecord(nil, r)
+			if len(b)+len(rr) > maxUDPLen {
+				break
+			}
+			b = append(b, rr...)
+			arcount++
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[6:], ancount)
+	binary.BigEndian.PutUint16(b[10:], arcount)
+	return b
+}
+
+// appendRecord appends r in wire format.
+func appendRecord(b []byte, r record) []byte {
+	b = appendName(b, r.Name)
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...)
+}
@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/server/services"
+	"gorm.io/gorm"
+)
+
+// Domain is the zone deployments are resolvable in: "<deployment>.knit" and
+// "<instance>.<deployment>.knit".
+const Domain = "knit"
+
+// forwardTimeout bounds how long a query forwarded upstream may take.
+const forwardTimeout = 2 * time.Second
+
+// Server answers DNS queries for deployments with the mesh IPs and host
+// ports of their ready instances, and forwards every other query upstream.
+// Instances are reloaded from the database on every interval, which is also
+// the TTL of the answers.
+type Server struct {
+	db       *gorm.DB
+	addr     string
+	upstream string
+	ttl      uint32
+	ticker   *time.Ticker
+	stopCh   chan bool
+	conn     net.PacketConn
+
+	mu        sync.RWMutex
+	instances map[string][]services.Instance
+}
+
+// NewServer creates a DNS server listening on addr. Queries outside the knit
+// zone go to upstream ("host:port"), or are refused if it is empty.
+func NewServer(db *gorm.DB, addr, upstream string, interval time.Duration) *Server {
+	ttl := uint32(interval / time.Second)
+	if ttl == 0 {
+		ttl = 1
+	}
+	return &Server{
+		db:       db,
+		addr:     addr,
+		upstream: upstream,
+		ttl:      ttl,
+		ticker:   time.NewTicker(interval),
+		stopCh:   make(chan bool),
+	}
+}
+
+// Start binds the UDP socket and begins serving queries and reloading
+// instances.
+func (s *Server) Start() error {
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not listen for dns on %s: %w", s.addr, err)
+	}
+	s.conn = conn
+	s.refresh()
+
+	log.Printf("[INFO] Starting DNS server on %s...", s.addr)
+	go s.serve()
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.refresh()
+			case <-s.stopCh:
+				log.Println("[INFO] Stopping DNS server.")
+				s.ticker.Stop()
+				s.conn.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop halts the DNS server.
+func (s *Server) Stop() {
+	s.stopCh <- true
+}
+
+// refresh reloads the ready instances, keyed by lower-cased deployment name.
+// On error the previous ones are kept.
+func (s *Server) refresh() {
+	loaded, err := services.Instances(s.db)
+	if err != nil {
+		log.Printf("[ERROR] DNS: loading instances: %v", err)
+		return
+	}
+	instances := make(map[string][]services.Instance, len(loaded))
+	for name, insts := range loaded {
+		instances[strings.ToLower(name)] = insts
+	}
+	s.mu.Lock()
+	s.instances = instances
+	s.mu.Unlock()
+}
+
+// serve answers queries until the socket is closed.
+func (s *Server) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[ERROR] DNS: reading query: %v", err)
+			}
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(req); resp != nil {
+				s.conn.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+// handle returns the response to a raw request, or nil to drop it.
+func (s *Server) handle(req []byte) []byte {
+	q, err := parseQuery(req)
+	if err != nil {
+		return nil
+	}
+	if q.Opcode() != 0 {
+		return buildResponse(q, rcodeNotImp, false, nil, nil)
+	}
+	if !InZone(q.Question.Name) {
+		if s.upstream == "" {
+			return buildResponse(q, rcodeRefused, false, nil, nil)
+		}
+		resp, err := s.forward(req)
+		if err != nil {
+			log.Printf("[WARN] DNS: forwarding '%s': %v", q.Question.Name, err)
+			return buildResponse(q, rcodeServFail, false, nil, nil)
+		}
+		return resp
+	}
+	rcode, answers, extra := s.resolve(q.Question)
+	return buildResponse(q, rcode, true, answers, extra)
+}
+
+// InZone reports whether name belongs to the knit zone.
+func InZone(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == Domain || strings.HasSuffix(name, "."+Domain)
+}
+
+// resolve answers a question in the knit zone. Deployment names have A
+// records for the mesh IPs of their nodes and an SRV record for every host
+// port of every instance, pointing at "<instance>.<deployment>.knit".
+// Instance names have an A record for their node only.
+func (s *Server) resolve(q question) (int, []record, []record) {
+	if q.Class != classIN {
+		return rcodeRefused, nil, nil
+	}
+	name := strings.TrimSuffix(q.Name, "."+Domain)
+	if name == Domain {
+		return rcodeSuccess, nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instances, ok := s.instances[name]
+	if !ok {
+		// "<instance>.<deployment>"
+		instance, deployment, found := strings.Cut(name, ".")
+		if !found {
+			return rcodeNXDomain, nil, nil
+		}
+		for _, inst := range s.instances[deployment] {
+			if strings.EqualFold(inst.Name, instance) {
+				return rcodeSuccess, s.addressRecords(q.Name, q.Type, []services.Instance{inst}), nil
+			}
+		}
+		return rcodeNXDomain, nil, nil
+	}
+
+	answers := s.addressRecords(q.Name, q.Type, instances)
+	var extra []record
+	if q.Type == typeSRV || q.Type == typeANY {
+		for _, inst := range instances {
+			target := strings.ToLower(inst.Name) + "." + name + "." + Domain
+			for _, p := range inst.Ports {
+				answers = append(answers, srvRecord(q.Name, s.ttl, p.HostPort, target))
+			}
+			if len(inst.Ports) > 0 {
+				extra = append(extra, s.addressRecords(target, typeA, []services.Instance{inst})...)
+			}
+		}
+	}
+	return rcodeSuccess, answers, extra
+}
+
+// addressRecords returns one A record per distinct IPv4 mesh address of
+// instances if qtype asks for it.
+func (s *Server) addressRecords(name string, qtype uint16, instances []services.Instance) []record {
+	if qtype != typeA && qtype != typeANY {
+		return nil
+	}
+	var records []record
+	seen := map[netip.Addr]bool{}
+	for _, inst := range instances {
+		addr, err := netip.ParseAddr(inst.Address)
+		if err != nil || !addr.Is4() || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		records = append(records, aRecord(name, s.ttl, addr))
+	}
+	return records
+}
+
+// forward relays a raw request to the upstream resolver and returns its
+// response.
+func (s *Server) forward(req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// UpstreamFromResolvConf returns the first nameserver of a resolv.conf file
+// as "host:53", or "" if it has none.
+func UpstreamFromResolvConf(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				return net.JoinHostPort(addr.String(), "53")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// newQuery encodes a recursive query for name.
+func newQuery(name string, qtype uint16) []byte {
+	b := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, classIN)
+}
+
+// answers decodes the rcode, the answer count and the A record addresses of
+// a response built by buildResponse.
+func answers(t *testing.T, resp []byte) (int, int, []string) {
+	t.Helper()
+	if binary.BigEndian.Uint16(resp[0:]) != 0x1234 {
+		t.Fatalf("Expected the query ID to be echoed, but got %x", resp[0:2])
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	count := int(binary.BigEndian.Uint16(resp[6:])) + int(binary.BigEndian.Uint16(resp[10:]))
+	_, off, err := readName(resp, headerLen)
+	if err != nil {
+		t.Fatalf("Failed to read question: %v", err)
+	}
+	off += 4
+	var addrs []string
+	for i := 0; i < count; i++ {
+		if _, off, err = readName(resp, off); err != nil {
+			t.Fatalf("Failed to read record name: %v", err)
+		}
+		rtype := binary.BigEndian.Uint16(resp[off:])
+		n := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if rtype == typeA {
+			addrs = append(addrs, net.IP(resp[off:off+n]).String())
+		}
+		off += n
+	}
+	return int(flags & 0xF), int(binary.BigEndian.Uint16(resp[6:])), addrs
+}
+
+func TestResolve(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy", MeshIP: "10.99.0.1"}
+	b := db.Node{NodeID: "node-b", Status: "healthy", MeshIP: "10.99.0.2"}
+	gormDB.Create(&a)
+	gormDB.Create(&b)
+	ds := spec.DeploymentSpec{Name: "api", Image: "api", Ports: []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}}}
+	specJSON, _ := json.Marshal(ds)
+	d := db.Deployment{Name: ds.Name, Image: ds.Image, Spec: string(specJSON)}
+	gormDB.Create(&d)
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "api-0", NodeID: a.ID, Status: "running"})
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "api-1", InstanceIndex: 1, NodeID: b.ID, Status: "running"})
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "api-2", InstanceIndex: 2, NodeID: a.ID, Status: "running"})
+
+	s := NewServer(gormDB, "127.0.0.1:0", "", 5*time.Second)
+	s.refresh()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		addrs   []string
+	}{
+		{"api.knit", typeA, rcodeSuccess, 2, []string{"10.99.0.1", "10.99.0.2"}},
+		{"API.knit.", typeA, rcodeSuccess, 2, []string{"10.99.0.1", "10.99.0.2"}},
+		{"api-1.api.knit", typeA, rcodeSuccess, 1, []string{"10.99.0.2"}},
+		{"api.knit", typeSRV, rcodeSuccess, 3, []string{"10.99.0.1", "10.99.0.2", "10.99.0.1"}},
+		{"api.knit", 28, rcodeSuccess, 0, nil},
+		{"web.knit", typeA, rcodeNXDomain, 0, nil},
+		{"api-9.api.knit", typeA, rcodeNXDomain, 0, nil},
+		{"example.com", typeA, rcodeRefused, 0, nil},
+	}
+	for _, tt := range tests {
+		resp := s.handle(newQuery(tt.name, tt.qtype))
+		if resp == nil {
+			t.Fatalf("%s: Expected a response, but got none", tt.name)
+		}
+		rcode, n, addrs := answers(t, resp)
+		if rcode != tt.rcode || n != tt.answers || len(addrs) != len(tt.addrs) {
+			t.Errorf("%s (%d): Expected rcode %d with %d answers and addresses %v, but got rcode %d with %d answers and %v", tt.name, tt.qtype, tt.rcode, tt.answers, tt.addrs, rcode, n, addrs)
+			continue
+		}
+		for i := range addrs {
+			if addrs[i] != tt.addrs[i] {
+				t.Errorf("%s (%d): Expected addresses %v, but got %v", tt.name, tt.qtype, tt.addrs, addrs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package liveness
+
+import (
+	"log"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"gorm.io/gorm"
+)
+
+// Service marks nodes suspect and then down when their heartbeats stop.
+// A heartbeat from the agent marks the node healthy again.
+type Service struct {
+	db           *gorm.DB
+	suspectAfter time.Duration
+	downAfter    time.Duration
+	onDown       func(nodeIDs []string)
+	ticker       *time.Ticker
+	stopCh       chan bool
+}
+
+// NewService creates a new liveness service. onDown is called with the agent
+// node ids that went down during a check, so their workloads can be moved.
+func NewService(db *gorm.DB, suspectAfter, downAfter, interval time.Duration, onDown func(nodeIDs []string)) *Service {
+	return &Service{
+		db:           db,
+		suspectAfter: suspectAfter,
+		downAfter:    downAfter,
+		onDown:       onDown,
+		ticker:       time.NewTicker(interval),
+		stopCh:       make(chan bool),
+	}
+}
+
+// Start begins the periodic liveness checks.
+func (s *Service) Start() {
+	log.Println("[INFO] Starting node liveness service...")
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.check(time.Now())
+			case <-s.stopCh:
+				log.Println("[INFO] Stopping node liveness service.")
+				s.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the liveness service.
+func (s *Service) Stop() {
+	s.stopCh <- true
+}
+
+func (s *Service) check(now time.Time) {
+	var nodes []db.Node
+	if err := s.db.Where("status IN ?", []string{"healthy", "suspect"}).Find(&nodes).Error; err != nil {
+		log.Printf("[ERROR] Liveness: loading nodes: %v", err)
+		return
+	}
+
+	var down []string
+	for _, n := range nodes {
+		silence := now.Sub(n.LastHeartbeat)
+		status := n.Status
+		switch {
+		case silence >= s.downAfter:
+			status = "down"
+		case silence >= s.suspectAfter:
+			status = "suspect"
+		}
+		if status == n.Status {
+			continue
+		}
+
+		// Only transition if no heartbeat arrived since we loaded the node.
+		res := s.db.Model(&db.Node{}).
+			Where("id = ? AND status = ? AND last_heartbeat = ?", n.ID, n.Status, n.LastHeartbeat).
+			Update("status", status)
+		if res.Error != nil {
+			log.Printf("[ERROR] Liveness: updating node %s: %v", n.NodeID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		log.Printf("[WARN] Node %s (%s) is %s, no heartbeat for %s", n.NodeID, n.Hostname, status, silence.Round(time.Second))
+		if status == "down" {
+			down = append(down, n.NodeID)
+		}
+	}
+
+	if len(down) > 0 && s.onDown != nil {
+		s.onDown(down)
+	}
+}
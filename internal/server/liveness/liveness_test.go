@@ -0,0 +1,42 @@
+package liveness
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+)
+
+func TestCheckTransitionsNodes(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	now := time.Now()
+	nodes := []db.Node{
+		{NodeID: "fresh", Status: "healthy", LastHeartbeat: now},
+		{NodeID: "quiet", Status: "healthy", LastHeartbeat: now.Add(-time.Minute)},
+		{NodeID: "gone", Status: "suspect", LastHeartbeat: now.Add(-5 * time.Minute)},
+	}
+	if err := gormDB.Create(&nodes).Error; err != nil {
+		t.Fatalf("Failed to create nodes: %v", err)
+	}
+
+	var down []string
+	s := NewService(gormDB, 30*time.Second, 2*time.Minute, time.Hour, func(ids []string) { down = ids })
+	s.check(now)
+
+	want := map[string]string{"fresh": "healthy", "quiet": "suspect", "gone": "down"}
+	for id, status := range want {
+		var n db.Node
+		if err := gormDB.First(&n, "node_id = ?", id).Error; err != nil {
+			t.Fatalf("Failed to load node %s: %v", id, err)
+		}
+		if n.Status != status {
+			t.Errorf("Expected node %s to be %s, but got %s", id, status, n.Status)
+		}
+	}
+	if len(down) != 1 || down[0] != "gone" {
+		t.Errorf("Expected onDown to be called with [gone], but got %v", down)
+	}
+}
@@ -0,0 +1,109 @@
+package meshnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// ErrExhausted is returned when a mesh network has no free node subnet left.
+var ErrExhausted = errors.New("mesh network has no free node subnet")
+
+// Allocate returns the subnet of a node in a mesh network, allocating the
+// first free one if the node has none yet.
+func Allocate(gormDB *gorm.DB, network *db.Network, nodeID uint) (string, error) {
+	var alloc db.NetworkAllocation
+	err := gormDB.Where("network_id = ? AND node_id = ?", network.ID, nodeID).First(&alloc).Error
+	if err == nil {
+		return alloc.Subnet, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	var used []string
+	if err := gormDB.Model(&db.NetworkAllocation{}).Where("network_id = ?", network.ID).Pluck("subnet", &used).Error; err != nil {
+		return "", err
+	}
+	subnet, err := nextSubnet(network.Subnet, used)
+	if err != nil {
+		return "", fmt.Errorf("network '%s': %w", network.Name, err)
+	}
+	alloc = db.NetworkAllocation{NetworkID: network.ID, NodeID: nodeID, Subnet: subnet}
+	if err := gormDB.Create(&alloc).Error; err != nil {
+		return "", err
+	}
+	return subnet, nil
+}
+
+// nextSubnet returns the first node subnet of cluster that is not used.
+func nextSubnet(cluster string, used []string) (string, error) {
+	prefix, err := netip.ParsePrefix(cluster)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() >= spec.MeshNodePrefix {
+		return "", fmt.Errorf("invalid mesh subnet %q", cluster)
+	}
+	taken := make(map[string]bool, len(used))
+	for _, u := range used {
+		taken[u] = true
+	}
+	base := prefix.Masked().Addr().As4()
+	start := binary.BigEndian.Uint32(base[:])
+	count := uint32(1) << (spec.MeshNodePrefix - prefix.Bits())
+	step := uint32(1) << (32 - spec.MeshNodePrefix)
+	for i := uint32(0); i < count; i++ {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], start+i*step)
+		subnet := netip.PrefixFrom(netip.AddrFrom4(b), spec.MeshNodePrefix).String()
+		if !taken[subnet] {
+			return subnet, nil
+		}
+	}
+	return "", ErrExhausted
+}
+
+// NodeConfig allocates the node's subnet in every mesh network and returns
+// them with the routes to the subnets of all other nodes that have a mesh IP.
+func NodeConfig(gormDB *gorm.DB, node *db.Node) (messaging.MeshConfig, error) {
+	cfg := messaging.MeshConfig{Networks: []messaging.MeshNetwork{}, Routes: []messaging.MeshRoute{}}
+	var networks []db.Network
+	if err := gormDB.Where("driver = ?", spec.MeshDriver).Order("name").Find(&networks).Error; err != nil {
+		return cfg, err
+	}
+	if len(networks) == 0 {
+		return cfg, nil
+	}
+	for i := range networks {
+		subnet, err := Allocate(gormDB, &networks[i], node.ID)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Networks = append(cfg.Networks, messaging.MeshNetwork{Name: networks[i].Name, Subnet: subnet})
+	}
+
+	var allocs []db.NetworkAllocation
+	if err := gormDB.Where("node_id <> ?", node.ID).Find(&allocs).Error; err != nil {
+		return cfg, err
+	}
+	var nodes []db.Node
+	if err := gormDB.Where("mesh_ip <> ''").Find(&nodes).Error; err != nil {
+		return cfg, err
+	}
+	meshIPs := make(map[uint]string, len(nodes))
+	for _, n := range nodes {
+		meshIPs[n.ID] = n.MeshIP
+	}
+	for _, a := range allocs {
+		if via, ok := meshIPs[a.NodeID]; ok {
+			cfg.Routes = append(cfg.Routes, messaging.MeshRoute{Subnet: a.Subnet, Via: via})
+		}
+	}
+	sort.Slice(cfg.Routes, func(i, j int) bool { return cfg.Routes[i].Subnet < cfg.Routes[j].Subnet })
+	return cfg, nil
+}
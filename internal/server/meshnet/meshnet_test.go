@@ -0,0 +1,50 @@
+package meshnet
+
+import (
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+)
+
+func TestNodeConfigAllocatesAndRoutes(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	gormDB.Create(&db.Network{NetworkID: "n1", Name: "pods", Driver: "mesh", Subnet: "10.200.0.0/23"})
+	a := db.Node{NodeID: "node-a", MeshIP: "10.99.0.1"}
+	b := db.Node{NodeID: "node-b", MeshIP: "10.99.0.2"}
+	c := db.Node{NodeID: "node-c", MeshIP: "10.99.0.3"}
+	for _, n := range []*db.Node{&a, &b, &c} {
+		gormDB.Create(n)
+	}
+
+	cfgA, err := NodeConfig(gormDB, &a)
+	if err != nil {
+		t.Fatalf("NodeConfig failed: %v", err)
+	}
+	if len(cfgA.Networks) != 1 || cfgA.Networks[0].Subnet != "10.200.0.0/24" {
+		t.Fatalf("Expected node-a to get 10.200.0.0/24, but got %v", cfgA.Networks)
+	}
+	cfgB, err := NodeConfig(gormDB, &b)
+	if err != nil {
+		t.Fatalf("NodeConfig failed: %v", err)
+	}
+	if cfgB.Networks[0].Subnet != "10.200.1.0/24" {
+		t.Errorf("Expected node-b to get 10.200.1.0/24, but got %v", cfgB.Networks)
+	}
+	if len(cfgB.Routes) != 1 || cfgB.Routes[0].Subnet != "10.200.0.0/24" || cfgB.Routes[0].Via != "10.99.0.1" {
+		t.Errorf("Expected node-b to route 10.200.0.0/24 via 10.99.0.1, but got %v", cfgB.Routes)
+	}
+
+	// A /23 only has room for two nodes.
+	if _, err := NodeConfig(gormDB, &c); err == nil {
+		t.Errorf("Expected node-c to find the network exhausted, but got no error")
+	}
+
+	// Allocations are stable.
+	again, _ := NodeConfig(gormDB, &a)
+	if again.Networks[0].Subnet != "10.200.0.0/24" || len(again.Routes) != 1 {
+		t.Errorf("Expected node-a to keep its subnet and route to node-b, but got %+v", again)
+	}
+}
@@ -0,0 +1,72 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// Scheduled reports whether the replicas of a deployment are placed by the
+// scheduler. Broadcast deployments are too while a node is cordoned,
+// draining or tainted, since any agent could claim them.
+func (s *Service) Scheduled(ds spec.DeploymentSpec) (bool, error) {
+	if ds.Scheduled() {
+		return true, nil
+	}
+	return s.scheduler.Restricted()
+}
+
+// draining reports whether a node is being drained and still reachable, so
+// the containers moved off it keep running until their replacements are
+// ready.
+func draining(n db.Node) bool {
+	return n.Draining && n.Status != "down"
+}
+
+// drainBudget returns how many ready instances of a deployment may leave
+// draining nodes at once without fewer than replicas-maxUnavailable of them
+// staying ready, the same budget a rolling update spends.
+func drainBudget(instances []db.ContainerInstance, replicas int, ds spec.DeploymentSpec) (budget, ready, maxUnavailable int) {
+	maxUnavailable = 1
+	if ds.Update != nil {
+		_, maxUnavailable = ds.Update.Limits()
+	}
+	for _, inst := range instances {
+		if InstanceReady(inst.Status, ds) {
+			ready++
+		}
+	}
+	return ready - (replicas - maxUnavailable), ready, maxUnavailable
+}
+
+// replacementReady reports whether the instance that replaces a container
+// left on a draining node is ready to take over.
+func replacementReady(deployment *db.Deployment, inst *db.ContainerInstance) bool {
+	var ds spec.DeploymentSpec
+	if err := json.Unmarshal([]byte(deployment.Spec), &ds); err != nil {
+		return true
+	}
+	return InstanceReady(inst.Status, ds)
+}
+
+// Drained reports whether no instance is placed on a node any more and, if
+// it reported its containers since, none of them still runs there.
+func (s *Service) Drained(nodeKey string) (bool, error) {
+	var node db.Node
+	if err := s.db.Where("node_id = ?", nodeKey).First(&node).Error; err != nil {
+		return false, fmt.Errorf("loading node %s: %w", nodeKey, err)
+	}
+	var placed int64
+	if err := s.db.Model(&db.ContainerInstance{}).Where("node_id = ?", node.ID).Count(&placed).Error; err != nil {
+		return false, err
+	}
+	if placed > 0 {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.inventories[nodeKey]
+	return !ok || len(inv.containers) == 0, nil
+}
@@ -0,0 +1,518 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// Dispatcher publishes tasks to agents and returns their task IDs. An empty
+// nodeKey means broadcast.
+type Dispatcher interface {
+	Deploy(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string) (string, error)
+	Undeploy(nodeKey string, task messaging.UndeployTask) (string, error)
+}
+
+// inventory is the last container list reported by a node.
+type inventory struct {
+	at         time.Time
+	containers map[string]messaging.ContainerReport // by container name
+}
+
+// Service converges the containers running on agents to the stored deployments.
+type Service struct {
+	db         *gorm.DB
+	dispatcher Dispatcher
+	scheduler  *scheduler.Scheduler
+	interval   time.Duration
+	ticker     *time.Ticker
+	stopCh     chan bool
+
+	mu          sync.Mutex // guards inventories and serialises reconcile passes
+	inventories map[string]inventory
+}
+
+// NewService creates a new reconciliation service that allocates host ports
+// from the given range.
+func NewService(db *gorm.DB, dispatcher Dispatcher, ports scheduler.PortRange, interval time.Duration) *Service {
+	return &Service{
+		db:          db,
+		dispatcher:  dispatcher,
+		scheduler:   scheduler.New(db, ports),
+		interval:    interval,
+		ticker:      time.NewTicker(interval),
+		stopCh:      make(chan bool),
+		inventories: map[string]inventory{},
+	}
+}
+
+// Start begins the periodic reconciliation loop.
+func (s *Service) Start() {
+	log.Println("[INFO] Starting reconciliation service...")
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.reconcile()
+			case <-s.stopCh:
+				log.Println("[INFO] Stopping reconciliation service.")
+				s.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the reconciliation service.
+func (s *Service) Stop() {
+	s.stopCh <- true
+}
+
+// ObserveInventory records the containers a node reported in its heartbeat
+// and updates the node's instances to reflect what actually runs there.
+func (s *Service) ObserveInventory(nodeKey string, containers []messaging.ContainerReport, at time.Time) {
+	inv := inventory{at: at, containers: make(map[string]messaging.ContainerReport, len(containers))}
+	for _, c := range containers {
+		inv.containers[c.Name] = c
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.syncInstances(nodeKey, inv); err != nil {
+		log.Printf("[ERROR] Syncing instances of node %s: %v", nodeKey, err)
+	}
+	s.inventories[nodeKey] = inv
+	s.advanceRollouts()
+}
+
+// syncInstances copies the reported container state onto the instances placed
+// on the node. Pending instances are skipped: the inventory may still list the
+// container their in-flight task is about to replace.
+func (s *Service) syncInstances(nodeKey string, inv inventory) error {
+	var node db.Node
+	if err := s.db.Where("node_id = ?", nodeKey).First(&node).Error; err != nil {
+		return err
+	}
+	var instances []db.ContainerInstance
+	if err := s.db.Where("node_id = ? AND status <> ?", node.ID, "pending").Find(&instances).Error; err != nil {
+		return err
+	}
+
+	for i := range instances {
+		inst := &instances[i]
+		updates := map[string]interface{}{}
+		c, ok := inv.containers[inst.Name]
+		switch {
+		case !ok && inst.Status != "failed" && inst.Status != "missing":
+			updates["status"] = "missing"
+		case ok:
+			if status := InstanceStatus(c); status != inst.Status {
+				updates["status"] = status
+			}
+			if c.ContainerID != inst.ContainerID {
+				updates["container_id"] = c.ContainerID
+			}
+			if c.ImageDigest != inst.ImageDigest {
+				updates["image_digest"] = c.ImageDigest
+			}
+			if c.ExitCode != inst.ExitCode {
+				updates["exit_code"] = c.ExitCode
+			}
+			if !c.StartedAt.Equal(inst.StartedAt) {
+				updates["started_at"] = c.StartedAt
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if err := s.db.Model(inst).Updates(updates).Error; err != nil {
+			return fmt.Errorf("updating instance '%s': %w", inst.Name, err)
+		}
+	}
+	return nil
+}
+
+// InstanceStatus derives an instance status from a container report: the
+// health state for running containers with a healthcheck, otherwise the
+// Docker state.
+func InstanceStatus(c messaging.ContainerReport) string {
+	if c.State == "running" && c.Health != "" {
+		return c.Health
+	}
+	return c.State
+}
+
+// Running reports whether an instance status means the container runs,
+// whatever its health.
+func Running(status string) bool {
+	switch status {
+	case "running", "starting", "healthy", "unhealthy":
+		return true
+	}
+	return false
+}
+
+// InstanceReady reports whether an instance can serve: healthy, or merely
+// running if the spec has no healthcheck and the image reports no health.
+func InstanceReady(status string, ds spec.DeploymentSpec) bool {
+	return status == "healthy" || (status == "running" && ds.Healthcheck == nil)
+}
+
+// Ready reports whether every replica of a deployment runs the current spec
+// and is ready.
+func Ready(gormDB *gorm.DB, deployment *db.Deployment) (bool, error) {
+	var ds spec.DeploymentSpec
+	if err := json.Unmarshal([]byte(deployment.Spec), &ds); err != nil {
+		return false, fmt.Errorf("decoding spec: %w", err)
+	}
+	var instances []db.ContainerInstance
+	if err := gormDB.Where("deployment_id = ?", deployment.ID).Find(&instances).Error; err != nil {
+		return false, err
+	}
+	if len(instances) != ds.ReplicaCount() {
+		return false, nil
+	}
+	hash := SpecHash(deployment.Spec)
+	for _, inst := range instances {
+		if inst.SpecHash != hash || !InstanceReady(inst.Status, ds) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SpecHash returns a short, stable identifier for a stored spec.
+func SpecHash(specJSON string) string {
+	sum := sha256.Sum256([]byte(specJSON))
+	return hex.EncodeToString(sum[:8])
+}
+
+// CheckPlacement returns an error if a scheduled deployment cannot be placed,
+// e.g. because no node matches or its host ports are taken everywhere.
+func (s *Service) CheckPlacement(ds spec.DeploymentSpec) error {
+	scheduled, err := s.Scheduled(ds)
+	if err != nil || !scheduled {
+		return err
+	}
+	_, err = s.scheduler.Place(ds, nil)
+	return err
+}
+
+// ExplainPlacement places a spec without deploying it, keeping the replicas
+// of an existing deployment of the same name where they run.
+func (s *Service) ExplainPlacement(ds spec.DeploymentSpec) (scheduler.Explanation, error) {
+	var instances []db.ContainerInstance
+	var deployment db.Deployment
+	if err := s.db.Where("name = ?", ds.Name).Limit(1).Find(&deployment).Error; err != nil {
+		return scheduler.Explanation{}, err
+	}
+	if deployment.ID != 0 {
+		if err := s.db.Where("deployment_id = ?", deployment.ID).Find(&instances).Error; err != nil {
+			return scheduler.Explanation{}, err
+		}
+	}
+	return s.scheduler.Explain(ds, instances)
+}
+
+// ReconcileDeployment converges a single deployment and returns the IDs of
+// the tasks it published. With force set every instance is redeployed, which
+// is what an explicit API submit asks for.
+func (s *Service) ReconcileDeployment(deployment *db.Deployment, force bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes, err := s.loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	return s.reconcileDeployment(deployment, nodes, force)
+}
+
+// Reconcile runs a full reconciliation pass immediately, e.g. after a node
+// went down, instead of waiting for the next tick.
+func (s *Service) Reconcile() {
+	s.reconcile()
+}
+
+func (s *Service) reconcile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes, err := s.loadNodes()
+	if err != nil {
+		log.Printf("[ERROR] Reconcile: loading nodes: %v", err)
+		return
+	}
+	var deployments []db.Deployment
+	if err := s.db.Find(&deployments).Error; err != nil {
+		log.Printf("[ERROR] Reconcile: loading deployments: %v", err)
+		return
+	}
+	for i := range deployments {
+		if _, err := s.reconcileDeployment(&deployments[i], nodes, false); err != nil {
+			log.Printf("[WARN] Reconcile: deployment '%s': %v", deployments[i].Name, err)
+		}
+	}
+	s.removeOrphans(deployments, nodes)
+}
+
+// loadNodes returns all known nodes by primary key.
+func (s *Service) loadNodes() (map[uint]db.Node, error) {
+	var nodes []db.Node
+	if err := s.db.Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]db.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	return byID, nil
+}
+
+func (s *Service) reconcileDeployment(deployment *db.Deployment, nodes map[uint]db.Node, force bool) ([]string, error) {
+	var ds spec.DeploymentSpec
+	if err := json.Unmarshal([]byte(deployment.Spec), &ds); err != nil {
+		return nil, fmt.Errorf("decoding spec: %w", err)
+	}
+	hash := SpecHash(deployment.Spec)
+
+	var instances []db.ContainerInstance
+	if err := s.db.Where("deployment_id = ?", deployment.ID).Find(&instances).Error; err != nil {
+		return nil, fmt.Errorf("loading instances: %w", err)
+	}
+	byIndex := make(map[int]*db.ContainerInstance, len(instances))
+	for i := range instances {
+		byIndex[instances[i].InstanceIndex] = &instances[i]
+	}
+
+	if ds.Rolling() && deployment.RolloutStatus == RolloutProgressing {
+		if reason := rolloutFailure(deployment, ds, instances, hash); reason != "" {
+			return s.failRollout(deployment, ds, nodes, reason)
+		}
+	}
+
+	scheduled, err := s.Scheduled(ds)
+	if err != nil {
+		return nil, err
+	}
+	var placements []scheduler.Placement
+	if scheduled {
+		placements, err = s.scheduler.Place(ds, instances)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Broadcast deployments stay on whichever node claimed them until
+		// that node goes down, then they are broadcast again.
+		p := scheduler.Placement{Index: 0}
+		if inst := byIndex[0]; inst != nil && inst.NodeID != 0 && nodes[inst.NodeID].Status != "down" {
+			p.NodeID, p.NodeKey = inst.NodeID, nodes[inst.NodeID].NodeID
+		}
+		placements = []scheduler.Placement{p}
+	}
+
+	// A rolling update replaces outdated instances within its budget instead
+	// of all at once, and keeps its surge instances until it is done.
+	rolling := ds.Rolling()
+	if rolling {
+		force = false
+	}
+	keepSurge := rolling && !rolledOut(instances, len(placements), hash, ds)
+
+	var taskIDs []string
+	for i := range instances {
+		inst := &instances[i]
+		if inst.InstanceIndex < len(placements) || (keepSurge && inst.SpecHash == hash) {
+			continue
+		}
+		log.Printf("[INFO] Reconcile: removing surplus instance '%s'", inst.Name)
+		taskID, err := s.dispatcher.Undeploy(nodes[inst.NodeID].NodeID, undeployTask(deployment, inst))
+		if err != nil {
+			return taskIDs, err
+		}
+		taskIDs = append(taskIDs, taskID)
+		if err := s.db.Delete(inst).Error; err != nil {
+			return taskIDs, fmt.Errorf("deleting instance '%s': %w", inst.Name, err)
+		}
+	}
+
+	var outdated []scheduler.Placement
+	drainLeft, ready, maxUnavailable := drainBudget(instances, len(placements), ds)
+	for _, p := range placements {
+		inst := byIndex[p.Index]
+		if !force && inst != nil && inst.NodeID == p.NodeID && s.converged(inst, nodes[inst.NodeID].NodeID, hash) {
+			continue
+		}
+		// Ready instances leave a draining node only as far as the
+		// unavailability budget allows; the others are not serving anyway.
+		if inst != nil && inst.NodeID != p.NodeID && draining(nodes[inst.NodeID]) && InstanceReady(inst.Status, ds) {
+			if drainLeft <= 0 {
+				log.Printf("[INFO] Reconcile: instance '%s' waits to leave draining node %s: %d of %d replicas ready, at most %d may be unavailable",
+					inst.Name, nodes[inst.NodeID].NodeID, ready, len(placements), maxUnavailable)
+				continue
+			}
+			drainLeft--
+			ready--
+		}
+		if rolling && inst != nil && inst.NodeID == p.NodeID && inst.SpecHash != hash && serving(inst.Status) {
+			outdated = append(outdated, p)
+			continue
+		}
+		ids, err := s.deployInstance(deployment, ds, hash, inst, p, nodes)
+		taskIDs = append(taskIDs, ids...)
+		if err != nil {
+			return taskIDs, err
+		}
+	}
+	if len(outdated) > 0 {
+		ids, err := s.rollOut(deployment, ds, hash, outdated, len(placements), nodes)
+		taskIDs = append(taskIDs, ids...)
+		if err != nil {
+			return taskIDs, err
+		}
+	}
+
+	if err := s.finishRollout(deployment); err != nil {
+		return taskIDs, err
+	}
+	return taskIDs, nil
+}
+
+// deployInstance publishes a deploy task for an instance at its placement,
+// first undeploying it from the node it leaves. A nil inst creates it.
+func (s *Service) deployInstance(deployment *db.Deployment, ds spec.DeploymentSpec, hash string, inst *db.ContainerInstance, p scheduler.Placement, nodes map[uint]db.Node) ([]string, error) {
+	var taskIDs []string
+	if inst != nil && inst.NodeID != 0 && inst.NodeID != p.NodeID {
+		// The old node may be down; it drops the container via orphan
+		// removal once it reports its inventory again. A draining node
+		// keeps it until the replacement is ready.
+		log.Printf("[INFO] Reconcile: moving instance '%s' off node %s", inst.Name, nodes[inst.NodeID].NodeID)
+		if !draining(nodes[inst.NodeID]) {
+			taskID, err := s.dispatcher.Undeploy(nodes[inst.NodeID].NodeID, undeployTask(deployment, inst))
+			if err != nil {
+				return taskIDs, err
+			}
+			taskIDs = append(taskIDs, taskID)
+		}
+	}
+	var previous []spec.PortBinding
+	if inst == nil {
+		inst = &db.ContainerInstance{DeploymentID: deployment.ID, InstanceIndex: p.Index}
+	} else if inst.NodeID == p.NodeID {
+		previous = scheduler.InstancePorts(inst)
+	}
+	inst.Name = spec.InstanceName(deployment.Name, p.Index)
+	// Broadcast instances get their host ports from the agent that claims them.
+	inst.Ports = ""
+	if p.NodeID != 0 && len(ds.Ports) > 0 {
+		ports, err := s.scheduler.AssignPorts(deployment.Name, inst.Name, p.NodeID, ds.Ports, previous)
+		if err != nil {
+			return taskIDs, fmt.Errorf("instance '%s': %w", inst.Name, err)
+		}
+		b, err := json.Marshal(ports)
+		if err != nil {
+			return taskIDs, err
+		}
+		inst.Ports = string(b)
+	}
+	inst.NodeID = p.NodeID
+	inst.SpecHash = hash
+	inst.Status = "pending"
+	if err := s.db.Save(inst).Error; err != nil {
+		return taskIDs, fmt.Errorf("storing instance '%s': %w", inst.Name, err)
+	}
+	taskID, err := s.dispatcher.Deploy(deployment, ds, inst, p.NodeKey)
+	if err != nil {
+		return taskIDs, err
+	}
+	return append(taskIDs, taskID), nil
+}
+
+// converged reports whether an instance needs no action. Pending instances
+// are given one interval to report back before the task is re-issued, and a
+// running instance is only considered gone once a heartbeat taken after its
+// last update no longer lists it.
+func (s *Service) converged(inst *db.ContainerInstance, nodeKey, hash string) bool {
+	if inst.SpecHash != hash {
+		return false
+	}
+	switch {
+	case inst.Status == "pending":
+		return time.Since(inst.UpdatedAt) < s.interval
+	case Running(inst.Status):
+		inv, ok := s.inventories[nodeKey]
+		if !ok || inv.at.Before(inst.UpdatedAt) {
+			return true
+		}
+		c, ok := inv.containers[inst.Name]
+		return ok && c.State == "running"
+	default:
+		return false
+	}
+}
+
+// removeOrphans undeploys containers that agents report but that no stored
+// instance places on that node, e.g. after a deployment was deleted while
+// its node was offline.
+func (s *Service) removeOrphans(deployments []db.Deployment, nodes map[uint]db.Node) {
+	byName := make(map[string]*db.Deployment, len(deployments))
+	for i := range deployments {
+		byName[deployments[i].Name] = &deployments[i]
+	}
+	nodeIDs := make(map[string]uint, len(nodes))
+	for id, n := range nodes {
+		if n.Status != "down" {
+			nodeIDs[n.NodeID] = id
+		}
+	}
+
+	for nodeKey, inv := range s.inventories {
+		if _, ok := nodeIDs[nodeKey]; !ok {
+			continue
+		}
+		for name, c := range inv.containers {
+			deployment := byName[c.Deployment]
+			if deployment != nil {
+				var inst db.ContainerInstance
+				err := s.db.Where("deployment_id = ? AND name = ?", deployment.ID, name).First(&inst).Error
+				if err == nil && inst.NodeID == nodeIDs[nodeKey] {
+					continue
+				}
+				if err == nil && inst.NodeID == 0 {
+					// A broadcast task was claimed before its status arrived.
+					s.db.Model(&inst).Update("node_id", nodeIDs[nodeKey])
+					continue
+				}
+				if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Printf("[ERROR] Reconcile: loading instance '%s': %v", name, err)
+					continue
+				}
+				if err == nil && draining(nodes[nodeIDs[nodeKey]]) && !replacementReady(deployment, &inst) {
+					continue
+				}
+			}
+			log.Printf("[INFO] Reconcile: removing orphaned container '%s' on node %s", name, nodeKey)
+			task := messaging.UndeployTask{Name: c.Deployment, InstanceName: name}
+			if deployment != nil {
+				task.DeploymentID = deployment.ID
+			}
+			if _, err := s.dispatcher.Undeploy(nodeKey, task); err != nil {
+				log.Printf("[ERROR] Reconcile: %v", err)
+			}
+		}
+	}
+}
+
+func undeployTask(deployment *db.Deployment, inst *db.ContainerInstance) messaging.UndeployTask {
+	return messaging.UndeployTask{DeploymentID: deployment.ID, Name: deployment.Name, InstanceName: inst.Name}
+}
@@ -0,0 +1,255 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/revisions"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+type fakeDispatcher struct {
+	deploys   []string // instance names
+	undeploys []messaging.UndeployTask
+}
+
+func (f *fakeDispatcher) Deploy(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string) (string, error) {
+	f.deploys = append(f.deploys, instance.Name)
+	return "deploy-" + instance.Name, nil
+}
+
+func (f *fakeDispatcher) Undeploy(nodeKey string, task messaging.UndeployTask) (string, error) {
+	f.undeploys = append(f.undeploys, task)
+	return "undeploy-" + task.InstanceName, nil
+}
+
+func newTestService(t *testing.T) (*Service, *gorm.DB, *fakeDispatcher) {
+	t.Helper()
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	node := db.Node{NodeID: "node-a", Status: "healthy", Labels: `{"role":"api"}`, LastHeartbeat: time.Now()}
+	if err := gormDB.Create(&node).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	f := &fakeDispatcher{}
+	return NewService(gormDB, f, scheduler.DefaultPortRange, time.Minute), gormDB, f
+}
+
+func createDeployment(t *testing.T, gormDB *gorm.DB, ds spec.DeploymentSpec) *db.Deployment {
+	t.Helper()
+	b, _ := json.Marshal(ds)
+	d := db.Deployment{Name: ds.Name, Image: ds.Image, Spec: string(b)}
+	if err := gormDB.Create(&d).Error; err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+	return &d
+}
+
+func TestReconcileRedeploysMissingContainer(t *testing.T) {
+	s, gormDB, f := newTestService(t)
+	d := createDeployment(t, gormDB, spec.DeploymentSpec{Name: "web", Image: "nginx", Replicas: 2, NodeSelector: map[string]string{"role": "api"}})
+
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	if len(f.deploys) != 2 {
+		t.Fatalf("Expected 2 deploys, but got %d", len(f.deploys))
+	}
+
+	// Both instances report running, but the node only lists one of them.
+	gormDB.Model(&db.ContainerInstance{}).Where("deployment_id = ?", d.ID).Update("status", "running")
+	s.ObserveInventory("node-a", []messaging.ContainerReport{{Name: "web-0", ContainerID: "c0", Deployment: "web", State: "running", ExitCode: 0}}, time.Now().Add(time.Second))
+
+	var instances []db.ContainerInstance
+	gormDB.Order("instance_index").Find(&instances)
+	if instances[0].ContainerID != "c0" || instances[0].Status != "running" {
+		t.Errorf("Expected 'web-0' to be running as c0, but got %s as %q", instances[0].Status, instances[0].ContainerID)
+	}
+	if instances[1].Status != "missing" {
+		t.Errorf("Expected 'web-1' to be missing, but got %s", instances[1].Status)
+	}
+
+	f.deploys = nil
+	s.reconcile()
+	if len(f.deploys) != 1 || f.deploys[0] != "web-1" {
+		t.Errorf("Expected only 'web-1' to be redeployed, but got %v", f.deploys)
+	}
+}
+
+func TestScheduledWhileNodeCordoned(t *testing.T) {
+	s, gormDB, _ := newTestService(t)
+	ds := spec.DeploymentSpec{Name: "web", Image: "nginx"}
+	if scheduled, err := s.Scheduled(ds); err != nil || scheduled {
+		t.Errorf("Expected a broadcast deployment, but got scheduled %v (%v)", scheduled, err)
+	}
+	gormDB.Model(&db.Node{}).Where("node_id = ?", "node-a").Update("cordoned", true)
+	if scheduled, err := s.Scheduled(ds); err != nil || !scheduled {
+		t.Errorf("Expected the scheduler to place it while a node is cordoned, but got %v (%v)", scheduled, err)
+	}
+}
+
+func TestReconcileRemovesOrphans(t *testing.T) {
+	s, _, f := newTestService(t)
+
+	s.ObserveInventory("node-a", []messaging.ContainerReport{{Name: "gone-0", Deployment: "gone", State: "running"}}, time.Now())
+	s.reconcile()
+
+	if len(f.undeploys) != 1 || f.undeploys[0].InstanceName != "gone-0" {
+		t.Errorf("Expected orphan 'gone-0' to be undeployed, but got %v", f.undeploys)
+	}
+}
+
+func TestReadyWaitsForHealthyInstances(t *testing.T) {
+	s, gormDB, _ := newTestService(t)
+	d := createDeployment(t, gormDB, spec.DeploymentSpec{
+		Name: "api", Image: "api", Replicas: 2, NodeSelector: map[string]string{"role": "api"},
+		Healthcheck: &spec.Healthcheck{HTTP: "http://localhost:8080/healthz"},
+	})
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	gormDB.Model(&db.ContainerInstance{}).Where("deployment_id = ?", d.ID).Update("status", "running")
+
+	s.ObserveInventory("node-a", []messaging.ContainerReport{
+		{Name: "api-0", Deployment: "api", State: "running", Health: "healthy"},
+		{Name: "api-1", Deployment: "api", State: "running", Health: "starting"},
+	}, time.Now().Add(time.Second))
+	if ready, err := Ready(gormDB, d); err != nil || ready {
+		t.Errorf("Expected deployment not to be ready while 'api-1' is starting, but got %v (%v)", ready, err)
+	}
+
+	s.ObserveInventory("node-a", []messaging.ContainerReport{
+		{Name: "api-0", Deployment: "api", State: "running", Health: "healthy"},
+		{Name: "api-1", Deployment: "api", State: "running", Health: "healthy"},
+	}, time.Now().Add(2*time.Second))
+	if ready, err := Ready(gormDB, d); err != nil || !ready {
+		t.Errorf("Expected deployment to be ready, but got %v (%v)", ready, err)
+	}
+}
+
+func TestRollingUpdateProgressesAndRollsBack(t *testing.T) {
+	s, gormDB, f := newTestService(t)
+	ds := spec.DeploymentSpec{
+		Name: "web", Image: "web:v1", Replicas: 2, NodeSelector: map[string]string{"role": "api"},
+		Update: &spec.UpdateStrategy{Type: spec.UpdateRolling},
+	}
+	d := createDeployment(t, gormDB, ds)
+	revisions.Record(gormDB, d.ID, 0, d.Spec, "")
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	setStatus := func(name, status string) {
+		gormDB.Model(&db.ContainerInstance{}).Where("name = ?", name).Update("status", status)
+	}
+	setStatus("web-0", "running")
+	setStatus("web-1", "running")
+
+	// Roll out v2 with the default max_unavailable of 1.
+	ds.Image = "web:v2"
+	b, _ := json.Marshal(ds)
+	d.Spec, d.Revision = string(b), 2
+	d.RolloutStatus, d.RolloutStartedAt = RolloutProgressing, time.Now()
+	gormDB.Save(d)
+	revisions.Record(gormDB, d.ID, 1, d.Spec, "")
+
+	f.deploys = nil
+	s.ReconcileDeployment(d, true)
+	if len(f.deploys) != 1 || f.deploys[0] != "web-0" {
+		t.Fatalf("Expected only 'web-0' to be updated first, but got %v", f.deploys)
+	}
+	s.ReconcileDeployment(d, false)
+	if len(f.deploys) != 1 {
+		t.Fatalf("Expected no progress while 'web-0' is pending, but got %v", f.deploys)
+	}
+
+	setStatus("web-0", "running")
+	f.deploys = nil
+	s.ReconcileDeployment(d, false)
+	if len(f.deploys) != 1 || f.deploys[0] != "web-1" {
+		t.Fatalf("Expected 'web-1' to be updated next, but got %v", f.deploys)
+	}
+
+	// The new revision fails on 'web-1': the deployment returns to v1.
+	setStatus("web-1", "failed")
+	f.deploys = nil
+	s.ReconcileDeployment(d, false)
+
+	var stored db.Deployment
+	gormDB.First(&stored, d.ID)
+	if stored.Revision != 1 || stored.Image != "web:v1" || stored.RolloutStatus != RolloutRollingBack {
+		t.Errorf("Expected rollback to revision 1 (web:v1), but got revision %d (%s) %s", stored.Revision, stored.Image, stored.RolloutStatus)
+	}
+	if len(f.deploys) != 1 || f.deploys[0] != "web-1" {
+		t.Errorf("Expected failed 'web-1' to be redeployed first, but got %v", f.deploys)
+	}
+}
+
+func TestRollingUpdateWithoutRoomForSurge(t *testing.T) {
+	s, gormDB, f := newTestService(t)
+	// A fixed host port on the only node leaves no room for a surge instance.
+	ds := spec.DeploymentSpec{
+		Name: "web", Image: "web:v1", NodeSelector: map[string]string{"role": "api"},
+		Ports:  []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}},
+		Update: &spec.UpdateStrategy{Type: spec.UpdateRolling, MaxSurge: 1, MaxUnavailable: 1},
+	}
+	d := createDeployment(t, gormDB, ds)
+	revisions.Record(gormDB, d.ID, 0, d.Spec, "")
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	gormDB.Model(&db.ContainerInstance{}).Where("name = ?", "web-0").Update("status", "running")
+
+	ds.Image = "web:v2"
+	b, _ := json.Marshal(ds)
+	d.Spec, d.Revision = string(b), 2
+	d.RolloutStatus, d.RolloutStartedAt = RolloutProgressing, time.Now()
+	gormDB.Save(d)
+	revisions.Record(gormDB, d.ID, 1, d.Spec, "")
+
+	f.deploys = nil
+	if _, err := s.ReconcileDeployment(d, true); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	if len(f.deploys) != 1 || f.deploys[0] != "web-0" {
+		t.Errorf("Expected 'web-0' to be updated in place, but got %v", f.deploys)
+	}
+}
+
+func TestDrainMovesInstancesWithinUnavailabilityBudget(t *testing.T) {
+	s, gormDB, f := newTestService(t)
+	d := createDeployment(t, gormDB, spec.DeploymentSpec{
+		Name: "web", Image: "nginx", Replicas: 3, NodeSelector: map[string]string{"role": "api"},
+		Update: &spec.UpdateStrategy{MaxUnavailable: 2},
+	})
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	gormDB.Model(&db.ContainerInstance{}).Where("deployment_id = ?", d.ID).Update("status", "running")
+
+	gormDB.Create(&db.Node{NodeID: "node-b", Status: "healthy", Labels: `{"role":"api"}`, LastHeartbeat: time.Now()})
+	gormDB.Model(&db.Node{}).Where("node_id = ?", "node-a").Update("draining", true)
+
+	f.deploys = nil
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	if len(f.deploys) != 2 {
+		t.Errorf("Expected 2 instances to leave the draining node, but got %v", f.deploys)
+	}
+
+	// The moved instances are not ready yet, so the last one waits.
+	f.deploys = nil
+	if _, err := s.ReconcileDeployment(d, false); err != nil {
+		t.Fatalf("ReconcileDeployment failed: %v", err)
+	}
+	if len(f.deploys) != 0 {
+		t.Errorf("Expected the last instance to wait for the moved ones, but got %v", f.deploys)
+	}
+}
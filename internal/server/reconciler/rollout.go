@@ -0,0 +1,266 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/server/revisions"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// Rollout states of a deployment.
+const (
+	RolloutProgressing = "progressing" // a new revision is being rolled out
+	RolloutComplete    = "complete"    // every replica runs the revision and is ready
+	RolloutPaused      = "paused"      // a rolling update failed and was stopped
+	RolloutRollingBack = "rolling_back"
+	RolloutRolledBack  = "rolled_back"
+)
+
+// serving reports whether an instance of an outdated spec still serves,
+// i.e. replacing it costs availability.
+func serving(status string) bool {
+	return status == "running" || status == "healthy"
+}
+
+// rolledOut reports whether every replica runs the current spec and is ready.
+func rolledOut(instances []db.ContainerInstance, replicas int, hash string, ds spec.DeploymentSpec) bool {
+	ready := 0
+	for _, inst := range instances {
+		if inst.InstanceIndex < replicas && inst.SpecHash == hash && InstanceReady(inst.Status, ds) {
+			ready++
+		}
+	}
+	return ready == replicas
+}
+
+// rolloutFailure returns why a rolling update failed, or "" if it did not.
+func rolloutFailure(deployment *db.Deployment, ds spec.DeploymentSpec, instances []db.ContainerInstance, hash string) string {
+	if time.Since(deployment.RolloutStartedAt) > ds.Update.Deadline() {
+		return fmt.Sprintf("not ready within %s", ds.Update.Deadline())
+	}
+	for _, inst := range instances {
+		if inst.SpecHash != hash {
+			continue
+		}
+		switch inst.Status {
+		case "failed":
+			return fmt.Sprintf("instance '%s' failed to deploy", inst.Name)
+		case "unhealthy":
+			return fmt.Sprintf("instance '%s' is unhealthy", inst.Name)
+		case "exited", "dead":
+			return fmt.Sprintf("instance '%s' exited with code %d", inst.Name, inst.ExitCode)
+		}
+	}
+	return ""
+}
+
+// failRollout pauses a failed rolling update or rolls the deployment back to
+// its previous revision, which is then rolled out like any other.
+func (s *Service) failRollout(deployment *db.Deployment, ds spec.DeploymentSpec, nodes map[uint]db.Node, reason string) ([]string, error) {
+	log.Printf("[WARN] Rollout of '%s' revision %d failed: %s", deployment.Name, deployment.Revision, reason)
+
+	prev, err := revisions.Previous(s.db, deployment.ID, deployment.Revision)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("loading previous revision: %w", err)
+	}
+	if ds.Update.FailureAction == spec.FailurePause || prev == nil {
+		return nil, s.db.Model(deployment).Update("rollout_status", RolloutPaused).Error
+	}
+
+	log.Printf("[INFO] Rolling back '%s' to revision %d", deployment.Name, prev.Revision)
+	if err := s.applyRevision(deployment, prev); err != nil {
+		return nil, err
+	}
+	return s.reconcileDeployment(deployment, nodes, false)
+}
+
+// Rollback switches a deployment to one of its earlier revisions and rolls
+// it out like any other update, returning the IDs of the published tasks.
+func (s *Service) Rollback(deployment *db.Deployment, rev *db.DeploymentRevision) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes, err := s.loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyRevision(deployment, rev); err != nil {
+		return nil, err
+	}
+	return s.reconcileDeployment(deployment, nodes, false)
+}
+
+// applyRevision stores a revision's spec as the deployment's current one and
+// marks the deployment as rolling back to it.
+func (s *Service) applyRevision(deployment *db.Deployment, rev *db.DeploymentRevision) error {
+	var ds spec.DeploymentSpec
+	if err := json.Unmarshal([]byte(rev.Spec), &ds); err != nil {
+		return fmt.Errorf("decoding revision %d: %w", rev.Revision, err)
+	}
+	templates := ""
+	if len(ds.Templates) > 0 {
+		b, err := json.Marshal(ds.Templates)
+		if err != nil {
+			return fmt.Errorf("encoding templates of revision %d: %w", rev.Revision, err)
+		}
+		templates = string(b)
+	}
+
+	deployment.Spec = rev.Spec
+	deployment.Image = ds.Image
+	deployment.Templates = templates
+	deployment.NetworkAttachments = ds.NetworkNames()
+	deployment.Revision = rev.Revision
+	deployment.RolloutStatus = RolloutRollingBack
+	deployment.RolloutStartedAt = time.Now()
+	if err := s.db.Model(deployment).Select("spec", "image", "network_attachments", "templates", "revision", "rollout_status", "rollout_started_at").Updates(deployment).Error; err != nil {
+		return fmt.Errorf("storing rollback: %w", err)
+	}
+	return nil
+}
+
+// rollOut replaces outdated instances without letting fewer than
+// replicas-maxUnavailable instances serve. Surge instances above the replica
+// count are started first when the strategy allows them.
+func (s *Service) rollOut(deployment *db.Deployment, ds spec.DeploymentSpec, hash string, outdated []scheduler.Placement, replicas int, nodes map[uint]db.Node) ([]string, error) {
+	maxSurge, maxUnavailable := ds.Update.Limits()
+
+	var instances []db.ContainerInstance
+	if err := s.db.Where("deployment_id = ?", deployment.ID).Find(&instances).Error; err != nil {
+		return nil, fmt.Errorf("loading instances: %w", err)
+	}
+	byIndex := make(map[int]*db.ContainerInstance, len(instances))
+	available, surge := 0, 0
+	for i := range instances {
+		inst := &instances[i]
+		byIndex[inst.InstanceIndex] = inst
+		if inst.InstanceIndex >= replicas {
+			surge++
+		}
+		if (inst.SpecHash == hash && InstanceReady(inst.Status, ds)) || (inst.SpecHash != hash && serving(inst.Status)) {
+			available++
+		}
+	}
+
+	var taskIDs []string
+	if want := min(maxSurge, len(outdated)) - surge; want > 0 {
+		// Without room for surge instances the rollout still proceeds
+		// within the unavailability budget.
+		placements, err := s.surgePlacements(ds, instances, replicas, want)
+		if err != nil {
+			log.Printf("[WARN] Rollout: no surge instance for '%s', updating in place: %v", deployment.Name, err)
+		}
+		for _, p := range placements {
+			log.Printf("[INFO] Rollout: starting surge instance '%s'", spec.InstanceName(deployment.Name, p.Index))
+			ids, err := s.deployInstance(deployment, ds, hash, nil, p, nodes)
+			taskIDs = append(taskIDs, ids...)
+			if err != nil {
+				return taskIDs, err
+			}
+		}
+	}
+
+	budget := available - (replicas - maxUnavailable)
+	for _, p := range outdated {
+		if budget <= 0 {
+			break
+		}
+		inst := byIndex[p.Index]
+		log.Printf("[INFO] Rollout: updating instance '%s'", inst.Name)
+		ids, err := s.deployInstance(deployment, ds, hash, inst, p, nodes)
+		taskIDs = append(taskIDs, ids...)
+		if err != nil {
+			return taskIDs, err
+		}
+		budget--
+	}
+	return taskIDs, nil
+}
+
+// surgePlacements places n surge instances on the first free indices at or
+// above the replica count.
+func (s *Service) surgePlacements(ds spec.DeploymentSpec, instances []db.ContainerInstance, replicas, n int) ([]scheduler.Placement, error) {
+	used := make(map[int]bool, len(instances))
+	for _, inst := range instances {
+		used[inst.InstanceIndex] = true
+	}
+	var indices []int
+	for i := replicas; len(indices) < n; i++ {
+		if !used[i] {
+			indices = append(indices, i)
+		}
+	}
+
+	scheduled, err := s.Scheduled(ds)
+	if err != nil {
+		return nil, err
+	}
+	if !scheduled {
+		placements := make([]scheduler.Placement, 0, n)
+		for _, i := range indices {
+			placements = append(placements, scheduler.Placement{Index: i})
+		}
+		return placements, nil
+	}
+	wide := ds
+	wide.Replicas = indices[len(indices)-1] + 1
+	all, err := s.scheduler.Place(wide, instances)
+	if err != nil {
+		return nil, err
+	}
+	placements := make([]scheduler.Placement, 0, n)
+	for _, i := range indices {
+		placements = append(placements, all[i])
+	}
+	return placements, nil
+}
+
+// finishRollout marks a rollout done once the deployment is ready.
+func (s *Service) finishRollout(deployment *db.Deployment) error {
+	var done string
+	switch deployment.RolloutStatus {
+	case RolloutProgressing:
+		done = RolloutComplete
+	case RolloutRollingBack:
+		done = RolloutRolledBack
+	default:
+		return nil
+	}
+	ready, err := Ready(s.db, deployment)
+	if err != nil || !ready {
+		return err
+	}
+	log.Printf("[INFO] Rollout of '%s' revision %d %s", deployment.Name, deployment.Revision, done)
+	deployment.RolloutStatus = done
+	return s.db.Model(deployment).Update("rollout_status", done).Error
+}
+
+// advanceRollouts moves rollouts on as soon as a heartbeat may have changed
+// instance health, instead of waiting for the next reconcile tick.
+func (s *Service) advanceRollouts() {
+	var deployments []db.Deployment
+	if err := s.db.Where("rollout_status IN ?", []string{RolloutProgressing, RolloutRollingBack}).Find(&deployments).Error; err != nil {
+		log.Printf("[ERROR] Rollout: loading deployments: %v", err)
+		return
+	}
+	if len(deployments) == 0 {
+		return
+	}
+	nodes, err := s.loadNodes()
+	if err != nil {
+		log.Printf("[ERROR] Rollout: loading nodes: %v", err)
+		return
+	}
+	for i := range deployments {
+		if _, err := s.reconcileDeployment(&deployments[i], nodes, false); err != nil {
+			log.Printf("[WARN] Rollout: deployment '%s': %v", deployments[i].Name, err)
+		}
+	}
+}
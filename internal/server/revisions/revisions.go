@@ -0,0 +1,125 @@
+package revisions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"gorm.io/gorm"
+)
+
+// redactedFields hold credentials and are only reported as changed in diffs.
+var redactedFields = map[string]bool{"registry": true}
+
+// Record stores specJSON as a new revision of a deployment unless it equals
+// the revision the deployment currently runs. It returns the revision for
+// specJSON and whether it was created by this call.
+func Record(gormDB *gorm.DB, deploymentID uint, current int, specJSON, author string) (*db.DeploymentRevision, bool, error) {
+	var cur db.DeploymentRevision
+	err := gormDB.Where("deployment_id = ? AND revision = ?", deploymentID, current).First(&cur).Error
+	switch {
+	case err == nil && cur.Spec == specJSON:
+		return &cur, false, nil
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, false, err
+	}
+
+	var latest int
+	if err := gormDB.Model(&db.DeploymentRevision{}).Where("deployment_id = ?", deploymentID).
+		Select("COALESCE(MAX(revision), 0)").Scan(&latest).Error; err != nil {
+		return nil, false, err
+	}
+	diff, err := Diff(cur.Spec, specJSON)
+	if err != nil {
+		return nil, false, err
+	}
+	rev := db.DeploymentRevision{
+		DeploymentID: deploymentID,
+		Revision:     latest + 1,
+		Spec:         specJSON,
+		Author:       author,
+		Diff:         diff,
+	}
+	if err := gormDB.Create(&rev).Error; err != nil {
+		return nil, false, err
+	}
+	return &rev, true, nil
+}
+
+// Previous returns the newest revision of a deployment older than revision.
+func Previous(gormDB *gorm.DB, deploymentID uint, revision int) (*db.DeploymentRevision, error) {
+	var rev db.DeploymentRevision
+	if err := gormDB.Where("deployment_id = ? AND revision < ?", deploymentID, revision).Order("revision DESC").First(&rev).Error; err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// List returns every revision of a deployment, newest first.
+func List(gormDB *gorm.DB, deploymentID uint) ([]db.DeploymentRevision, error) {
+	var revs []db.DeploymentRevision
+	err := gormDB.Where("deployment_id = ?", deploymentID).Order("revision DESC").Find(&revs).Error
+	return revs, err
+}
+
+// Diff describes how the top-level fields of two spec JSON documents differ,
+// one field per line: "+ field: new", "- field: old" or "~ field: old -> new".
+// An empty from is treated as an empty spec.
+func Diff(from, to string) (string, error) {
+	fromFields, err := fields(from)
+	if err != nil {
+		return "", err
+	}
+	toFields, err := fields(to)
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(fromFields)+len(toFields))
+	for k := range fromFields {
+		keys = append(keys, k)
+	}
+	for k := range toFields {
+		if _, ok := fromFields[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		old, hadOld := fromFields[k]
+		cur, hasCur := toFields[k]
+		if redactedFields[k] {
+			old, cur = "(redacted)", "(redacted)"
+		}
+		switch {
+		case !hadOld:
+			lines = append(lines, fmt.Sprintf("+ %s: %s", k, cur))
+		case !hasCur:
+			lines = append(lines, fmt.Sprintf("- %s: %s", k, old))
+		case fromFields[k] != toFields[k]:
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", k, old, cur))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// fields returns the compact JSON of every top-level field of a spec.
+func fields(specJSON string) (map[string]string, error) {
+	out := map[string]string{}
+	if specJSON == "" {
+		return out, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(specJSON), &raw); err != nil {
+		return nil, fmt.Errorf("decoding spec: %w", err)
+	}
+	for k, v := range raw {
+		out[k] = string(v)
+	}
+	return out, nil
+}
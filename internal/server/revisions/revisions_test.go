@@ -0,0 +1,20 @@
+package revisions
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	from := `{"name":"web","image":"web:v1","replicas":2,"registry":{"username":"u","password":"old"}}`
+	to := `{"name":"web","image":"web:v2","env":{"A":"1"},"registry":{"username":"u","password":"new"}}`
+
+	got, err := Diff(from, to)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := "+ env: {\"A\":\"1\"}\n" +
+		"~ image: \"web:v1\" -> \"web:v2\"\n" +
+		"~ registry: (redacted) -> (redacted)\n" +
+		"- replicas: 2"
+	if got != want {
+		t.Errorf("Expected diff\n%s\nbut got\n%s", want, got)
+	}
+}
@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// MatchesRequirement reports whether labels satisfy a selector requirement.
+// Gt and Lt never match labels that are missing or not integers.
+func MatchesRequirement(labels map[string]string, r spec.SelectorRequirement) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case spec.OpExists:
+		return ok
+	case spec.OpDoesNotExist:
+		return !ok
+	case spec.OpIn, spec.OpNotIn:
+		in := false
+		for _, v := range r.Values {
+			in = in || (ok && v == value)
+		}
+		return in == (r.Operator == spec.OpIn)
+	case spec.OpGt, spec.OpLt:
+		if !ok || len(r.Values) != 1 {
+			return false
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		bound, err := strconv.ParseInt(r.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		if r.Operator == spec.OpGt {
+			return n > bound
+		}
+		return n < bound
+	}
+	return false
+}
+
+// unmetRequirement returns the first required expression of the affinity
+// that labels do not satisfy.
+func unmetRequirement(labels map[string]string, a *spec.Affinity) (spec.SelectorRequirement, bool) {
+	if a == nil {
+		return spec.SelectorRequirement{}, false
+	}
+	for _, r := range a.Required {
+		if !MatchesRequirement(labels, r) {
+			return r, true
+		}
+	}
+	return spec.SelectorRequirement{}, false
+}
+
+// Score returns the sum of the weights of the preferences labels satisfy.
+func Score(labels map[string]string, a *spec.Affinity) int {
+	if a == nil {
+		return 0
+	}
+	score := 0
+	for _, p := range a.Preferred {
+		if MatchesRequirement(labels, p.SelectorRequirement) {
+			score += p.Weight
+		}
+	}
+	return score
+}
+
+// avoidDeployments drops the candidates running an instance of a deployment
+// the spec must not share a node with. If the spec avoids itself, every
+// remaining node takes at most one of its replicas.
+func (s *Scheduler) avoidDeployments(candidates []Candidate, ds spec.DeploymentSpec, reject rejectFunc) ([]Candidate, error) {
+	var names []string
+	self := false
+	for _, name := range ds.Affinity.AvoidDeployments {
+		if name == ds.Name {
+			self = true
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	occupied := map[uint]string{}
+	if len(names) > 0 {
+		var deployments []db.Deployment
+		if err := s.db.Where("name IN ?", names).Find(&deployments).Error; err != nil {
+			return nil, err
+		}
+		byID := make(map[uint]string, len(deployments))
+		ids := make([]uint, 0, len(deployments))
+		for _, d := range deployments {
+			byID[d.ID] = d.Name
+			ids = append(ids, d.ID)
+		}
+		var instances []db.ContainerInstance
+		if err := s.db.Where("deployment_id IN ? AND node_id <> 0", ids).Find(&instances).Error; err != nil {
+			return nil, err
+		}
+		for _, inst := range instances {
+			occupied[inst.NodeID] = byID[inst.DeploymentID]
+		}
+	}
+
+	kept := candidates[:0]
+	for _, c := range candidates {
+		if name, ok := occupied[c.NodeID]; ok {
+			reject(c.NodeID, fmt.Sprintf("runs an instance of '%s'", name))
+			continue
+		}
+		if self {
+			c.MaxReplicas = 1
+		}
+		kept = append(kept, c)
+	}
+	if len(kept) == 0 && len(candidates) > 0 {
+		return nil, fmt.Errorf("%w: every matching node runs an avoided deployment", ErrNoMatchingNode)
+	}
+	return kept, nil
+}
@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestMatchesRequirement(t *testing.T) {
+	labels := map[string]string{"zone": "a", "cores": "16", "ssd": "true"}
+	tests := []struct {
+		req  spec.SelectorRequirement
+		want bool
+	}{
+		{spec.SelectorRequirement{Key: "zone", Operator: spec.OpIn, Values: []string{"a", "b"}}, true},
+		{spec.SelectorRequirement{Key: "zone", Operator: spec.OpIn, Values: []string{"c"}}, false},
+		{spec.SelectorRequirement{Key: "zone", Operator: spec.OpNotIn, Values: []string{"c"}}, true},
+		{spec.SelectorRequirement{Key: "region", Operator: spec.OpNotIn, Values: []string{"eu"}}, true},
+		{spec.SelectorRequirement{Key: "ssd", Operator: spec.OpExists}, true},
+		{spec.SelectorRequirement{Key: "gpu", Operator: spec.OpExists}, false},
+		{spec.SelectorRequirement{Key: "gpu", Operator: spec.OpDoesNotExist}, true},
+		{spec.SelectorRequirement{Key: "cores", Operator: spec.OpGt, Values: []string{"8"}}, true},
+		{spec.SelectorRequirement{Key: "cores", Operator: spec.OpLt, Values: []string{"8"}}, false},
+		{spec.SelectorRequirement{Key: "zone", Operator: spec.OpGt, Values: []string{"0"}}, false},
+		{spec.SelectorRequirement{Key: "memory", Operator: spec.OpLt, Values: []string{"64"}}, false},
+	}
+	for _, tt := range tests {
+		if got := MatchesRequirement(labels, tt.req); got != tt.want {
+			t.Errorf("%s: Expected %v, but got %v", tt.req, tt.want, got)
+		}
+	}
+}
+
+func TestPlaceWithAffinity(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy", Labels: `{"zone":"a","cores":"4"}`}
+	b := db.Node{NodeID: "node-b", Status: "healthy", Labels: `{"zone":"b","cores":"32"}`}
+	c := db.Node{NodeID: "node-c", Status: "healthy", Labels: `{"zone":"c","cores":"32"}`}
+	d := db.Node{NodeID: "node-d", Status: "healthy", Labels: `{"zone":"b","cores":"16"}`}
+	for _, n := range []*db.Node{&a, &b, &c, &d} {
+		gormDB.Create(n)
+	}
+	other := spec.DeploymentSpec{Name: "db", Image: "postgres"}
+	specJSON, _ := json.Marshal(other)
+	dep := db.Deployment{Name: other.Name, Image: other.Image, Spec: string(specJSON)}
+	gormDB.Create(&dep)
+	gormDB.Create(&db.ContainerInstance{DeploymentID: dep.ID, Name: "db-0", NodeID: b.ID})
+
+	s := New(gormDB, DefaultPortRange)
+	ds := spec.DeploymentSpec{Name: "api", Image: "api", Affinity: &spec.Affinity{
+		Required:         []spec.SelectorRequirement{{Key: "zone", Operator: spec.OpNotIn, Values: []string{"c"}}},
+		Preferred:        []spec.Preference{{Weight: 10, SelectorRequirement: spec.SelectorRequirement{Key: "cores", Operator: spec.OpGt, Values: []string{"8"}}}},
+		AvoidDeployments: []string{"db"},
+	}}
+	placements, err := s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[0].NodeID != d.ID {
+		t.Errorf("Expected 'api' on node-d, the only preferred node without 'db', but got node %d", placements[0].NodeID)
+	}
+
+	explanation, err := s.Explain(ds, nil)
+	if err != nil {
+		t.Fatalf("Explain failed: %v", err)
+	}
+	if explanation.Err != nil {
+		t.Errorf("Expected the deployment to be placeable, but got %v", explanation.Err)
+	}
+	want := map[string]struct {
+		accepted bool
+		score    int
+		reason   string
+	}{
+		"node-a": {true, 0, ""},
+		"node-b": {false, 10, "runs an instance of 'db'"},
+		"node-c": {false, 10, "labels do not satisfy 'zone NotIn (c)'"},
+		"node-d": {true, 10, ""},
+	}
+	for _, v := range explanation.Nodes {
+		w := want[v.NodeKey]
+		reason := ""
+		if len(v.Reasons) > 0 {
+			reason = v.Reasons[0]
+		}
+		if v.Accepted != w.accepted || v.Score != w.score || reason != w.reason {
+			t.Errorf("%s: Expected accepted %v, score %d and reason %q, but got %v, %d and %q", v.NodeKey, w.accepted, w.score, w.reason, v.Accepted, v.Score, reason)
+		}
+	}
+
+	// Avoiding itself spreads the replicas one per node.
+	ds.Replicas = 3
+	ds.Affinity.AvoidDeployments = []string{"db", "api"}
+	if _, err := s.Place(ds, nil); err == nil {
+		t.Errorf("Expected an error placing 3 replicas one per node on 2 nodes")
+	}
+}
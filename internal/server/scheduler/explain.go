@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// Verdict tells whether a node can take replicas of a deployment, and if
+// not, why.
+type Verdict struct {
+	NodeID   uint
+	NodeKey  string
+	Status   string
+	Accepted bool
+	Score    int
+	Reasons  []string
+	Replicas []int // indices of the replicas placed on the node
+}
+
+// Explanation is the outcome of a dry-run placement.
+type Explanation struct {
+	Nodes      []Verdict
+	Placements []Placement
+	// Err is why the deployment cannot be placed, nil if it can.
+	Err error
+}
+
+// Explain places the deployment like Place without changing anything, and
+// reports for every node whether it was accepted and why not. The error is
+// only set when the nodes cannot be loaded.
+func (s *Scheduler) Explain(ds spec.DeploymentSpec, existing []db.ContainerInstance) (Explanation, error) {
+	var nodes []db.Node
+	if err := s.db.Order("node_id").Find(&nodes).Error; err != nil {
+		return Explanation{}, err
+	}
+	reasons := map[uint][]string{}
+	placements, err := s.place(ds, existing, func(nodeID uint, reason string) {
+		reasons[nodeID] = append(reasons[nodeID], reason)
+	})
+
+	replicas := map[uint][]int{}
+	for _, p := range placements {
+		replicas[p.NodeID] = append(replicas[p.NodeID], p.Index)
+	}
+	out := Explanation{Placements: placements, Err: err}
+	for _, n := range nodes {
+		v := Verdict{
+			NodeID:   n.ID,
+			NodeKey:  n.NodeID,
+			Status:   n.Status,
+			Accepted: len(reasons[n.ID]) == 0,
+			Score:    Score(ParseLabels(n.Labels), ds.Affinity),
+			Reasons:  reasons[n.ID],
+			Replicas: replicas[n.ID],
+		}
+		if v.Accepted && n.Status == "suspect" {
+			v.Reasons = []string{"node is suspect: it keeps its replicas but gets no new ones"}
+		}
+		out.Nodes = append(out.Nodes, v)
+	}
+	return out, nil
+}
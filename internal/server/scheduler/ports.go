@@ -0,0 +1,202 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// ErrNoFreePort is returned when a node has no free host port left in the range.
+var ErrNoFreePort = errors.New("no free host port in range")
+
+// PortRange is the inclusive range host ports are allocated from.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// DefaultPortRange stays below the usual Linux ephemeral port range.
+var DefaultPortRange = PortRange{Min: 20000, Max: 32000}
+
+// ParsePortRange parses a range such as "20000-32000".
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return PortRange{}, fmt.Errorf("port range must be <min>-<max>, got %q", s)
+	}
+	var r PortRange
+	var err error
+	if r.Min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if r.Max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+// contains reports whether port lies in the range.
+func (r PortRange) contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// String returns the range as "<min>-<max>".
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// InstancePorts decodes the host port bindings stored on an instance, nil
+// if it has none.
+func InstancePorts(inst *db.ContainerInstance) []spec.PortBinding {
+	if inst == nil || inst.Ports == "" {
+		return nil
+	}
+	var ports []spec.PortBinding
+	if err := json.Unmarshal([]byte(inst.Ports), &ports); err != nil {
+		return nil
+	}
+	return ports
+}
+
+// portClaim is the set of host ports an instance holds on its node.
+type portClaim struct {
+	deployment string
+	instance   string
+	ports      []spec.PortBinding
+}
+
+// claims returns the host ports held by every placed instance, by node.
+// Instances without stored bindings hold the fixed ports of their spec.
+func (s *Scheduler) claims() (map[uint][]portClaim, error) {
+	var deployments []db.Deployment
+	if err := s.db.Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	type fixed struct {
+		name  string
+		ports []spec.PortBinding
+	}
+	byID := make(map[uint]fixed, len(deployments))
+	for _, d := range deployments {
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(d.Spec), &ds); err != nil {
+			continue
+		}
+		byID[d.ID] = fixed{name: d.Name, ports: fixedPorts(ds.Ports)}
+	}
+
+	var instances []db.ContainerInstance
+	if err := s.db.Where("node_id <> 0").Find(&instances).Error; err != nil {
+		return nil, err
+	}
+	out := map[uint][]portClaim{}
+	for i := range instances {
+		inst := &instances[i]
+		d, ok := byID[inst.DeploymentID]
+		if !ok {
+			continue
+		}
+		ports := InstancePorts(inst)
+		if ports == nil {
+			ports = d.ports
+		}
+		out[inst.NodeID] = append(out[inst.NodeID], portClaim{deployment: d.name, instance: inst.Name, ports: ports})
+	}
+	return out, nil
+}
+
+// portTaken reports whether a binding conflicts with any of the claimed ports.
+func portTaken(p spec.PortBinding, claimed []spec.PortBinding) bool {
+	for _, c := range claimed {
+		if c.HostPort != 0 && p.Conflicts(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// portsTakenBy reports whether any of ports is held by another deployment
+// than the named one.
+func portsTakenBy(ports []spec.PortBinding, claims []portClaim, deployment string) bool {
+	for _, c := range claims {
+		if c.deployment == deployment {
+			continue
+		}
+		for _, p := range ports {
+			if portTaken(p, c.ports) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fixedPorts returns the bindings with a hand-picked host port.
+func fixedPorts(ports []spec.PortBinding) []spec.PortBinding {
+	var out []spec.PortBinding
+	for _, p := range ports {
+		if p.HostPort != 0 {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// AssignPorts returns the host port bindings of an instance of a deployment
+// placed on a node: ports with a zero host port get free ports of the range,
+// consecutive for port ranges, preferring the ones the instance held before
+// (previous) so that a redeployed instance keeps its address.
+func (s *Scheduler) AssignPorts(deployment, instance string, nodeID uint, ports, previous []spec.PortBinding) ([]spec.PortBinding, error) {
+	all, err := s.claims()
+	if err != nil {
+		return nil, err
+	}
+	var claimed []spec.PortBinding
+	for _, c := range all[nodeID] {
+		if c.deployment != deployment || c.instance != instance {
+			claimed = append(claimed, c.ports...)
+		}
+	}
+
+	out := make([]spec.PortBinding, len(ports))
+	copy(out, ports)
+	claimed = append(claimed, fixedPorts(out)...)
+	for i := range out {
+		if out[i].HostPort != 0 {
+			continue
+		}
+		p := out[i]
+		free := func(port int) bool {
+			candidate := p
+			candidate.HostPort = port
+			return s.ports.contains(port) && s.ports.contains(port+p.Size()-1) && !portTaken(candidate, claimed)
+		}
+		for _, prev := range previous {
+			if prev.ContainerPort == p.ContainerPort && prev.Size() == p.Size() && prev.Proto() == p.Proto() && prev.HostIP == p.HostIP {
+				if free(prev.HostPort) {
+					p.HostPort = prev.HostPort
+				}
+				break
+			}
+		}
+		for port := s.ports.Min; p.HostPort == 0 && port <= s.ports.Max; port++ {
+			if free(port) {
+				p.HostPort = port
+			}
+		}
+		if p.HostPort == 0 {
+			return nil, fmt.Errorf("container port %d: %w %s", p.ContainerPort, ErrNoFreePort, s.ports)
+		}
+		out[i] = p
+		claimed = append(claimed, p)
+	}
+	return out, nil
+}
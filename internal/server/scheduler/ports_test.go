@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestAssignPorts(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	node := db.Node{NodeID: "node-a", Status: "healthy"}
+	gormDB.Create(&node)
+	other := spec.DeploymentSpec{Name: "other", Image: "other", Ports: []spec.PortBinding{{HostPort: 20000, ContainerPort: 80}}}
+	specJSON, _ := json.Marshal(other)
+	d := db.Deployment{Name: other.Name, Image: other.Image, Spec: string(specJSON)}
+	gormDB.Create(&d)
+	// other-0 reported its ports, other-1 holds the fixed one of its spec.
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "other-0", NodeID: node.ID, Ports: `[{"host_port":20001,"container_port":80}]`})
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "other-1", InstanceIndex: 1, NodeID: node.ID})
+
+	s := New(gormDB, PortRange{Min: 20000, Max: 20003})
+	ports, err := s.AssignPorts("api", "api-0", node.ID, []spec.PortBinding{{ContainerPort: 80}, {HostPort: 20002, ContainerPort: 443}}, nil)
+	if err != nil {
+		t.Fatalf("AssignPorts failed: %v", err)
+	}
+	if ports[0].HostPort != 20003 || ports[1].HostPort != 20002 {
+		t.Errorf("Expected host ports 20003 and 20002, but got %v", ports)
+	}
+
+	previous := []spec.PortBinding{{HostPort: 20002, ContainerPort: 80}}
+	ports, err = s.AssignPorts("api", "api-0", node.ID, []spec.PortBinding{{ContainerPort: 80}}, previous)
+	if err != nil {
+		t.Fatalf("AssignPorts failed: %v", err)
+	}
+	if ports[0].HostPort != 20002 {
+		t.Errorf("Expected the previous host port 20002 to be kept, but got %d", ports[0].HostPort)
+	}
+
+	// UDP ports do not clash with the TCP ones held; ranges get consecutive ports.
+	ports, err = s.AssignPorts("game", "game-0", node.ID, []spec.PortBinding{{ContainerPort: 27015, ContainerPortEnd: 27016, Protocol: "udp"}}, nil)
+	if err != nil {
+		t.Fatalf("AssignPorts failed: %v", err)
+	}
+	if ports[0].HostPort != 20000 {
+		t.Errorf("Expected udp host ports from 20000, but got %d", ports[0].HostPort)
+	}
+
+	if _, err := s.AssignPorts("api", "api-0", node.ID, []spec.PortBinding{{ContainerPort: 80}, {ContainerPort: 81}, {ContainerPort: 82}}, nil); !errors.Is(err, ErrNoFreePort) {
+		t.Errorf("Expected ErrNoFreePort, but got %v", err)
+	}
+}
+
+func TestPlaceAvoidsHostPortConflicts(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy"}
+	b := db.Node{NodeID: "node-b", Status: "healthy"}
+	gormDB.Create(&a)
+	gormDB.Create(&b)
+	other := spec.DeploymentSpec{Name: "other", Image: "other", Ports: []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}}}
+	specJSON, _ := json.Marshal(other)
+	d := db.Deployment{Name: other.Name, Image: other.Image, Spec: string(specJSON)}
+	gormDB.Create(&d)
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "other-0", NodeID: a.ID})
+
+	s := New(gormDB, DefaultPortRange)
+	ds := spec.DeploymentSpec{Name: "api", Image: "api", NodeSelector: map[string]string{}, Ports: []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}}}
+	placements, err := s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[0].NodeID != b.ID {
+		t.Errorf("Expected 'api' on node-b, where 8080 is free, but got node %d", placements[0].NodeID)
+	}
+
+	ds.Replicas = 2
+	if _, err := s.Place(ds, nil); !errors.Is(err, ErrNoMatchingNode) {
+		t.Errorf("Expected ErrNoMatchingNode for a second replica binding 8080, but got %v", err)
+	}
+}
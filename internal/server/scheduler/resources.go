@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// Capacity is an amount of CPU, in cores, and memory, in MB.
+type Capacity struct {
+	CPU      float64
+	MemoryMB int64
+}
+
+// nodeCapacity returns the allocatable capacity a node reported, nil if it
+// has not reported any.
+func nodeCapacity(n db.Node) *Capacity {
+	if n.CPU == 0 && n.MemoryMB == 0 {
+		return nil
+	}
+	return &Capacity{CPU: n.AllocatableCPU, MemoryMB: n.AllocatableMemoryMB}
+}
+
+// reserved returns the resources reserved by the placed instances of every
+// deployment but the named one, by node.
+func (s *Scheduler) reserved(deployment string) (map[uint]Capacity, error) {
+	var deployments []db.Deployment
+	if err := s.db.Where("name <> ?", deployment).Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	perInstance := make(map[uint]Capacity, len(deployments))
+	for _, d := range deployments {
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(d.Spec), &ds); err != nil || !ds.Resources.Reserves() {
+			continue
+		}
+		perInstance[d.ID] = Capacity{CPU: ds.Resources.ReservedCPU(), MemoryMB: ds.Resources.ReservedMemoryMB()}
+	}
+
+	var instances []db.ContainerInstance
+	if err := s.db.Where("node_id <> 0").Find(&instances).Error; err != nil {
+		return nil, err
+	}
+	out := map[uint]Capacity{}
+	for _, inst := range instances {
+		r, ok := perInstance[inst.DeploymentID]
+		if !ok {
+			continue
+		}
+		used := out[inst.NodeID]
+		used.CPU += r.CPU
+		used.MemoryMB += r.MemoryMB
+		out[inst.NodeID] = used
+	}
+	return out, nil
+}
+
+// fitResources drops the candidates without room for one replica of the
+// deployment and caps the others at the replicas that fit. The rest are
+// ordered by free memory, then free CPU, most first, so that replicas are
+// spread by free capacity. Nodes that never reported their capacity fit any
+// number of replicas and come last.
+func (s *Scheduler) fitResources(candidates []Candidate, ds spec.DeploymentSpec, reject rejectFunc) ([]Candidate, error) {
+	used, err := s.reserved(ds.Name)
+	if err != nil {
+		return nil, err
+	}
+	cpu, memory := ds.Resources.ReservedCPU(), ds.Resources.ReservedMemoryMB()
+
+	free := map[uint]Capacity{}
+	fits := candidates[:0]
+	var noCPU, noMemory int
+	for _, c := range candidates {
+		if c.Allocatable == nil {
+			fits = append(fits, c)
+			continue
+		}
+		left := Capacity{CPU: c.Allocatable.CPU - used[c.NodeID].CPU, MemoryMB: c.Allocatable.MemoryMB - used[c.NodeID].MemoryMB}
+		n := math.MaxInt
+		if cpu > 0 {
+			// Round away float noise, e.g. 0.3 cores of 0.1 each.
+			n = min(n, int(math.Floor(left.CPU/cpu+1e-9)))
+		}
+		if memory > 0 {
+			n = min(n, int(left.MemoryMB/memory))
+		}
+		if n <= 0 {
+			reject(c.NodeID, fmt.Sprintf("needs %g cores and %d MB, has %g cores and %d MB free", cpu, memory, left.CPU, left.MemoryMB))
+			if cpu > 0 && left.CPU+1e-9 < cpu {
+				noCPU++
+			}
+			if memory > 0 && left.MemoryMB < memory {
+				noMemory++
+			}
+			continue
+		}
+		if c.MaxReplicas == 0 || n < c.MaxReplicas {
+			c.MaxReplicas = n
+		}
+		free[c.NodeID] = left
+		fits = append(fits, c)
+	}
+	if total := len(candidates); len(fits) == 0 && total > 0 {
+		switch {
+		case noMemory == total:
+			return nil, fmt.Errorf("%w: insufficient memory on all matching nodes", ErrNoMatchingNode)
+		case noCPU == total:
+			return nil, fmt.Errorf("%w: insufficient cpu on all matching nodes", ErrNoMatchingNode)
+		default:
+			return nil, fmt.Errorf("%w: insufficient cpu or memory on all matching nodes", ErrNoMatchingNode)
+		}
+	}
+
+	sort.SliceStable(fits, func(i, j int) bool {
+		a, aok := free[fits[i].NodeID]
+		b, bok := free[fits[j].NodeID]
+		if aok != bok {
+			return aok
+		}
+		if a.MemoryMB != b.MemoryMB {
+			return a.MemoryMB > b.MemoryMB
+		}
+		return a.CPU > b.CPU
+	})
+	return fits, nil
+}
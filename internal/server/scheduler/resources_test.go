@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestPlaceByFreeCapacity(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy", CPU: 4, MemoryMB: 2304, AllocatableCPU: 4, AllocatableMemoryMB: 2048}
+	b := db.Node{NodeID: "node-b", Status: "healthy", CPU: 2, MemoryMB: 4352, AllocatableCPU: 2, AllocatableMemoryMB: 4096}
+	gormDB.Create(&a)
+	gormDB.Create(&b)
+	// "cache" reserves 1.5 GB of node-b, leaving it 2.5 GB to node-a's 2 GB.
+	cache := spec.DeploymentSpec{Name: "cache", Image: "redis", Resources: &spec.Resources{MemoryMB: 1536}}
+	specJSON, _ := json.Marshal(cache)
+	d := db.Deployment{Name: cache.Name, Image: cache.Image, Spec: string(specJSON)}
+	gormDB.Create(&d)
+	gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: "cache-0", NodeID: b.ID})
+
+	s := New(gormDB, DefaultPortRange)
+	ds := spec.DeploymentSpec{Name: "api", Image: "api", Replicas: 3, Resources: &spec.Resources{CPU: 0.5, MemoryMB: 1024}}
+	placements, err := s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[0].NodeID != b.ID {
+		t.Errorf("Expected replica 0 on node-b, which has the most free memory, but got node %d", placements[0].NodeID)
+	}
+	perNode := map[uint]int{}
+	for _, p := range placements {
+		perNode[p.NodeID]++
+	}
+	if perNode[a.ID] != 1 || perNode[b.ID] != 2 {
+		t.Errorf("Expected 1 replica on node-a and 2 on node-b, but got %v", perNode)
+	}
+
+	ds.Replicas = 5
+	if _, err := s.Place(ds, nil); !errors.Is(err, ErrNoMatchingNode) {
+		t.Errorf("Expected ErrNoMatchingNode for 5 replicas where 4 fit, but got %v", err)
+	}
+
+	ds.Replicas = 1
+	ds.Resources = &spec.Resources{MemoryMB: 3072}
+	if _, err := s.Place(ds, nil); err == nil || !strings.Contains(err.Error(), "insufficient memory on all matching nodes") {
+		t.Errorf("Expected an insufficient memory error, but got %v", err)
+	}
+
+	ds.Resources = &spec.Resources{CPU: 2.5, MemoryMB: 512}
+	placements, err = s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[0].NodeID != a.ID {
+		t.Errorf("Expected the 2.5 core replica on node-a, but got node %d", placements[0].NodeID)
+	}
+}
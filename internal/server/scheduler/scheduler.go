@@ -0,0 +1,301 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// ErrNoMatchingNode is returned when no healthy node satisfies a deployment's selector.
+var ErrNoMatchingNode = errors.New("no healthy node matches selector")
+
+// Candidate is a live node that a deployment may be placed on.
+type Candidate struct {
+	NodeID  uint   // db.Node primary key
+	NodeKey string // agent node id, used for NATS subjects
+	Labels  map[string]string
+	// Suspect nodes have missed heartbeats: they keep the replicas they
+	// already run but receive no new ones.
+	Suspect bool
+	// Cordoned nodes, and nodes with a NoSchedule taint the deployment does
+	// not tolerate, likewise keep their replicas but receive no new ones.
+	Cordoned bool
+	// MaxReplicas caps the replicas of the deployment on the node, e.g. one
+	// when it binds a fixed host port. Zero means no limit.
+	MaxReplicas int
+	// Allocatable is the capacity the node offers containers, nil if its
+	// agent has not reported it.
+	Allocatable *Capacity
+	// Score is the weight of the preferred affinity the node matches.
+	Score int
+}
+
+// Placement assigns one replica of a deployment to a node.
+type Placement struct {
+	Index   int
+	NodeID  uint
+	NodeKey string
+}
+
+// Scheduler places deployment instances on healthy nodes and allocates
+// their host ports.
+type Scheduler struct {
+	db    *gorm.DB
+	ports PortRange
+}
+
+// New creates a new scheduler backed by the node table, allocating host
+// ports from the given range.
+func New(db *gorm.DB, ports PortRange) *Scheduler {
+	return &Scheduler{db: db, ports: ports}
+}
+
+// rejectFunc records why a node cannot take replicas of a deployment.
+type rejectFunc func(nodeID uint, reason string)
+
+// Candidates returns healthy and suspect nodes matching the selector, most
+// recent heartbeat first. Down nodes are never candidates.
+func (s *Scheduler) Candidates(selector map[string]string) ([]Candidate, error) {
+	return s.candidates(spec.DeploymentSpec{NodeSelector: selector}, func(uint, string) {})
+}
+
+// candidates returns the healthy and suspect nodes matching the node
+// selector and required affinity of the spec, most recent heartbeat first,
+// scored by its preferred affinity. Draining nodes and nodes with a NoExecute
+// taint the spec does not tolerate are never candidates.
+func (s *Scheduler) candidates(ds spec.DeploymentSpec, reject rejectFunc) ([]Candidate, error) {
+	var nodes []db.Node
+	if err := s.db.Order("last_heartbeat desc").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	candidates := []Candidate{}
+	for _, n := range nodes {
+		if n.Status != "healthy" && n.Status != "suspect" {
+			reject(n.ID, fmt.Sprintf("node is %s", n.Status))
+			continue
+		}
+		if n.Draining {
+			reject(n.ID, "node is draining")
+			continue
+		}
+		taint, tainted := untolerated(ParseTaints(n.Taints), ds.Tolerations)
+		if tainted && taint.Effect == spec.TaintNoExecute {
+			reject(n.ID, fmt.Sprintf("has taint '%s' it does not tolerate", taint))
+			continue
+		}
+		labels := ParseLabels(n.Labels)
+		if !MatchesSelector(labels, ds.NodeSelector) {
+			reject(n.ID, "labels do not match node_selector")
+			continue
+		}
+		if r, unmet := unmetRequirement(labels, ds.Affinity); unmet {
+			reject(n.ID, fmt.Sprintf("labels do not satisfy '%s'", r))
+			continue
+		}
+		if n.Cordoned {
+			reject(n.ID, "node is cordoned")
+		} else if tainted {
+			reject(n.ID, fmt.Sprintf("has taint '%s' it does not tolerate", taint))
+		}
+		candidates = append(candidates, Candidate{
+			NodeID:      n.ID,
+			NodeKey:     n.NodeID,
+			Labels:      labels,
+			Suspect:     n.Status == "suspect",
+			Cordoned:    n.Cordoned || tainted,
+			Allocatable: nodeCapacity(n),
+			Score:       Score(labels, ds.Affinity),
+		})
+	}
+	return candidates, nil
+}
+
+// Place assigns every replica of the deployment to a node. Replicas that
+// already run on a node that is still a candidate keep their placement.
+// Nodes where another deployment holds one of its fixed host ports are
+// skipped, and each node gets at most one replica binding them. Nodes
+// running a deployment it avoids are skipped too. Replicas that reserve
+// resources only go where they fit, most free capacity first. Replicas with
+// named volumes stay on the node holding them.
+func (s *Scheduler) Place(ds spec.DeploymentSpec, existing []db.ContainerInstance) ([]Placement, error) {
+	return s.place(ds, existing, func(uint, string) {})
+}
+
+func (s *Scheduler) place(ds spec.DeploymentSpec, existing []db.ContainerInstance, reject rejectFunc) ([]Placement, error) {
+	candidates, err := s.candidates(ds, reject)
+	if err != nil {
+		return nil, err
+	}
+	if fixed := fixedPorts(ds.Ports); len(fixed) > 0 {
+		claims, err := s.claims()
+		if err != nil {
+			return nil, err
+		}
+		free := candidates[:0]
+		for _, c := range candidates {
+			if portsTakenBy(fixed, claims[c.NodeID], ds.Name) {
+				reject(c.NodeID, "another deployment holds one of its host ports")
+				continue
+			}
+			c.MaxReplicas = 1
+			free = append(free, c)
+		}
+		if len(free) == 0 && len(candidates) > 0 {
+			return nil, fmt.Errorf("%w: host ports are taken on every matching node", ErrNoMatchingNode)
+		}
+		candidates = free
+	}
+	if ds.Affinity != nil && len(ds.Affinity.AvoidDeployments) > 0 {
+		if candidates, err = s.avoidDeployments(candidates, ds, reject); err != nil {
+			return nil, err
+		}
+	}
+	reserves := ds.Resources.Reserves()
+	if reserves {
+		if candidates, err = s.fitResources(candidates, ds, reject); err != nil {
+			return nil, err
+		}
+	}
+	current := make(map[int]uint, len(existing))
+	for _, inst := range existing {
+		if inst.NodeID != 0 {
+			current[inst.InstanceIndex] = inst.NodeID
+		}
+	}
+
+	pins, err := s.volumePins(ds)
+	if err != nil {
+		return nil, err
+	}
+	for _, pin := range pins {
+		found := false
+		for _, c := range candidates {
+			found = found || c.NodeID == pin.nodeID
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: volume '%s' is held by a node that is down, does not match or is full", ErrNoMatchingNode, pin.volume)
+		}
+	}
+	placements, err := spread(candidates, ds.ReplicaCount(), ds.SpreadBy, current, pins)
+	if err == ErrNoMatchingNode && reserves && len(candidates) > 0 {
+		return nil, fmt.Errorf("%w: not enough free cpu or memory for %d replicas", ErrNoMatchingNode, ds.ReplicaCount())
+	}
+	return placements, err
+}
+
+// Spread places replicas across candidates so that every spread group (the
+// value of the spreadBy label, or each node when spreadBy is empty) receives
+// as even a share as possible, and the highest scoring node wins between
+// nodes that are otherwise tied. current maps replica index to the node it
+// already runs on; those placements are kept if the node is still a candidate
+// with room for them. New replicas only go to candidates that are neither
+// suspect nor cordoned.
+func Spread(candidates []Candidate, replicas int, spreadBy string, current map[int]uint) ([]Placement, error) {
+	return spread(candidates, replicas, spreadBy, current, nil)
+}
+
+// spread is Spread with replicas pinned to the node holding their volume.
+// Pinned replicas are placed first and never moved: if their node has no
+// room for them, spread fails rather than start them on an empty volume.
+func spread(candidates []Candidate, replicas int, spreadBy string, current map[int]uint, pins map[int]volumePin) ([]Placement, error) {
+	byID := make(map[uint]Candidate, len(candidates))
+	healthy := []Candidate{}
+	for _, c := range candidates {
+		byID[c.NodeID] = c
+		if !c.Suspect && !c.Cordoned {
+			healthy = append(healthy, c)
+		}
+	}
+	group := func(c Candidate) string {
+		if spreadBy == "" {
+			return c.NodeKey
+		}
+		return c.Labels[spreadBy]
+	}
+
+	placements := make([]Placement, replicas)
+	assigned := make([]bool, replicas)
+	nodeCount := map[uint]int{}
+	groupCount := map[string]int{}
+
+	for i := 0; i < replicas; i++ {
+		pin, ok := pins[i]
+		if !ok {
+			continue
+		}
+		c, ok := byID[pin.nodeID]
+		if !ok || (c.MaxReplicas > 0 && nodeCount[c.NodeID] >= c.MaxReplicas) {
+			return nil, fmt.Errorf("%w: volume '%s' pins replica %d to a node without room for it", ErrNoMatchingNode, pin.volume, i)
+		}
+		placements[i] = Placement{Index: i, NodeID: c.NodeID, NodeKey: c.NodeKey}
+		assigned[i] = true
+		nodeCount[c.NodeID]++
+		groupCount[group(c)]++
+	}
+
+	for i := 0; i < replicas; i++ {
+		if assigned[i] {
+			continue
+		}
+		c, ok := byID[current[i]]
+		if !ok || (c.MaxReplicas > 0 && nodeCount[c.NodeID] >= c.MaxReplicas) {
+			continue
+		}
+		placements[i] = Placement{Index: i, NodeID: c.NodeID, NodeKey: c.NodeKey}
+		assigned[i] = true
+		nodeCount[c.NodeID]++
+		groupCount[group(c)]++
+	}
+
+	for i := 0; i < replicas; i++ {
+		if assigned[i] {
+			continue
+		}
+		var best Candidate
+		found := false
+		for _, c := range healthy {
+			if c.MaxReplicas > 0 && nodeCount[c.NodeID] >= c.MaxReplicas {
+				continue
+			}
+			gc, bgc := groupCount[group(c)], groupCount[group(best)]
+			nc, bnc := nodeCount[c.NodeID], nodeCount[best.NodeID]
+			if !found || gc < bgc || (gc == bgc && (nc < bnc || (nc == bnc && c.Score > best.Score))) {
+				best, found = c, true
+			}
+		}
+		if !found {
+			return nil, ErrNoMatchingNode
+		}
+		placements[i] = Placement{Index: i, NodeID: best.NodeID, NodeKey: best.NodeKey}
+		nodeCount[best.NodeID]++
+		groupCount[group(best)]++
+	}
+	return placements, nil
+}
+
+// ParseLabels decodes a node's JSON label blob. It returns nil if the blob is malformed.
+func ParseLabels(labelsJSON string) map[string]string {
+	labels := map[string]string{}
+	if strings.TrimSpace(labelsJSON) == "" {
+		return labels
+	}
+	if err := json.Unmarshal([]byte(labelsJSON), &labels); err != nil {
+		return nil
+	}
+	return labels
+}
+
+// MatchesSelector reports whether labels contain every key/value pair of the selector.
+func MatchesSelector(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestSpreadAcrossNodes(t *testing.T) {
+	candidates := []Candidate{
+		{NodeID: 1, NodeKey: "a"},
+		{NodeID: 2, NodeKey: "b"},
+		{NodeID: 3, NodeKey: "c"},
+	}
+
+	placements, err := Spread(candidates, 4, "", nil)
+	if err != nil {
+		t.Fatalf("Spread failed: %v", err)
+	}
+
+	perNode := map[uint]int{}
+	for i, p := range placements {
+		if p.Index != i {
+			t.Errorf("Expected placement %d to have index %d, but got %d", i, i, p.Index)
+		}
+		perNode[p.NodeID]++
+	}
+	for _, c := range candidates {
+		if n := perNode[c.NodeID]; n < 1 || n > 2 {
+			t.Errorf("Expected node %s to get 1 or 2 replicas, but got %d", c.NodeKey, n)
+		}
+	}
+}
+
+func TestSpreadByLabel(t *testing.T) {
+	candidates := []Candidate{
+		{NodeID: 1, NodeKey: "a", Labels: map[string]string{"zone": "z1"}},
+		{NodeID: 2, NodeKey: "b", Labels: map[string]string{"zone": "z1"}},
+		{NodeID: 3, NodeKey: "c", Labels: map[string]string{"zone": "z2"}},
+	}
+
+	placements, err := Spread(candidates, 2, "zone", nil)
+	if err != nil {
+		t.Fatalf("Spread failed: %v", err)
+	}
+	zone := func(p Placement) string { return candidates[p.NodeID-1].Labels["zone"] }
+	if zone(placements[0]) == zone(placements[1]) {
+		t.Errorf("Expected one replica in each zone, but got nodes %d and %d", placements[0].NodeID, placements[1].NodeID)
+	}
+}
+
+func TestSpreadKeepsCurrentPlacement(t *testing.T) {
+	candidates := []Candidate{
+		{NodeID: 1, NodeKey: "a"},
+		{NodeID: 2, NodeKey: "b"},
+	}
+
+	placements, err := Spread(candidates, 2, "", map[int]uint{0: 2, 1: 9})
+	if err != nil {
+		t.Fatalf("Spread failed: %v", err)
+	}
+	if placements[0].NodeID != 2 {
+		t.Errorf("Expected replica 0 to stay on node 2, but got %d", placements[0].NodeID)
+	}
+	if placements[1].NodeID != 1 {
+		t.Errorf("Expected replica 1 to move to node 1, but got %d", placements[1].NodeID)
+	}
+}
+
+func TestSpreadNoCandidates(t *testing.T) {
+	if _, err := Spread(nil, 1, "", nil); err != ErrNoMatchingNode {
+		t.Errorf("Expected ErrNoMatchingNode, but got %v", err)
+	}
+}
+
+func TestSpreadSkipsSuspectNodesForNewReplicas(t *testing.T) {
+	candidates := []Candidate{
+		{NodeID: 1, NodeKey: "a", Suspect: true},
+		{NodeID: 2, NodeKey: "b"},
+	}
+
+	placements, err := Spread(candidates, 2, "", map[int]uint{0: 1})
+	if err != nil {
+		t.Fatalf("Spread failed: %v", err)
+	}
+	if placements[0].NodeID != 1 {
+		t.Errorf("Expected replica 0 to stay on suspect node 1, but got %d", placements[0].NodeID)
+	}
+	if placements[1].NodeID != 2 {
+		t.Errorf("Expected replica 1 to be placed on healthy node 2, but got %d", placements[1].NodeID)
+	}
+
+	if _, err := Spread(candidates[:1], 1, "", nil); err != ErrNoMatchingNode {
+		t.Errorf("Expected ErrNoMatchingNode with only suspect nodes, but got %v", err)
+	}
+}
+
+func TestPlacePinsReplicasToTheirVolumes(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy"}
+	b := db.Node{NodeID: "node-b", Status: "healthy"}
+	gormDB.Create(&a)
+	gormDB.Create(&b)
+
+	ds := spec.DeploymentSpec{Name: "db", Image: "postgres", Replicas: 2, Volumes: []spec.VolumeMount{{Source: "pgdata", Target: "/var/lib/postgresql/data"}}}
+	// Replica 1 wrote to "pgdata-1" on node-a; replica 0 has no data yet.
+	if err := RecordVolumes(gormDB, 1, ds, 1, a.ID); err != nil {
+		t.Fatalf("RecordVolumes failed: %v", err)
+	}
+
+	s := New(gormDB, DefaultPortRange)
+	placements, err := s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[1].NodeID != a.ID || placements[0].NodeID != b.ID {
+		t.Errorf("Expected replica 1 pinned to node-a and replica 0 on node-b, but got %v", placements)
+	}
+
+	// A fixed host port allows one replica per node. Replica 1 keeps its
+	// volume's node even though replica 0 ran there first.
+	ds.Ports = []spec.PortBinding{{HostPort: 5432, ContainerPort: 5432}}
+	placements, err = s.Place(ds, []db.ContainerInstance{{InstanceIndex: 0, NodeID: a.ID}})
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	if placements[1].NodeID != a.ID || placements[0].NodeID != b.ID {
+		t.Errorf("Expected replica 1 to keep node-a and replica 0 to move, but got %v", placements)
+	}
+
+	// With both replicas pinned to node-a, one of them has no room there and
+	// must not be moved to an empty volume elsewhere.
+	if err := RecordVolumes(gormDB, 1, ds, 0, a.ID); err != nil {
+		t.Fatalf("RecordVolumes failed: %v", err)
+	}
+	if _, err := s.Place(ds, nil); !errors.Is(err, ErrNoMatchingNode) {
+		t.Errorf("Expected ErrNoMatchingNode for two replicas pinned to one node, but got %v", err)
+	}
+
+	gormDB.Model(&a).Update("status", "down")
+	if _, err := s.Place(ds, nil); err == nil {
+		t.Errorf("Expected an error while the node holding 'pgdata-1' is down")
+	}
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+// ParseTaints decodes a node's JSON taint blob. It returns nil if the blob
+// is empty or malformed.
+func ParseTaints(taintsJSON string) []spec.Taint {
+	if strings.TrimSpace(taintsJSON) == "" {
+		return nil
+	}
+	var taints []spec.Taint
+	if err := json.Unmarshal([]byte(taintsJSON), &taints); err != nil {
+		return nil
+	}
+	return taints
+}
+
+// untolerated returns a taint none of the tolerations match, preferring
+// NoExecute taints, and whether there is one.
+func untolerated(taints []spec.Taint, tolerations []spec.Toleration) (spec.Taint, bool) {
+	var found spec.Taint
+	ok := false
+	for _, t := range taints {
+		tolerated := false
+		for _, tol := range tolerations {
+			tolerated = tolerated || tol.Tolerates(t)
+		}
+		if tolerated {
+			continue
+		}
+		if !ok || t.Effect == spec.TaintNoExecute {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// Restricted reports whether a live node is cordoned, draining or tainted.
+// Broadcast deployments are then placed too, since any agent could claim them.
+func (s *Scheduler) Restricted() (bool, error) {
+	var count int64
+	err := s.db.Model(&db.Node{}).
+		Where("status <> ? AND (cordoned = ? OR draining = ? OR taints <> '')", "down", true, true).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestPlaceRespectsTaintsAndCordon(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy", Cordoned: true}
+	b := db.Node{NodeID: "node-b", Status: "healthy", Taints: `[{"key":"dedicated","value":"gpu","effect":"NoSchedule"}]`}
+	c := db.Node{NodeID: "node-c", Status: "healthy", Taints: `[{"key":"maintenance","effect":"NoExecute"}]`}
+	d := db.Node{NodeID: "node-d", Status: "healthy"}
+	for _, n := range []*db.Node{&a, &b, &c, &d} {
+		gormDB.Create(n)
+	}
+	s := New(gormDB, DefaultPortRange)
+
+	// Replicas stay on the cordoned and NoSchedule nodes, leave the NoExecute
+	// node, and new ones only go to the untainted node.
+	ds := spec.DeploymentSpec{Name: "web", Image: "nginx", Replicas: 4}
+	existing := []db.ContainerInstance{
+		{InstanceIndex: 0, NodeID: a.ID},
+		{InstanceIndex: 1, NodeID: b.ID},
+		{InstanceIndex: 2, NodeID: c.ID},
+	}
+	placements, err := s.Place(ds, existing)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	want := []uint{a.ID, b.ID, d.ID, d.ID}
+	for i, p := range placements {
+		if p.NodeID != want[i] {
+			t.Errorf("Replica %d: Expected node %d, but got %d", i, want[i], p.NodeID)
+		}
+	}
+
+	// Tolerating both taints opens nodes b and c to new replicas.
+	ds.Replicas = 3
+	ds.Tolerations = []spec.Toleration{
+		{Key: "dedicated", Value: "gpu", Effect: spec.TaintNoSchedule},
+		{Key: "maintenance", Operator: spec.OpExists},
+	}
+	placements, err = s.Place(ds, nil)
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	seen := map[uint]bool{}
+	for _, p := range placements {
+		seen[p.NodeID] = true
+	}
+	if seen[a.ID] || !seen[b.ID] || !seen[c.ID] || !seen[d.ID] {
+		t.Errorf("Expected one replica on each of nodes b, c and d, but got %v", placements)
+	}
+
+	// A draining node loses its replicas.
+	gormDB.Model(&d).Update("draining", true)
+	placements, err = s.Place(ds, []db.ContainerInstance{{InstanceIndex: 0, NodeID: d.ID}})
+	if err != nil {
+		t.Fatalf("Place failed: %v", err)
+	}
+	for _, p := range placements {
+		if p.NodeID == d.ID || p.NodeID == a.ID {
+			t.Errorf("Expected no replica on the draining or cordoned node, but got %v", placements)
+		}
+	}
+
+	restricted, err := s.Restricted()
+	if err != nil || !restricted {
+		t.Errorf("Expected the cluster to be restricted, but got %v (%v)", restricted, err)
+	}
+}
@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// volumePin ties a replica to the node holding one of its named volumes.
+type volumePin struct {
+	volume string
+	nodeID uint
+}
+
+// volumeNames returns the Docker volume names a replica mounts.
+func volumeNames(ds spec.DeploymentSpec, index int) []string {
+	var names []string
+	for _, v := range ds.Volumes {
+		if v.Kind() == spec.VolumeNamed {
+			names = append(names, spec.VolumeName(v.Source, index))
+		}
+	}
+	return names
+}
+
+// volumePins returns, by replica index, the node each replica of a stateful
+// deployment is pinned to by a volume it already has data in.
+func (s *Scheduler) volumePins(ds spec.DeploymentSpec) (map[int]volumePin, error) {
+	pins := map[int]volumePin{}
+	if !ds.Stateful() {
+		return pins, nil
+	}
+	for i := 0; i < ds.ReplicaCount(); i++ {
+		names := volumeNames(ds, i)
+		var volumes []db.Volume
+		if err := s.db.Where("name IN ?", names).Find(&volumes).Error; err != nil {
+			return nil, err
+		}
+		for _, v := range volumes {
+			if pin, ok := pins[i]; ok && pin.nodeID != v.NodeID {
+				return nil, fmt.Errorf("replica %d mounts volumes '%s' and '%s' held by different nodes", i, pin.volume, v.Name)
+			}
+			pins[i] = volumePin{volume: v.Name, nodeID: v.NodeID}
+		}
+	}
+	return pins, nil
+}
+
+// RecordVolumes records the node holding the named volumes of a replica
+// that was deployed there. Volumes already recorded keep their node.
+func RecordVolumes(gormDB *gorm.DB, deploymentID uint, ds spec.DeploymentSpec, index int, nodeID uint) error {
+	for _, name := range volumeNames(ds, index) {
+		v := db.Volume{Name: name, NodeID: nodeID, DeploymentID: deploymentID}
+		if err := gormDB.Clauses(clause.OnConflict{DoNothing: true}).Create(&v).Error; err != nil {
+			return fmt.Errorf("recording volume '%s': %w", name, err)
+		}
+	}
+	return nil
+}
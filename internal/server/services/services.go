@@ -0,0 +1,86 @@
+package services
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/server/scheduler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// Instance is a ready instance of a deployment, reachable over the mesh.
+type Instance struct {
+	Name    string             // container name, unique per deployment replica
+	Node    string             // agent node id
+	Address string             // mesh IP of the instance's node
+	Ports   []spec.PortBinding // ports the instance publishes on the node, as allocated
+}
+
+// Instances returns the ready instances of every deployment, keyed by
+// deployment name and ordered by instance index. Instances on nodes that are
+// down or have no mesh IP are left out.
+func Instances(gormDB *gorm.DB) (map[string][]Instance, error) {
+	var deployments []db.Deployment
+	if err := gormDB.Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	var nodes []db.Node
+	if err := gormDB.Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]db.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+
+	out := map[string][]Instance{}
+	for _, d := range deployments {
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(d.Spec), &ds); err != nil {
+			continue
+		}
+		var instances []db.ContainerInstance
+		if err := gormDB.Where("deployment_id = ?", d.ID).Order("instance_index").Find(&instances).Error; err != nil {
+			return nil, err
+		}
+		for _, inst := range instances {
+			node, ok := byID[inst.NodeID]
+			if !ok || node.MeshIP == "" || node.Status == "down" || !reconciler.InstanceReady(inst.Status, ds) {
+				continue
+			}
+			ports := scheduler.InstancePorts(&inst)
+			if ports == nil {
+				ports = ds.Ports
+			}
+			out[d.Name] = append(out[d.Name], Instance{Name: inst.Name, Node: node.NodeID, Address: node.MeshIP, Ports: ports})
+		}
+	}
+	return out, nil
+}
+
+// Endpoints returns the mesh endpoints of every deployment's ready instances,
+// keyed by deployment name. A deployment is reachable on the first host port
+// it publishes; deployments without ports are left out.
+func Endpoints(gormDB *gorm.DB) (map[string][]messaging.ServiceEndpoint, error) {
+	instances, err := Instances(gormDB)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]messaging.ServiceEndpoint{}
+	for name, insts := range instances {
+		for _, inst := range insts {
+			if len(inst.Ports) == 0 {
+				continue
+			}
+			out[name] = append(out[name], messaging.ServiceEndpoint{Address: inst.Address, Port: inst.Ports[0].HostPort, Node: inst.Node})
+		}
+	}
+	for _, eps := range out {
+		sort.Slice(eps, func(i, j int) bool { return eps[i].String() < eps[j].String() })
+	}
+	return out, nil
+}
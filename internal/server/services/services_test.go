@@ -0,0 +1,106 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+)
+
+func TestEndpoints(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	a := db.Node{NodeID: "node-a", Status: "healthy", MeshIP: "10.99.0.1"}
+	b := db.Node{NodeID: "node-b", Status: "healthy"}
+	gormDB.Create(&a)
+	gormDB.Create(&b)
+
+	for _, ds := range []spec.DeploymentSpec{
+		{Name: "api", Image: "api", Ports: []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}}},
+		{Name: "worker", Image: "worker"},
+	} {
+		specJSON, _ := json.Marshal(ds)
+		d := db.Deployment{Name: ds.Name, Image: ds.Image, Spec: string(specJSON)}
+		gormDB.Create(&d)
+		gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: ds.Name + "-0", NodeID: a.ID, Status: "running"})
+		gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: ds.Name + "-1", InstanceIndex: 1, NodeID: b.ID, Status: "running"})
+		gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: ds.Name + "-2", InstanceIndex: 2, NodeID: a.ID, Status: "pending"})
+	}
+
+	endpoints, err := Endpoints(gormDB)
+	if err != nil {
+		t.Fatalf("Endpoints failed: %v", err)
+	}
+	if len(endpoints) != 1 || len(endpoints["api"]) != 1 || endpoints["api"][0].String() != "10.99.0.1:8080" {
+		t.Errorf("Expected only 'api' at 10.99.0.1:8080, but got %v", endpoints)
+	}
+}
+
+type fakeRenderer struct {
+	renders []string // instance names
+}
+
+func (f *fakeRenderer) Render(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string, endpoints map[string][]messaging.ServiceEndpoint) (string, error) {
+	f.renders = append(f.renders, instance.Name)
+	return "render-" + instance.Name, nil
+}
+
+func TestWatcherRendersOnEndpointChange(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	node := db.Node{NodeID: "node-a", Status: "healthy", MeshIP: "10.99.0.1"}
+	gormDB.Create(&node)
+
+	create := func(ds spec.DeploymentSpec) db.Deployment {
+		specJSON, _ := json.Marshal(ds)
+		d := db.Deployment{Name: ds.Name, Image: ds.Image, Spec: string(specJSON)}
+		if len(ds.Templates) > 0 {
+			d.Templates = "[]"
+		}
+		gormDB.Create(&d)
+		gormDB.Create(&db.ContainerInstance{DeploymentID: d.ID, Name: ds.Name + "-0", NodeID: node.ID, SpecHash: reconciler.SpecHash(d.Spec), Status: "running"})
+		return d
+	}
+	api := create(spec.DeploymentSpec{Name: "api", Image: "api", Ports: []spec.PortBinding{{HostPort: 8080, ContainerPort: 80}}})
+	create(spec.DeploymentSpec{Name: "lb", Image: "nginx", Templates: []spec.Template{{Destination: "/etc/nginx/nginx.conf", Content: `{{ range service "api" }}{{ . }}{{ end }}`}}})
+
+	f := &fakeRenderer{}
+	w := NewWatcher(gormDB, f, time.Minute)
+	w.check()
+	if len(f.renders) != 1 || f.renders[0] != "lb-0" {
+		t.Fatalf("Expected 'lb-0' to be rendered, but got %v", f.renders)
+	}
+	w.check()
+	if len(f.renders) != 1 {
+		t.Fatalf("Expected no render without endpoint changes, but got %v", f.renders)
+	}
+
+	gormDB.Create(&db.ContainerInstance{DeploymentID: api.ID, Name: "api-1", InstanceIndex: 1, NodeID: node.ID, Status: "running"})
+	w.check()
+	if len(f.renders) != 2 {
+		t.Errorf("Expected 'lb-0' to be rendered again after 'api-1' started, but got %v", f.renders)
+	}
+}
+
+func TestUsesServices(t *testing.T) {
+	for content, want := range map[string]bool{
+		`{{ range service "api" }}{{ . }}{{ end }}`:                       true,
+		`{{ "api" | service | len }}`:                                     true,
+		`{{ if .Env.X }}{{ with service "db" }}{{ . }}{{ end }}{{ end }}`: true,
+		`{{ define "x" }}{{ service "api" }}{{ end }}{{ template "x" }}`:  true,
+		`{{ .Env.service_name }} service`:                                 false,
+		`{{ .Deployment.Name }}`:                                          false,
+	} {
+		if got := usesServices([]spec.Template{{Content: content}}); got != want {
+			t.Errorf("Expected usesServices(%q) to be %v, but got %v", content, want, got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"github.com/atvirokodosprendimai/knitu/internal/server/reconciler"
+	"github.com/atvirokodosprendimai/knitu/internal/spec"
+	"gorm.io/gorm"
+)
+
+// Renderer publishes render tasks to agents.
+type Renderer interface {
+	Render(deployment *db.Deployment, ds spec.DeploymentSpec, instance *db.ContainerInstance, nodeKey string, endpoints map[string][]messaging.ServiceEndpoint) (string, error)
+}
+
+// Watcher asks agents to re-render the templates of running containers
+// whenever service endpoints change. Agents only touch containers whose
+// rendered output actually differs.
+type Watcher struct {
+	db       *gorm.DB
+	renderer Renderer
+	ticker   *time.Ticker
+	stopCh   chan bool
+	// last is the hash of the endpoints every container was last sent.
+	last string
+}
+
+// NewWatcher creates a new template watcher.
+func NewWatcher(db *gorm.DB, renderer Renderer, interval time.Duration) *Watcher {
+	return &Watcher{
+		db:       db,
+		renderer: renderer,
+		ticker:   time.NewTicker(interval),
+		stopCh:   make(chan bool),
+	}
+}
+
+// Start begins the periodic endpoint check.
+func (w *Watcher) Start() {
+	log.Println("[INFO] Starting template watcher...")
+	go func() {
+		for {
+			select {
+			case <-w.ticker.C:
+				w.check()
+			case <-w.stopCh:
+				log.Println("[INFO] Stopping template watcher.")
+				w.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the template watcher.
+func (w *Watcher) Stop() {
+	w.stopCh <- true
+}
+
+// check publishes render tasks for every running templated instance if the
+// endpoints changed since the last successful round.
+func (w *Watcher) check() {
+	endpoints, err := Endpoints(w.db)
+	if err != nil {
+		log.Printf("[ERROR] Template watcher: loading endpoints: %v", err)
+		return
+	}
+	b, err := json.Marshal(endpoints)
+	if err != nil {
+		log.Printf("[ERROR] Template watcher: encoding endpoints: %v", err)
+		return
+	}
+	sum := sha256.Sum256(b)
+	current := hex.EncodeToString(sum[:])
+	if current == w.last {
+		return
+	}
+
+	var deployments []db.Deployment
+	if err := w.db.Where("templates <> ''").Find(&deployments).Error; err != nil {
+		log.Printf("[ERROR] Template watcher: loading deployments: %v", err)
+		return
+	}
+	var nodes []db.Node
+	if err := w.db.Find(&nodes).Error; err != nil {
+		log.Printf("[ERROR] Template watcher: loading nodes: %v", err)
+		return
+	}
+	byID := make(map[uint]db.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+
+	ok := true
+	for i := range deployments {
+		d := &deployments[i]
+		var ds spec.DeploymentSpec
+		if err := json.Unmarshal([]byte(d.Spec), &ds); err != nil || !usesServices(ds.Templates) {
+			continue
+		}
+		hash := reconciler.SpecHash(d.Spec)
+		var instances []db.ContainerInstance
+		if err := w.db.Where("deployment_id = ?", d.ID).Find(&instances).Error; err != nil {
+			log.Printf("[ERROR] Template watcher: loading instances of '%s': %v", d.Name, err)
+			ok = false
+			continue
+		}
+		for j := range instances {
+			inst := &instances[j]
+			node, found := byID[inst.NodeID]
+			// Instances still running an older spec are replaced by the
+			// reconciler and get fresh templates then.
+			if !found || node.Status == "down" || !reconciler.Running(inst.Status) || inst.SpecHash != hash {
+				continue
+			}
+			if _, err := w.renderer.Render(d, ds, inst, node.NodeID, endpoints); err != nil {
+				log.Printf("[WARN] Template watcher: render task for '%s': %v", inst.Name, err)
+				ok = false
+			}
+		}
+	}
+	if ok {
+		w.last = current
+	}
+}
+
+// usesServices reports whether any template calls the service function, the
+// only template input that changes while a container runs. Templates that do
+// not parse fail on the agent and are never rendered again.
+func usesServices(templates []spec.Template) bool {
+	for _, t := range templates {
+		tmpl, err := template.New("").Funcs(template.FuncMap{"service": func(string) any { return nil }}).Parse(t.Content)
+		if err != nil {
+			continue
+		}
+		for _, tt := range tmpl.Templates() {
+			if tt.Tree != nil && callsService(tt.Tree.Root) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// callsService reports whether a template parse tree calls the service
+// function anywhere, including in pipelines and nested blocks.
+func callsService(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		return n.Ident == "service"
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if callsService(c) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return callsService(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if callsService(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if callsService(a) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return callsService(n.Node)
+	case *parse.IfNode:
+		return callsService(n.Pipe) || callsService(n.List) || callsService(n.ElseList)
+	case *parse.RangeNode:
+		return callsService(n.Pipe) || callsService(n.List) || callsService(n.ElseList)
+	case *parse.WithNode:
+		return callsService(n.Pipe) || callsService(n.List) || callsService(n.ElseList)
+	case *parse.TemplateNode:
+		return callsService(n.Pipe)
+	}
+	return false
+}
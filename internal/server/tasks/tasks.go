@@ -0,0 +1,132 @@
+package tasks
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+	"gorm.io/gorm"
+)
+
+// Task states.
+const (
+	StatePending    = "pending"    // stored, not yet published
+	StateDispatched = "dispatched" // published to the task stream
+	StateRunning    = "running"    // an agent picked it up
+	StateSucceeded  = "succeeded"
+	StateFailed     = "failed"
+	StateTimedOut   = "timed_out"
+)
+
+// Terminal reports whether a task in this state will not change any more.
+func Terminal(state string) bool {
+	return state == StateSucceeded || state == StateFailed || state == StateTimedOut
+}
+
+// RecordStatus applies a status reported by an agent to its task. Reports
+// without a task ID come from older agents and are ignored.
+func RecordStatus(gormDB *gorm.DB, status messaging.TaskStatus) error {
+	if status.TaskID == "" {
+		return nil
+	}
+	updates := map[string]interface{}{"node_id": status.NodeID}
+	switch {
+	case status.State == StateRunning:
+		updates["state"] = StateRunning
+	case status.Success:
+		updates["state"] = StateSucceeded
+		updates["message"] = status.Message
+		updates["container_id"] = status.ContainerID
+		updates["completed_at"] = time.Now()
+	default:
+		updates["state"] = StateFailed
+		updates["message"] = status.Message
+		updates["completed_at"] = time.Now()
+	}
+	// A late "running" report must not overwrite a final state.
+	return gormDB.Model(&db.Task{}).
+		Where("task_id = ? AND state NOT IN ?", status.TaskID, []string{StateSucceeded, StateFailed, StateTimedOut}).
+		Updates(updates).Error
+}
+
+// Wait polls until every task reached a terminal state or ctx is done, and
+// returns the tasks as last seen.
+func Wait(ctx context.Context, gormDB *gorm.DB, taskIDs []string) ([]db.Task, error) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var found []db.Task
+		if err := gormDB.Where("task_id IN ?", taskIDs).Order("id").Find(&found).Error; err != nil {
+			return nil, err
+		}
+		done := len(found) == len(taskIDs)
+		for _, t := range found {
+			if !Terminal(t.State) {
+				done = false
+			}
+		}
+		if done {
+			return found, nil
+		}
+		select {
+		case <-ctx.Done():
+			return found, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Service marks tasks that got no final status within the timeout as timed out.
+type Service struct {
+	db      *gorm.DB
+	timeout time.Duration
+	ticker  *time.Ticker
+	stopCh  chan bool
+}
+
+// NewService creates a new task timeout service.
+func NewService(db *gorm.DB, timeout, interval time.Duration) *Service {
+	return &Service{
+		db:      db,
+		timeout: timeout,
+		ticker:  time.NewTicker(interval),
+		stopCh:  make(chan bool),
+	}
+}
+
+// Start begins the periodic timeout sweep.
+func (s *Service) Start() {
+	log.Println("[INFO] Starting task timeout service...")
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.expire(time.Now())
+			case <-s.stopCh:
+				log.Println("[INFO] Stopping task timeout service.")
+				s.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the task timeout service.
+func (s *Service) Stop() {
+	s.stopCh <- true
+}
+
+func (s *Service) expire(now time.Time) {
+	res := s.db.Model(&db.Task{}).
+		Where("state IN ? AND created_at < ?", []string{StatePending, StateDispatched, StateRunning}, now.Add(-s.timeout)).
+		Updates(map[string]interface{}{"state": StateTimedOut, "message": "no result from agent within " + s.timeout.String(), "completed_at": now})
+	if res.Error != nil {
+		log.Printf("[ERROR] Expiring tasks: %v", res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		log.Printf("[WARN] %d task(s) timed out", res.RowsAffected)
+	}
+}
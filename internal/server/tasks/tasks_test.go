@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/knitu/internal/db"
+	"github.com/atvirokodosprendimai/knitu/internal/messaging"
+)
+
+func TestRecordStatusAndExpire(t *testing.T) {
+	gormDB, err := db.NewDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	records := []db.Task{
+		{TaskID: "ok", Type: "deploy", State: StateDispatched},
+		{TaskID: "stuck", Type: "deploy", State: StateDispatched},
+	}
+	if err := gormDB.Create(&records).Error; err != nil {
+		t.Fatalf("Failed to create tasks: %v", err)
+	}
+
+	steps := []messaging.TaskStatus{
+		{TaskID: "ok", State: StateRunning, NodeID: "n1"},
+		{TaskID: "ok", Success: true, ContainerID: "c1", NodeID: "n1"},
+		{TaskID: "ok", State: StateRunning, NodeID: "n1"}, // late progress report
+		{TaskID: "stuck", State: StateRunning, NodeID: "n2"},
+	}
+	for _, st := range steps {
+		if err := RecordStatus(gormDB, st); err != nil {
+			t.Fatalf("RecordStatus failed: %v", err)
+		}
+	}
+
+	s := NewService(gormDB, time.Minute, time.Hour)
+	s.expire(time.Now().Add(2 * time.Minute))
+
+	want := map[string]string{"ok": StateSucceeded, "stuck": StateTimedOut}
+	for id, state := range want {
+		var task db.Task
+		if err := gormDB.First(&task, "task_id = ?", id).Error; err != nil {
+			t.Fatalf("Failed to load task %s: %v", id, err)
+		}
+		if task.State != state {
+			t.Errorf("Expected task %s to be %s, but got %s", id, state, task.State)
+		}
+		if task.CompletedAt == nil {
+			t.Errorf("Expected task %s to have a completion time", id)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the length of the master key in bytes (AES-256).
+const KeySize = 32
+
+// sealedPrefix marks values sealed by a Vault, so a format change can be
+// told apart from the current one.
+const sealedPrefix = "v1:"
+
+// Vault encrypts values stored in the database with the server master key.
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// New creates a vault from a master key of KeySize bytes.
+func New(key []byte) (*Vault, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+// LoadOrCreateKey reads the base64 master key at path, generating and
+// storing a new one (mode 0600) if the file does not exist.
+func LoadOrCreateKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key in %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read master key: %w", err)
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("could not generate master key: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create master key directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("could not write master key: %w", err)
+	}
+	log.Printf("[WARN] Generated a new master key at %s. Back it up: encrypted credentials and secrets cannot be read without it.", path)
+	return key, nil
+}
+
+// Encrypt seals plaintext for storage.
+func (v *Vault) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := v.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt.
+func (v *Vault) Decrypt(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", errors.New("value is not encrypted")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	n := v.aead.NonceSize()
+	if len(b) < n {
+		return "", errors.New("invalid encrypted value: too short")
+	}
+	plaintext, err := v.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", errors.New("could not decrypt value: wrong master key or corrupted data")
+	}
+	return string(plaintext), nil
+}
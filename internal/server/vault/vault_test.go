@@ -0,0 +1,38 @@
+package vault
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	key, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateKey failed: %v", err)
+	}
+	again, err := LoadOrCreateKey(path)
+	if err != nil || string(again) != string(key) {
+		t.Fatalf("Expected the stored key to be loaded again, but got %v", err)
+	}
+
+	v, err := New(key)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	sealed, err := v.Encrypt("hunter2")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if sealed == "hunter2" {
+		t.Fatalf("Expected ciphertext, but got the plaintext")
+	}
+	if got, err := v.Decrypt(sealed); err != nil || got != "hunter2" {
+		t.Errorf("Expected 'hunter2', but got %q (%v)", got, err)
+	}
+
+	other, _ := New(make([]byte, KeySize))
+	if _, err := other.Decrypt(sealed); err == nil {
+		t.Errorf("Expected decrypting with another key to fail")
+	}
+}
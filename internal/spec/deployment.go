@@ -1,16 +1,233 @@
 package spec
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecretRefPrefix marks an env value as a reference to a stored secret
+// (e.g. "secret://db-password"). Deploy tasks carry the reference; the
+// agent fetches the value from the server when it runs the task, so it is
+// never persisted in plaintext.
+const SecretRefPrefix = "secret://"
+
 // DeploymentSpec defines the structure for a user's deployment request.
 // This is what is sent to the API.
 type DeploymentSpec struct {
-	Name         string            `json:"name"`
-	Image        string            `json:"image"`
-	Registry     RegistryAuth      `json:"registry,omitempty"`
-	Network      string            `json:"network,omitempty"`
-	Templates    []Template        `json:"templates,omitempty"`
-	Env          map[string]string `json:"env,omitempty"`
-	Ports        []PortBinding     `json:"ports,omitempty"`
-	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	Name     string       `json:"name"`
+	Image    string       `json:"image"`
+	Registry RegistryAuth `json:"registry,omitempty"`
+	// Network is shorthand for a single entry in Networks without aliases.
+	Network      string              `json:"network,omitempty"`
+	Networks     []NetworkAttachment `json:"networks,omitempty"`
+	Templates    []Template          `json:"templates,omitempty"`
+	Env          map[string]string   `json:"env,omitempty"`
+	Ports        []PortBinding       `json:"ports,omitempty"`
+	NodeSelector map[string]string   `json:"node_selector,omitempty"`
+	Replicas     int                 `json:"replicas,omitempty"`
+	SpreadBy     string              `json:"spread_by,omitempty"`
+	// Affinity refines NodeSelector with label expressions, weighted
+	// preferences and deployments to keep away from.
+	Affinity *Affinity `json:"affinity,omitempty"`
+	// Tolerations let replicas run on nodes with matching taints.
+	Tolerations []Toleration `json:"tolerations,omitempty"`
+	// RestartPolicy is Docker's restart policy: "no" (default), "always",
+	// "unless-stopped", "on-failure" or "on-failure:<max-retries>".
+	RestartPolicy string          `json:"restart_policy,omitempty"`
+	Healthcheck   *Healthcheck    `json:"healthcheck,omitempty"`
+	Update        *UpdateStrategy `json:"update,omitempty"`
+	// Secrets are mounted as files under SecretsDir in the container.
+	Secrets   []SecretMount `json:"secrets,omitempty"`
+	Volumes   []VolumeMount `json:"volumes,omitempty"`
+	Resources *Resources    `json:"resources,omitempty"`
+}
+
+// Validate checks the parts of a spec that agents would otherwise reject.
+func (s *DeploymentSpec) Validate() error {
+	if _, _, err := ParseRestartPolicy(s.RestartPolicy); err != nil {
+		return err
+	}
+	if s.Healthcheck != nil {
+		if err := s.Healthcheck.Validate(); err != nil {
+			return fmt.Errorf("invalid healthcheck: %w", err)
+		}
+	}
+	if s.Resources != nil {
+		if err := s.Resources.Validate(); err != nil {
+			return fmt.Errorf("invalid resources: %w", err)
+		}
+	}
+	if s.Affinity != nil {
+		if err := s.Affinity.Validate(); err != nil {
+			return fmt.Errorf("invalid affinity: %w", err)
+		}
+	}
+	for _, t := range s.Tolerations {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("invalid toleration %q: %w", t.Key, err)
+		}
+	}
+	if s.Update != nil {
+		if err := s.Update.Validate(); err != nil {
+			return fmt.Errorf("invalid update strategy: %w", err)
+		}
+	}
+	for _, t := range s.Templates {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("invalid template %q: %w", t.Destination, err)
+		}
+	}
+	for i, p := range s.Ports {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid port %d: %w", i, err)
+		}
+		for _, q := range s.Ports[:i] {
+			if p.HostPort != 0 && p.Conflicts(q) {
+				return fmt.Errorf("host port %d is bound twice", p.HostPort)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, n := range s.AttachedNetworks() {
+		if strings.TrimSpace(n.Name) == "" {
+			return fmt.Errorf("network name is required")
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("network %q is attached twice", n.Name)
+		}
+		seen[n.Name] = true
+	}
+	mounts := map[string]bool{}
+	for _, v := range s.Volumes {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid volume %q: %w", v.Target, err)
+		}
+		if mounts[path.Clean(v.Target)] {
+			return fmt.Errorf("volume target %q is used twice", v.Target)
+		}
+		mounts[path.Clean(v.Target)] = true
+	}
+	targets := map[string]bool{}
+	for _, m := range s.Secrets {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("invalid secret mount %q: %w", m.Name, err)
+		}
+		if targets[m.Path()] {
+			return fmt.Errorf("secret target %q is used twice", m.Path())
+		}
+		targets[m.Path()] = true
+	}
+	return nil
+}
+
+// AttachedNetworks returns the networks the containers join, including the
+// Network shorthand.
+func (s *DeploymentSpec) AttachedNetworks() []NetworkAttachment {
+	if s.Network == "" {
+		return s.Networks
+	}
+	return append([]NetworkAttachment{{Name: s.Network}}, s.Networks...)
+}
+
+// NetworkNames returns the names of the attached networks as a JSON array,
+// or "" without networks. It is stored on the deployment for display.
+func (s *DeploymentSpec) NetworkNames() string {
+	attached := s.AttachedNetworks()
+	if len(attached) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(attached))
+	for _, a := range attached {
+		names = append(names, a.Name)
+	}
+	b, _ := json.Marshal(names)
+	return string(b)
+}
+
+// NetworkAttachment connects containers to a network defined with the
+// networks API, optionally under extra DNS aliases.
+type NetworkAttachment struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// Rolling reports whether instances are replaced with the rolling strategy.
+func (s *DeploymentSpec) Rolling() bool {
+	return s.Update != nil && s.Update.Type == UpdateRolling
+}
+
+// ReplicaCount returns the number of instances to run, defaulting to one.
+func (s *DeploymentSpec) ReplicaCount() int {
+	if s.Replicas < 1 {
+		return 1
+	}
+	return s.Replicas
+}
+
+// Scheduled reports whether the server must place instances on specific
+// nodes. Single-instance deployments without a selector, affinity, named
+// volumes, reserved resources or port ranges to allocate are broadcast.
+func (s *DeploymentSpec) Scheduled() bool {
+	return len(s.NodeSelector) > 0 || s.Affinity != nil || s.Replicas > 1 || s.SpreadBy != "" || s.Stateful() || s.Resources.Reserves() || s.allocatesPortRange()
+}
+
+// allocatesPortRange reports whether a port range needs host ports. Only the
+// server allocates them as one consecutive block.
+func (s *DeploymentSpec) allocatesPortRange() bool {
+	for _, p := range s.Ports {
+		if p.HostPort == 0 && p.Size() > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Stateful reports whether the spec mounts named volumes, which pin its
+// instances to the nodes holding them.
+func (s *DeploymentSpec) Stateful() bool {
+	for _, v := range s.Volumes {
+		if v.Kind() == VolumeNamed {
+			return true
+		}
+	}
+	return false
+}
+
+// InstanceName returns the container name used for a replica of a deployment.
+func InstanceName(deployment string, index int) string {
+	return fmt.Sprintf("%s-%d", deployment, index)
+}
+
+// DefaultRegistry is the registry of images that name no registry host.
+const DefaultRegistry = "docker.io"
+
+// ImageRegistry returns the registry host an image is pulled from, e.g.
+// "ghcr.io" for "ghcr.io/org/app:1.0" and "docker.io" for "nginx:latest".
+func ImageRegistry(image string) string {
+	host, _, ok := strings.Cut(image, "/")
+	if !ok || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return DefaultRegistry
+	}
+	return NormalizeRegistry(host)
+}
+
+// NormalizeRegistry reduces a registry URL to the host form ImageRegistry
+// returns: no scheme, no path, lower case, Docker Hub aliases folded.
+func NormalizeRegistry(url string) string {
+	host := strings.ToLower(strings.TrimSpace(url))
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DefaultRegistry
+	}
+	return host
 }
 
 // RegistryAuth defines credentials for a private container registry.
@@ -20,14 +237,754 @@ type RegistryAuth struct {
 }
 
 // Template defines a file to be rendered and mounted into a container.
+// Agents re-render it when the cluster state it reads changes and, if the
+// output differs, apply its change mode to the container.
 type Template struct {
 	Content     string `json:"content"`
 	Destination string `json:"destination"`
+	// ChangeMode is "restart" (default), "signal" or "noop".
+	ChangeMode string `json:"change_mode,omitempty"`
+	// ChangeSignal is sent with the "signal" change mode, e.g. "SIGHUP".
+	ChangeSignal string `json:"change_signal,omitempty"`
+	// Mode is the octal file mode of the rendered file, default "0644".
+	Mode string `json:"mode,omitempty"`
+	// UID and GID own the rendered file; 0 leaves it owned by the agent.
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+}
+
+// Template change modes.
+const (
+	ChangeRestart = "restart"
+	ChangeSignal  = "signal"
+	ChangeNoop    = "noop"
+)
+
+// changeSignals are the signals a template change may send.
+var changeSignals = map[string]bool{
+	"SIGHUP": true, "SIGINT": true, "SIGQUIT": true, "SIGUSR1": true,
+	"SIGUSR2": true, "SIGTERM": true, "SIGWINCH": true,
+}
+
+// Validate checks the destination, file mode, owner, change mode and signal.
+func (t Template) Validate() error {
+	if !path.IsAbs(t.Destination) {
+		return fmt.Errorf("destination must be an absolute path")
+	}
+	// The directory of a template is mounted over the container's, hiding
+	// the files the image has there.
+	if dir := path.Dir(path.Clean(t.Destination)); systemDirs[dir] || dir == SecretsDir {
+		return fmt.Errorf("destination directory %q cannot be replaced by templates", dir)
+	}
+	if _, err := t.FileMode(); err != nil {
+		return err
+	}
+	if t.UID < 0 || t.GID < 0 {
+		return fmt.Errorf("uid and gid must not be negative")
+	}
+	switch t.ChangeMode {
+	case "", ChangeRestart, ChangeNoop:
+		if t.ChangeSignal != "" {
+			return fmt.Errorf("change_signal requires change_mode %q", ChangeSignal)
+		}
+	case ChangeSignal:
+		if !changeSignals[t.Signal()] {
+			return fmt.Errorf("unsupported change_signal %q", t.ChangeSignal)
+		}
+	default:
+		return fmt.Errorf("unknown change_mode %q", t.ChangeMode)
+	}
+	return nil
+}
+
+// systemDirs are directories of an image that templates must not be placed
+// in directly, since their directory is mounted over the image's.
+var systemDirs = map[string]bool{
+	"/": true, "/bin": true, "/dev": true, "/etc": true, "/lib": true, "/lib64": true,
+	"/proc": true, "/sbin": true, "/sys": true, "/usr": true, "/usr/bin": true, "/usr/lib": true, "/usr/sbin": true,
+}
+
+// FileMode parses Mode, defaulting to 0644.
+func (t Template) FileMode() (uint32, error) {
+	if t.Mode == "" {
+		return 0o644, nil
+	}
+	mode, err := strconv.ParseUint(t.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q", t.Mode)
+	}
+	return uint32(mode), nil
 }
 
-// PortBinding defines a host-to-container port mapping.
+// OnChange returns the change mode, defaulting to restart.
+func (t Template) OnChange() string {
+	if t.ChangeMode == "" {
+		return ChangeRestart
+	}
+	return t.ChangeMode
+}
+
+// Signal returns the change signal in its "SIG" form, e.g. "SIGHUP" for "hup".
+func (t Template) Signal() string {
+	sig := strings.ToUpper(strings.TrimSpace(t.ChangeSignal))
+	if sig != "" && !strings.HasPrefix(sig, "SIG") {
+		sig = "SIG" + sig
+	}
+	return sig
+}
+
+// Port protocols.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolSCTP = "sctp"
+)
+
+// PortBinding defines a host-to-container port mapping. A zero HostPort is
+// allocated by the scheduler from the server's host port range. With
+// ContainerPortEnd set, the binding maps the range ContainerPort through
+// ContainerPortEnd onto as many consecutive host ports from HostPort.
 type PortBinding struct {
-	HostIP        string `json:"host_ip,omitempty"`
-	HostPort      int    `json:"host_port"`
-	ContainerPort int    `json:"container_port"`
+	HostIP           string `json:"host_ip,omitempty"`
+	HostPort         int    `json:"host_port"`
+	ContainerPort    int    `json:"container_port"`
+	ContainerPortEnd int    `json:"container_port_end,omitempty"`
+	Protocol         string `json:"protocol,omitempty"` // tcp (default), udp or sctp
+}
+
+// Proto returns the protocol of the binding, tcp if unset.
+func (p PortBinding) Proto() string {
+	if p.Protocol == "" {
+		return ProtocolTCP
+	}
+	return strings.ToLower(p.Protocol)
+}
+
+// Size returns the number of ports the binding maps.
+func (p PortBinding) Size() int {
+	if p.ContainerPortEnd == 0 {
+		return 1
+	}
+	return p.ContainerPortEnd - p.ContainerPort + 1
+}
+
+// Validate checks the protocol, the port numbers and the host IP.
+func (p PortBinding) Validate() error {
+	switch p.Proto() {
+	case ProtocolTCP, ProtocolUDP, ProtocolSCTP:
+	default:
+		return fmt.Errorf("protocol must be tcp, udp or sctp")
+	}
+	if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+		return fmt.Errorf("container_port must be between 1 and 65535")
+	}
+	if p.ContainerPortEnd != 0 && (p.ContainerPortEnd < p.ContainerPort || p.ContainerPortEnd > 65535) {
+		return fmt.Errorf("container_port_end must be between container_port and 65535")
+	}
+	if p.HostPort < 0 || p.HostPort+p.Size()-1 > 65535 {
+		return fmt.Errorf("host ports must be between 0 and 65535")
+	}
+	if p.HostIP != "" {
+		if _, err := netip.ParseAddr(p.HostIP); err != nil {
+			return fmt.Errorf("invalid host_ip %q", p.HostIP)
+		}
+	}
+	return nil
+}
+
+// Conflicts reports whether two bindings claim a common host port of the
+// same protocol on overlapping addresses. An empty or unspecified host IP
+// binds every address.
+func (p PortBinding) Conflicts(o PortBinding) bool {
+	if p.Proto() != o.Proto() || p.HostPort > o.HostPort+o.Size()-1 || o.HostPort > p.HostPort+p.Size()-1 {
+		return false
+	}
+	return anyAddr(p.HostIP) || anyAddr(o.HostIP) || p.HostIP == o.HostIP
+}
+
+// anyAddr reports whether a host IP binds every address.
+func anyAddr(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err != nil || addr.IsUnspecified()
+}
+
+// Healthcheck defines how Docker probes a container. Exactly one of Cmd, HTTP
+// or TCP is set. HTTP and TCP probes run inside the container and need curl
+// or wget, respectively nc, in the image.
+type Healthcheck struct {
+	Cmd         []string `json:"cmd,omitempty"`  // exec form, e.g. ["pg_isready"]
+	HTTP        string   `json:"http,omitempty"` // URL that must answer 2xx/3xx, e.g. "http://localhost:8080/healthz"
+	TCP         int      `json:"tcp,omitempty"`  // container port that must accept connections
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	StartPeriod string   `json:"start_period,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+}
+
+// Validate checks that exactly one probe is set and durations parse.
+func (h *Healthcheck) Validate() error {
+	probes := 0
+	if len(h.Cmd) > 0 {
+		probes++
+	}
+	if h.HTTP != "" {
+		probes++
+	}
+	if h.TCP != 0 {
+		probes++
+	}
+	if probes != 1 {
+		return fmt.Errorf("exactly one of cmd, http or tcp is required")
+	}
+	if h.TCP < 0 || h.TCP > 65535 {
+		return fmt.Errorf("tcp port %d out of range", h.TCP)
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	_, _, _, err := h.Durations()
+	return err
+}
+
+// Durations parses Interval, Timeout and StartPeriod. Empty values are zero,
+// which leaves Docker's defaults in place.
+func (h *Healthcheck) Durations() (interval, timeout, startPeriod time.Duration, err error) {
+	parse := func(field, value string) (time.Duration, error) {
+		if value == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid %s %q", field, value)
+		}
+		return d, nil
+	}
+	if interval, err = parse("interval", h.Interval); err != nil {
+		return
+	}
+	if timeout, err = parse("timeout", h.Timeout); err != nil {
+		return
+	}
+	startPeriod, err = parse("start_period", h.StartPeriod)
+	return
+}
+
+// Update strategy types.
+const (
+	UpdateRecreate = "recreate" // replace every instance at once (default)
+	UpdateRolling  = "rolling"  // replace instances in health-gated batches
+)
+
+// Failure actions of a rolling update.
+const (
+	FailureRollback = "rollback" // return to the previous revision (default)
+	FailurePause    = "pause"    // stop the rollout where it is
+)
+
+// defaultProgressDeadline bounds a rollout that sets no deadline.
+const defaultProgressDeadline = 10 * time.Minute
+
+// UpdateStrategy controls how running instances are replaced when the spec
+// changes.
+type UpdateStrategy struct {
+	Type string `json:"type,omitempty"`
+	// MaxSurge is how many instances may run above the replica count.
+	MaxSurge int `json:"max_surge,omitempty"`
+	// MaxUnavailable is how many replicas may be not ready at once. It
+	// defaults to 1 when MaxSurge is 0 as well.
+	MaxUnavailable int `json:"max_unavailable,omitempty"`
+	// ProgressDeadline is how long the rollout may take before it fails.
+	ProgressDeadline string `json:"progress_deadline,omitempty"`
+	FailureAction    string `json:"failure_action,omitempty"`
+}
+
+// Validate checks the strategy type, limits, deadline and failure action.
+func (u *UpdateStrategy) Validate() error {
+	switch u.Type {
+	case "", UpdateRecreate, UpdateRolling:
+	default:
+		return fmt.Errorf("unknown type %q", u.Type)
+	}
+	if u.MaxSurge < 0 || u.MaxUnavailable < 0 {
+		return fmt.Errorf("max_surge and max_unavailable must not be negative")
+	}
+	switch u.FailureAction {
+	case "", FailureRollback, FailurePause:
+	default:
+		return fmt.Errorf("unknown failure_action %q", u.FailureAction)
+	}
+	if u.ProgressDeadline != "" {
+		if d, err := time.ParseDuration(u.ProgressDeadline); err != nil || d <= 0 {
+			return fmt.Errorf("invalid progress_deadline %q", u.ProgressDeadline)
+		}
+	}
+	return nil
+}
+
+// Limits returns the surge and unavailability limits of a rolling update.
+func (u *UpdateStrategy) Limits() (maxSurge, maxUnavailable int) {
+	if u.MaxSurge == 0 && u.MaxUnavailable == 0 {
+		return 0, 1
+	}
+	return u.MaxSurge, u.MaxUnavailable
+}
+
+// Deadline returns the progress deadline, defaulting to ten minutes.
+func (u *UpdateStrategy) Deadline() time.Duration {
+	if d, err := time.ParseDuration(u.ProgressDeadline); err == nil && d > 0 {
+		return d
+	}
+	return defaultProgressDeadline
+}
+
+// ParseRestartPolicy splits a restart policy into Docker's policy name and
+// maximum retry count.
+func ParseRestartPolicy(policy string) (name string, maxRetries int, err error) {
+	name, retries, hasRetries := strings.Cut(policy, ":")
+	switch name {
+	case "", "no", "always", "unless-stopped":
+		if hasRetries {
+			return "", 0, fmt.Errorf("restart policy %q does not take a retry count", name)
+		}
+		return name, 0, nil
+	case "on-failure":
+		if !hasRetries {
+			return name, 0, nil
+		}
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("invalid retry count in restart policy %q", policy)
+		}
+		return name, n, nil
+	default:
+		return "", 0, fmt.Errorf("unknown restart policy %q", policy)
+	}
+}
+
+// SecretRef returns the secret referenced by an env value, if any, in the
+// form accepted by ParseSecretRef.
+func SecretRef(value string) (string, bool) {
+	if !strings.HasPrefix(value, SecretRefPrefix) {
+		return "", false
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(value, SecretRefPrefix))
+	return name, name != ""
+}
+
+// ParseSecretRef splits a secret reference of the form "name" or
+// "name@version". Version 0 means the latest version.
+func ParseSecretRef(ref string) (name string, version int, err error) {
+	name, v, pinned := strings.Cut(ref, "@")
+	if name == "" {
+		return "", 0, fmt.Errorf("secret name is required")
+	}
+	if !pinned {
+		return name, 0, nil
+	}
+	version, err = strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid secret version in %q", ref)
+	}
+	return name, version, nil
+}
+
+// SecretsDir is where secret files are mounted in containers.
+const SecretsDir = "/run/secrets"
+
+// SecretMount mounts a secret as a file under SecretsDir.
+type SecretMount struct {
+	Name   string `json:"name"`             // secret reference, "name" or "name@version"
+	Target string `json:"target,omitempty"` // file path relative to SecretsDir, defaults to the secret name
+	Mode   string `json:"mode,omitempty"`   // octal file mode, defaults to "0444"
+}
+
+// Validate checks the reference, target path and mode.
+func (m SecretMount) Validate() error {
+	if _, _, err := ParseSecretRef(m.Name); err != nil {
+		return err
+	}
+	p := m.Path()
+	if path.IsAbs(p) || path.Clean(p) != p || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("target must be a clean relative path, got %q", p)
+	}
+	_, err := m.FileMode()
+	return err
+}
+
+// Path returns the file path relative to SecretsDir.
+func (m SecretMount) Path() string {
+	if m.Target != "" {
+		return m.Target
+	}
+	name, _, _ := strings.Cut(m.Name, "@")
+	return name
+}
+
+// FileMode parses Mode, defaulting to 0444.
+func (m SecretMount) FileMode() (uint32, error) {
+	if m.Mode == "" {
+		return 0o444, nil
+	}
+	mode, err := strconv.ParseUint(m.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q", m.Mode)
+	}
+	return uint32(mode), nil
+}
+
+// Volume mount types.
+const (
+	VolumeNamed = "volume" // named Docker volume, kept across redeploys
+	VolumeBind  = "bind"   // host path, allowed by the agent's allow-list
+	VolumeTmpfs = "tmpfs"  // in-memory, lost when the container stops
+)
+
+var volumeNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// VolumeMount mounts a named volume, a host path or a tmpfs into the container.
+type VolumeMount struct {
+	Type     string `json:"type,omitempty"`      // volume (default), bind or tmpfs
+	Source   string `json:"source,omitempty"`    // volume name or absolute host path; unused for tmpfs
+	Target   string `json:"target"`              // absolute path in the container
+	ReadOnly bool   `json:"read_only,omitempty"` // not for tmpfs
+	SizeMB   int    `json:"size_mb,omitempty"`   // tmpfs size limit, unlimited if zero
+}
+
+// Kind returns the mount type, VolumeNamed if unset.
+func (v VolumeMount) Kind() string {
+	if v.Type == "" {
+		return VolumeNamed
+	}
+	return strings.ToLower(v.Type)
+}
+
+// Validate checks the type, source and target of the mount.
+func (v VolumeMount) Validate() error {
+	if !path.IsAbs(v.Target) {
+		return fmt.Errorf("target must be an absolute path")
+	}
+	if path.Clean(v.Target) == SecretsDir {
+		return fmt.Errorf("target %q is reserved for secrets", SecretsDir)
+	}
+	switch v.Kind() {
+	case VolumeNamed:
+		if !volumeNameRE.MatchString(v.Source) {
+			return fmt.Errorf("source must be a volume name of letters, digits, '_', '.' and '-'")
+		}
+	case VolumeBind:
+		if !path.IsAbs(v.Source) {
+			return fmt.Errorf("source must be an absolute host path")
+		}
+	case VolumeTmpfs:
+		if v.Source != "" || v.ReadOnly {
+			return fmt.Errorf("tmpfs takes no source and cannot be read-only")
+		}
+	default:
+		return fmt.Errorf("type must be volume, bind or tmpfs")
+	}
+	if v.SizeMB < 0 || (v.SizeMB > 0 && v.Kind() != VolumeTmpfs) {
+		return fmt.Errorf("size_mb must be positive and is only for tmpfs")
+	}
+	return nil
+}
+
+// VolumeName returns the Docker volume name a replica mounts for a named
+// volume: the source itself for replica 0, "<source>-<index>" for the
+// others, so that every replica keeps its own data.
+func VolumeName(source string, index int) string {
+	if index == 0 {
+		return source
+	}
+	return fmt.Sprintf("%s-%d", source, index)
+}
+
+// Selector operators. Gt and Lt compare integer label values.
+const (
+	OpIn           = "In"
+	OpNotIn        = "NotIn"
+	OpExists       = "Exists"
+	OpDoesNotExist = "DoesNotExist"
+	OpGt           = "Gt"
+	OpLt           = "Lt"
+)
+
+// SelectorRequirement matches the value of a node label, e.g.
+// {"key": "zone", "operator": "In", "values": ["a", "b"]}.
+type SelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+// Validate checks the operator and the number and form of the values it takes.
+func (r SelectorRequirement) Validate() error {
+	if strings.TrimSpace(r.Key) == "" {
+		return fmt.Errorf("key is required")
+	}
+	switch r.Operator {
+	case OpIn, OpNotIn:
+		if len(r.Values) == 0 {
+			return fmt.Errorf("%s needs at least one value", r.Operator)
+		}
+	case OpExists, OpDoesNotExist:
+		if len(r.Values) > 0 {
+			return fmt.Errorf("%s takes no values", r.Operator)
+		}
+	case OpGt, OpLt:
+		if len(r.Values) != 1 {
+			return fmt.Errorf("%s needs exactly one value", r.Operator)
+		}
+		if _, err := strconv.ParseInt(r.Values[0], 10, 64); err != nil {
+			return fmt.Errorf("%s needs an integer value, got %q", r.Operator, r.Values[0])
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", r.Operator)
+	}
+	return nil
+}
+
+// String returns the requirement as e.g. "zone In (a, b)".
+func (r SelectorRequirement) String() string {
+	switch r.Operator {
+	case OpExists, OpDoesNotExist:
+		return r.Key + " " + r.Operator
+	case OpGt, OpLt:
+		return r.Key + " " + r.Operator + " " + strings.Join(r.Values, ", ")
+	}
+	return r.Key + " " + r.Operator + " (" + strings.Join(r.Values, ", ") + ")"
+}
+
+// Preference adds Weight to the score of nodes matching its requirement.
+type Preference struct {
+	Weight int `json:"weight"`
+	SelectorRequirement
+}
+
+// Affinity constrains and ranks the nodes a deployment's replicas go to.
+type Affinity struct {
+	// Required must all hold on a node, in addition to the NodeSelector.
+	Required []SelectorRequirement `json:"required,omitempty"`
+	// Preferred scores nodes; the spread picks the highest scoring of the
+	// nodes it would otherwise treat alike.
+	Preferred []Preference `json:"preferred,omitempty"`
+	// AvoidDeployments lists deployments whose instances replicas must not
+	// share a node with. Naming the deployment itself places at most one of
+	// its replicas per node.
+	AvoidDeployments []string `json:"avoid_deployments,omitempty"`
+}
+
+// Validate checks every requirement and that weights are between 1 and 100.
+func (a *Affinity) Validate() error {
+	for _, r := range a.Required {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("required %q: %w", r.Key, err)
+		}
+	}
+	for _, p := range a.Preferred {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("preferred %q: %w", p.Key, err)
+		}
+		if p.Weight < 1 || p.Weight > 100 {
+			return fmt.Errorf("preferred %q: weight must be between 1 and 100", p.Key)
+		}
+	}
+	for _, name := range a.AvoidDeployments {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("avoided deployment name is required")
+		}
+	}
+	return nil
+}
+
+// Taint effects. Replicas that do not tolerate a NoSchedule taint are not
+// placed on the node but keep running there; a NoExecute taint also moves
+// them off.
+const (
+	TaintNoSchedule = "NoSchedule"
+	TaintNoExecute  = "NoExecute"
+)
+
+// Taint keeps replicas off a node unless they tolerate it.
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// ParseTaint parses a taint written as "key=value:Effect" or "key:Effect".
+func ParseTaint(s string) (Taint, error) {
+	kv, effect, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Taint{}, fmt.Errorf("taint %q must be key[=value]:effect", s)
+	}
+	key, value, _ := strings.Cut(kv, "=")
+	t := Taint{Key: key, Value: value, Effect: effect}
+	return t, t.Validate()
+}
+
+// Validate checks the key and the effect.
+func (t Taint) Validate() error {
+	if strings.TrimSpace(t.Key) == "" {
+		return fmt.Errorf("taint key is required")
+	}
+	if t.Effect != TaintNoSchedule && t.Effect != TaintNoExecute {
+		return fmt.Errorf("unknown taint effect %q", t.Effect)
+	}
+	return nil
+}
+
+// String returns the taint as "key=value:Effect".
+func (t Taint) String() string {
+	if t.Value == "" {
+		return t.Key + ":" + t.Effect
+	}
+	return t.Key + "=" + t.Value + ":" + t.Effect
+}
+
+// Toleration lets replicas run on nodes with matching taints. With the
+// Exists operator it matches any value of the key, and an empty key with
+// Exists matches every taint. An empty effect matches both effects.
+type Toleration struct {
+	Key      string `json:"key,omitempty"`
+	Operator string `json:"operator,omitempty"` // Equal (default) or Exists
+	Value    string `json:"value,omitempty"`
+	Effect   string `json:"effect,omitempty"`
+}
+
+// Validate checks the operator and the effect.
+func (t Toleration) Validate() error {
+	switch t.Operator {
+	case "", "Equal":
+		if t.Key == "" {
+			return fmt.Errorf("key is required unless the operator is Exists")
+		}
+	case OpExists:
+		if t.Value != "" {
+			return fmt.Errorf("Exists takes no value")
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", t.Operator)
+	}
+	if t.Effect != "" && t.Effect != TaintNoSchedule && t.Effect != TaintNoExecute {
+		return fmt.Errorf("unknown effect %q", t.Effect)
+	}
+	return nil
+}
+
+// Tolerates reports whether the toleration matches a taint.
+func (t Toleration) Tolerates(taint Taint) bool {
+	if t.Effect != "" && t.Effect != taint.Effect {
+		return false
+	}
+	if t.Operator == OpExists {
+		return t.Key == "" || t.Key == taint.Key
+	}
+	return t.Key == taint.Key && t.Value == taint.Value
+}
+
+// Resources limits what each container may use and reserves capacity for it
+// on its node. CPU is in cores and memory in MB; zero means no limit.
+// Reservations default to the limits and are what the scheduler counts
+// against a node's allocatable capacity.
+type Resources struct {
+	CPU                 float64 `json:"cpu,omitempty"`
+	MemoryMB            int64   `json:"memory_mb,omitempty"`
+	Pids                int64   `json:"pids,omitempty"`
+	CPUReservation      float64 `json:"cpu_reservation,omitempty"`
+	MemoryReservationMB int64   `json:"memory_reservation_mb,omitempty"`
+}
+
+// Validate checks that limits are not negative and reservations fit within
+// their limits.
+func (r *Resources) Validate() error {
+	if r.CPU < 0 || r.MemoryMB < 0 || r.Pids < 0 || r.CPUReservation < 0 || r.MemoryReservationMB < 0 {
+		return fmt.Errorf("limits and reservations must not be negative")
+	}
+	if r.CPU > 0 && r.CPUReservation > r.CPU {
+		return fmt.Errorf("cpu_reservation %g exceeds the cpu limit %g", r.CPUReservation, r.CPU)
+	}
+	if r.MemoryMB > 0 && r.MemoryReservationMB > r.MemoryMB {
+		return fmt.Errorf("memory_reservation_mb %d exceeds the memory_mb limit %d", r.MemoryReservationMB, r.MemoryMB)
+	}
+	return nil
+}
+
+// ReservedCPU returns the cores reserved per container, the limit if no
+// reservation is set. It is zero for a nil receiver.
+func (r *Resources) ReservedCPU() float64 {
+	if r == nil {
+		return 0
+	}
+	if r.CPUReservation > 0 {
+		return r.CPUReservation
+	}
+	return r.CPU
+}
+
+// ReservedMemoryMB returns the memory reserved per container, the limit if no
+// reservation is set. It is zero for a nil receiver.
+func (r *Resources) ReservedMemoryMB() int64 {
+	if r == nil {
+		return 0
+	}
+	if r.MemoryReservationMB > 0 {
+		return r.MemoryReservationMB
+	}
+	return r.MemoryMB
+}
+
+// Reserves reports whether containers reserve CPU or memory on their node.
+func (r *Resources) Reserves() bool {
+	return r.ReservedCPU() > 0 || r.ReservedMemoryMB() > 0
+}
+
+// DefaultNetworkDriver is the Docker driver of networks that name none.
+const DefaultNetworkDriver = "bridge"
+
+// MeshDriver is the driver of networks spanning all nodes: each node gets a
+// MeshNodePrefix subnet of the network's subnet on a routed bridge, and
+// nodes route to each other's subnets over the wg-mesh.
+const MeshDriver = "mesh"
+
+// MeshNodePrefix is the prefix length of the subnet each node gets in a mesh network.
+const MeshNodePrefix = 24
+
+// networkDrivers are the network drivers agents may create.
+var networkDrivers = map[string]bool{"bridge": true, "macvlan": true, "ipvlan": true, MeshDriver: true}
+
+// NetworkSpec defines a Docker network that agents create on demand.
+type NetworkSpec struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver,omitempty"`
+	Subnet string `json:"subnet,omitempty"` // CIDR, e.g. "172.30.0.0/24"; empty lets Docker choose
+}
+
+// Validate checks the name, driver and subnet.
+func (n *NetworkSpec) Validate() error {
+	if strings.TrimSpace(n.Name) == "" {
+		return fmt.Errorf("network name is required")
+	}
+	if n.Driver != "" && !networkDrivers[n.Driver] {
+		return fmt.Errorf("unsupported network driver %q", n.Driver)
+	}
+	if n.Subnet != "" {
+		if _, err := netip.ParsePrefix(n.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet %q: %w", n.Subnet, err)
+		}
+	}
+	if n.Driver == MeshDriver {
+		p, err := netip.ParsePrefix(n.Subnet)
+		if err != nil || !p.Addr().Is4() || p.Bits() >= MeshNodePrefix {
+			return fmt.Errorf("mesh networks need an IPv4 subnet larger than /%d, got %q", MeshNodePrefix, n.Subnet)
+		}
+	}
+	return nil
+}
+
+// DriverName returns the driver, defaulting to DefaultNetworkDriver.
+func (n *NetworkSpec) DriverName() string {
+	if n.Driver == "" {
+		return DefaultNetworkDriver
+	}
+	return n.Driver
 }
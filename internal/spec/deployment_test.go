@@ -0,0 +1,156 @@
+package spec
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    DeploymentSpec
+		wantErr bool
+	}{
+		{"defaults", DeploymentSpec{}, false},
+		{"on-failure with retries", DeploymentSpec{RestartPolicy: "on-failure:3"}, false},
+		{"always with retries", DeploymentSpec{RestartPolicy: "always:3"}, true},
+		{"unknown policy", DeploymentSpec{RestartPolicy: "sometimes"}, true},
+		{"http healthcheck", DeploymentSpec{Healthcheck: &Healthcheck{HTTP: "http://localhost/", Interval: "5s"}}, false},
+		{"two probes", DeploymentSpec{Healthcheck: &Healthcheck{HTTP: "http://localhost/", TCP: 80}}, true},
+		{"no probe", DeploymentSpec{Healthcheck: &Healthcheck{Interval: "5s"}}, true},
+		{"bad interval", DeploymentSpec{Healthcheck: &Healthcheck{TCP: 80, Interval: "soon"}}, true},
+		{"signal on change", DeploymentSpec{Templates: []Template{{Destination: "/etc/app/app.conf", ChangeMode: "signal", ChangeSignal: "hup"}}}, false},
+		{"signal without mode", DeploymentSpec{Templates: []Template{{Destination: "/etc/app/app.conf", ChangeSignal: "SIGHUP"}}}, true},
+		{"unknown change mode", DeploymentSpec{Templates: []Template{{Destination: "/etc/app/app.conf", ChangeMode: "reload"}}}, true},
+		{"relative template destination", DeploymentSpec{Templates: []Template{{Destination: "app.conf"}}}, true},
+		{"template directly in /etc", DeploymentSpec{Templates: []Template{{Destination: "/etc/app.conf"}}}, true},
+		{"template in the secrets dir", DeploymentSpec{Templates: []Template{{Destination: "/run/secrets/app.conf"}}}, true},
+		{"template owner", DeploymentSpec{Templates: []Template{{Destination: "/etc/app/app.conf", Mode: "0640", UID: 101, GID: 101}}}, false},
+		{"bad template mode", DeploymentSpec{Templates: []Template{{Destination: "/etc/app/app.conf", Mode: "644x"}}}, true},
+		{"network shorthand and list", DeploymentSpec{Network: "front", Networks: []NetworkAttachment{{Name: "back", Aliases: []string{"db"}}}}, false},
+		{"network attached twice", DeploymentSpec{Network: "front", Networks: []NetworkAttachment{{Name: "front"}}}, true},
+		{"pinned secret", DeploymentSpec{Secrets: []SecretMount{{Name: "db@2", Target: "db/password", Mode: "0400"}}}, false},
+		{"secret outside dir", DeploymentSpec{Secrets: []SecretMount{{Name: "db", Target: "../etc/passwd"}}}, true},
+		{"secret parent dir", DeploymentSpec{Secrets: []SecretMount{{Name: "db", Target: ".."}}}, true},
+		{"secret name starting with dots", DeploymentSpec{Secrets: []SecretMount{{Name: "db", Target: "..data"}}}, false},
+		{"duplicate secret target", DeploymentSpec{Secrets: []SecretMount{{Name: "a", Target: "x"}, {Name: "b", Target: "x"}}}, true},
+		{"bad secret mode", DeploymentSpec{Secrets: []SecretMount{{Name: "db", Mode: "rw"}}}, true},
+		{"allocated host ports", DeploymentSpec{Ports: []PortBinding{{ContainerPort: 80}, {ContainerPort: 443}}}, false},
+		{"same host port on two addresses", DeploymentSpec{Ports: []PortBinding{{HostIP: "10.0.0.1", HostPort: 80, ContainerPort: 80}, {HostIP: "10.0.0.2", HostPort: 80, ContainerPort: 81}}}, false},
+		{"host port bound twice", DeploymentSpec{Ports: []PortBinding{{HostPort: 80, ContainerPort: 80}, {HostIP: "10.0.0.1", HostPort: 80, ContainerPort: 81}}}, true},
+		{"missing container port", DeploymentSpec{Ports: []PortBinding{{HostPort: 80}}}, true},
+		{"tcp and udp on one port", DeploymentSpec{Ports: []PortBinding{{HostPort: 53, ContainerPort: 53}, {HostPort: 53, ContainerPort: 53, Protocol: "udp"}}}, false},
+		{"unknown protocol", DeploymentSpec{Ports: []PortBinding{{HostPort: 53, ContainerPort: 53, Protocol: "icmp"}}}, true},
+		{"port range", DeploymentSpec{Ports: []PortBinding{{HostPort: 27015, ContainerPort: 27015, ContainerPortEnd: 27020, Protocol: "udp"}}}, false},
+		{"reversed port range", DeploymentSpec{Ports: []PortBinding{{ContainerPort: 27020, ContainerPortEnd: 27015}}}, true},
+		{"overlapping port ranges", DeploymentSpec{Ports: []PortBinding{{HostPort: 8000, ContainerPort: 80, ContainerPortEnd: 89}, {HostPort: 8005, ContainerPort: 443}}}, true},
+		{"volumes", DeploymentSpec{Volumes: []VolumeMount{{Source: "pgdata", Target: "/var/lib/postgresql/data"}, {Type: "bind", Source: "/srv/config", Target: "/etc/app", ReadOnly: true}, {Type: "tmpfs", Target: "/tmp", SizeMB: 64}}}, false},
+		{"relative volume target", DeploymentSpec{Volumes: []VolumeMount{{Source: "data", Target: "data"}}}, true},
+		{"bad volume name", DeploymentSpec{Volumes: []VolumeMount{{Source: "../data", Target: "/data"}}}, true},
+		{"relative host path", DeploymentSpec{Volumes: []VolumeMount{{Type: "bind", Source: "srv", Target: "/data"}}}, true},
+		{"tmpfs with source", DeploymentSpec{Volumes: []VolumeMount{{Type: "tmpfs", Source: "x", Target: "/tmp"}}}, true},
+		{"volume over secrets", DeploymentSpec{Volumes: []VolumeMount{{Type: "tmpfs", Target: "/run/secrets/"}}}, true},
+		{"volume target used twice", DeploymentSpec{Volumes: []VolumeMount{{Source: "a", Target: "/data"}, {Type: "tmpfs", Target: "/data/"}}}, true},
+		{"resources", DeploymentSpec{Resources: &Resources{CPU: 1.5, MemoryMB: 512, Pids: 100, MemoryReservationMB: 256}}, false},
+		{"negative memory", DeploymentSpec{Resources: &Resources{MemoryMB: -1}}, true},
+		{"reservation above limit", DeploymentSpec{Resources: &Resources{CPU: 0.5, CPUReservation: 1}}, true},
+		{"affinity", DeploymentSpec{Affinity: &Affinity{
+			Required:         []SelectorRequirement{{Key: "zone", Operator: "In", Values: []string{"a", "b"}}, {Key: "gpu", Operator: "DoesNotExist"}},
+			Preferred:        []Preference{{Weight: 10, SelectorRequirement: SelectorRequirement{Key: "cores", Operator: "Gt", Values: []string{"8"}}}},
+			AvoidDeployments: []string{"db"},
+		}}, false},
+		{"in without values", DeploymentSpec{Affinity: &Affinity{Required: []SelectorRequirement{{Key: "zone", Operator: "In"}}}}, true},
+		{"non-numeric gt", DeploymentSpec{Affinity: &Affinity{Required: []SelectorRequirement{{Key: "cores", Operator: "Gt", Values: []string{"many"}}}}}, true},
+		{"unknown operator", DeploymentSpec{Affinity: &Affinity{Required: []SelectorRequirement{{Key: "zone", Operator: "Near"}}}}, true},
+		{"zero weight", DeploymentSpec{Affinity: &Affinity{Preferred: []Preference{{SelectorRequirement: SelectorRequirement{Key: "ssd", Operator: "Exists"}}}}}, true},
+		{"tolerations", DeploymentSpec{Tolerations: []Toleration{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}, {Operator: "Exists"}}}, false},
+		{"toleration without key", DeploymentSpec{Tolerations: []Toleration{{Value: "gpu"}}}, true},
+		{"unknown toleration effect", DeploymentSpec{Tolerations: []Toleration{{Key: "x", Effect: "PreferNoSchedule"}}}, true},
+	}
+	for _, c := range cases {
+		err := c.spec.Validate()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: expected error %v, but got %v", c.name, c.wantErr, err)
+		}
+	}
+}
+
+func TestNetworkSpecValidate(t *testing.T) {
+	cases := []struct {
+		network NetworkSpec
+		wantErr bool
+	}{
+		{NetworkSpec{Name: "front"}, false},
+		{NetworkSpec{Name: "back", Driver: "bridge", Subnet: "172.30.0.0/24"}, false},
+		{NetworkSpec{Name: ""}, true},
+		{NetworkSpec{Name: "mesh", Driver: "weave"}, true},
+		{NetworkSpec{Name: "back", Subnet: "172.30.0.0"}, true},
+		{NetworkSpec{Name: "pods", Driver: "mesh", Subnet: "10.200.0.0/16"}, false},
+		{NetworkSpec{Name: "pods", Driver: "mesh"}, true},
+		{NetworkSpec{Name: "pods", Driver: "mesh", Subnet: "10.200.0.0/24"}, true},
+	}
+	for _, c := range cases {
+		err := c.network.Validate()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%+v: expected error %v, but got %v", c.network, c.wantErr, err)
+		}
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	cases := map[string]string{
+		"nginx:latest":                  "docker.io",
+		"library/nginx":                 "docker.io",
+		"ghcr.io/org/app:1.0":           "ghcr.io",
+		"Registry.Example.com:5000/app": "registry.example.com:5000",
+		"localhost/app":                 "localhost",
+		"index.docker.io/library/nginx": "docker.io",
+	}
+	for image, want := range cases {
+		if got := ImageRegistry(image); got != want {
+			t.Errorf("Expected registry of %s to be %s, but got %s", image, want, got)
+		}
+	}
+	if got := NormalizeRegistry("https://ghcr.io/v2/"); got != "ghcr.io" {
+		t.Errorf("Expected ghcr.io, but got %s", got)
+	}
+}
+
+func TestTaintsAndTolerations(t *testing.T) {
+	taint, err := ParseTaint("dedicated=gpu:NoSchedule")
+	if err != nil {
+		t.Fatalf("ParseTaint failed: %v", err)
+	}
+	if taint != (Taint{Key: "dedicated", Value: "gpu", Effect: TaintNoSchedule}) || taint.String() != "dedicated=gpu:NoSchedule" {
+		t.Errorf("Expected dedicated=gpu:NoSchedule, but got %+v", taint)
+	}
+	for _, bad := range []string{"dedicated=gpu", ":NoSchedule", "dedicated:PreferNoSchedule"} {
+		if _, err := ParseTaint(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+
+	cases := []struct {
+		toleration Toleration
+		want       bool
+	}{
+		{Toleration{Key: "dedicated", Value: "gpu"}, true},
+		{Toleration{Key: "dedicated", Value: "cpu"}, false},
+		{Toleration{Key: "dedicated", Operator: "Exists"}, true},
+		{Toleration{Operator: "Exists"}, true},
+		{Toleration{Key: "dedicated", Value: "gpu", Effect: TaintNoExecute}, false},
+	}
+	for _, c := range cases {
+		if got := c.toleration.Tolerates(taint); got != c.want {
+			t.Errorf("%+v: Expected %v, but got %v", c.toleration, c.want, got)
+		}
+	}
+}
+
+func TestScheduledPortRange(t *testing.T) {
+	ranged := DeploymentSpec{Ports: []PortBinding{{ContainerPort: 7000, ContainerPortEnd: 7002}}}
+	if !ranged.Scheduled() {
+		t.Errorf("Expected a port range without host ports to be placed by the server")
+	}
+	fixed := DeploymentSpec{Ports: []PortBinding{{HostPort: 7000, ContainerPort: 7000, ContainerPortEnd: 7002}, {ContainerPort: 8080}}}
+	if fixed.Scheduled() {
+		t.Errorf("Expected a fixed port range and a single port to be broadcast")
+	}
+}
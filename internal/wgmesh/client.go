@@ -55,50 +55,74 @@ type PeersListResult struct {
 	Peers []*PeerInfo `json:"peers"`
 }
 
+// Route sends traffic for Subnet to the peer with mesh IP Via.
+type Route struct {
+	Subnet string `json:"subnet"`
+	Via    string `json:"via"`
+}
+
 // GetPeers connects to the wg-mesh socket and fetches the list of peers.
 func (c *Client) GetPeers() ([]*PeerInfo, error) {
+	var peersResult PeersListResult
+	if err := c.call("peers.list", nil, &peersResult); err != nil {
+		return nil, err
+	}
+	return peersResult.Peers, nil
+}
+
+// SetRoutes replaces the extra routes wg-mesh maintains on this node: each
+// subnet is added to the allowed IPs of the peer owning Via and routed over
+// the WireGuard interface.
+func (c *Client) SetRoutes(routes []Route) error {
+	return c.call("routes.set", map[string]interface{}{"routes": routes}, nil)
+}
+
+// call performs one JSON-RPC call and decodes its result into result, if set.
+func (c *Client) call(method string, params map[string]interface{}, result interface{}) error {
 	conn, err := net.Dial("unix", c.socketPath)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to wg-mesh socket at %s: %w", c.socketPath, err)
+		return fmt.Errorf("could not connect to wg-mesh socket at %s: %w", c.socketPath, err)
 	}
 	defer conn.Close()
 
 	request := RPCRequest{
 		JSONRPC: "2.0",
-		Method:  "peers.list",
+		Method:  method,
+		Params:  params,
 		ID:      1,
 	}
 
 	reqBytes, err := json.Marshal(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal JSON-RPC request: %w", err)
+		return fmt.Errorf("failed to marshal JSON-RPC request: %w", err)
 	}
 
 	// wg-mesh expects newline-delimited requests
 	_, err = conn.Write(append(reqBytes, '\n'))
 	if err != nil {
-		return nil, fmt.Errorf("failed to write to socket: %w", err)
+		return fmt.Errorf("failed to write to socket: %w", err)
 	}
 
 	reader := bufio.NewReader(conn)
 	resBytes, err := reader.ReadBytes('\n')
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response from socket: %w", err)
+		return fmt.Errorf("failed to read response from socket: %w", err)
 	}
 
 	var response RPCResponse
 	if err := json.Unmarshal(resBytes, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON-RPC response: %w", err)
+		return fmt.Errorf("failed to unmarshal JSON-RPC response: %w", err)
 	}
 
 	if response.Error != nil {
-		return nil, fmt.Errorf("received error from wg-mesh: %s (code: %d)", response.Error.Message, response.Error.Code)
+		return fmt.Errorf("received error from wg-mesh: %s (code: %d)", response.Error.Message, response.Error.Code)
 	}
 
-	var peersResult PeersListResult
-	if err := json.Unmarshal(response.Result, &peersResult); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal nested peers result: %w", err)
+	if result == nil {
+		return nil
 	}
-
-	return peersResult.Peers, nil
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("failed to unmarshal %s result: %w", method, err)
+	}
+	return nil
 }